@@ -0,0 +1,44 @@
+package discover
+
+import (
+	"errors"
+	"strings"
+)
+
+// 注册中心类型
+const (
+	BackendConsul = "consul"
+	BackendEtcd   = "etcd"
+	BackendStatic = "static"
+)
+
+var (
+	ErrUnknownBackend = errors.New("unknown service discovery backend")
+)
+
+// 创建服务发现客户端的配置
+type BackendConfig struct {
+	Backend string // 注册中心类型
+
+	ConsulHost string // Consul Host
+	ConsulPort int    // Consul Port
+
+	EtcdEndpoints string // etcd 地址, 多个以逗号分隔
+	EtcdPrefix    string // etcd 服务注册键前缀
+
+	StaticFile string // 服务实例文件, 为空时仅使用内存注册表
+}
+
+// 根据注册中心类型创建服务发现客户端
+func NewDiscoveryClient(config *BackendConfig) (DiscoveryClientV2, error) {
+	switch config.Backend {
+	case BackendConsul, "":
+		return NewKitDiscoverClient(config.ConsulHost, config.ConsulPort)
+	case BackendEtcd:
+		return NewEtcdDiscoverClient(strings.Split(config.EtcdEndpoints, ","), config.EtcdPrefix)
+	case BackendStatic:
+		return NewStaticDiscoveryClient(config.StaticFile)
+	default:
+		return nil, ErrUnknownBackend
+	}
+}
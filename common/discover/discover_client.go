@@ -1,6 +1,9 @@
 package discover
 
-import "log"
+import (
+	"context"
+	"log"
+)
 
 type DiscoveryClient interface {
 	/**
@@ -26,3 +29,63 @@ type DiscoveryClient interface {
 	*/
 	DiscoveryServices(serviceName string, logger *log.Logger) []interface{}
 }
+
+// 支持 context 并返回错误的服务注册与发现接口
+// 通过 NewLegacyDiscoveryClient 可以适配为 DiscoveryClient
+type DiscoveryClientV2 interface {
+	/**
+	服务注册接口
+	@param serviceName 服务名
+	@param instanceId 服务实例Id
+	@param healthCheckUrl 健康实例地址
+	@param instanceHost 服务实例地址
+	@param instancePort 服务实例端口
+	@param options 标签、元数据、权重和附加健康检查等注册选项, 为空时使用默认配置
+	*/
+	Register(ctx context.Context, serviceName, instanceId, healthCheckUrl, instanceHost string, instancePort int, options *RegisterOptions) error
+
+	/**
+	服务注销接口
+	@param instanceId 服务实例Id
+	*/
+	DeRegister(ctx context.Context, instanceId string) error
+
+	/**
+	服务发现接口, 没有可用实例时返回空列表, 注册中心不可用时返回错误
+	@param serviceName 服务名
+	*/
+	DiscoveryServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error)
+
+	/**
+	关闭客户端, 停止实例监控和心跳, 已注册的实例不会被注销
+	*/
+	Close() error
+}
+
+// 订阅服务实例变化, 负载均衡器和网关可据此更新实例而无需轮询
+type InstanceSubscriber interface {
+	/**
+	订阅服务实例变化, 每次实例列表变化时推送最新的健康实例
+	通道只保留最新的实例列表, 客户端关闭后通道关闭
+	@param serviceName 服务名
+	*/
+	Subscribe(serviceName string) <-chan []*ServiceInstance
+}
+
+// 一次性查询服务实例, 未监控的服务不缓存也不开启监控
+// 网关等按请求路径查询任意服务名的调用方据此判断服务是否存在, 避免为不存在的服务创建监控
+type InstanceLookup interface {
+	/**
+	查询服务的健康实例, 已监控的服务返回缓存的实例
+	@param serviceName 服务名
+	*/
+	LookupServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error)
+}
+
+// 客户端支持时一次性查询服务实例, 否则使用 DiscoveryServices
+func LookupServices(client DiscoveryClientV2, ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	if lookup, ok := client.(InstanceLookup); ok {
+		return lookup.LookupServices(ctx, serviceName)
+	}
+	return client.DiscoveryServices(ctx, serviceName)
+}
@@ -0,0 +1,342 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInstanceNotRegistered = errors.New("service instance is not registered by this client")
+)
+
+const (
+	// 默认服务注册键前缀, 实例键为 {prefix}{serviceName}/{instanceId}
+	DefaultEtcdPrefix = "/services/"
+	// 默认租约时长 秒
+	DefaultEtcdLeaseTTL = 10
+)
+
+// 重新注册的退避间隔
+const (
+	etcdRegisterMinBackoff = 500 * time.Millisecond
+	etcdRegisterMaxBackoff = 30 * time.Second
+)
+
+// etcd 服务注册信息, 由租约保活, 租约过期后重新创建
+type etcdRegistration struct {
+	cancel context.CancelFunc // 停止租约续期
+	done   chan struct{}      // 续期已停止
+
+	mutex   sync.Mutex
+	leaseId clientv3.LeaseID
+}
+
+func (registration *etcdRegistration) lease() clientv3.LeaseID {
+	registration.mutex.Lock()
+	defer registration.mutex.Unlock()
+	return registration.leaseId
+}
+
+func (registration *etcdRegistration) setLease(leaseId clientv3.LeaseID) {
+	registration.mutex.Lock()
+	registration.leaseId = leaseId
+	registration.mutex.Unlock()
+}
+
+type EtcdDiscoverClient struct {
+	Endpoints []string // etcd 地址
+	Prefix    string   // 服务注册键前缀
+	TTL       int64    // 租约时长 秒
+
+	client *clientv3.Client
+
+	mutex sync.Mutex
+	// 本客户端注册的服务实例
+	registrations map[string]*etcdRegistration
+	// 服务实例缓存字段
+	instancesMap sync.Map
+	// 停止所有监控
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (etcdClient *EtcdDiscoverClient) Register(ctx context.Context, serviceName, instanceId, healthCheckUrl, instanceHost string, instancePort int, options *RegisterOptions) error {
+	// etcd 没有主动健康检查, 以租约续期作为实例存活依据, healthCheckUrl 与健康检查选项不使用
+	value, err := json.Marshal(options.serviceInstance(serviceName, instanceId, instanceHost, instancePort))
+	if err != nil {
+		return err
+	}
+
+	// 创建租约并写入实例信息
+	key := etcdClient.instanceKey(serviceName, instanceId)
+	leaseId, err := etcdClient.put(ctx, key, string(value))
+	if err != nil {
+		return err
+	}
+
+	// 租约续期, 续期不跟随请求的 ctx, 直到注销或关闭客户端
+	keepAliveCtx, cancel := context.WithCancel(etcdClient.ctx)
+	registration := &etcdRegistration{leaseId: leaseId, cancel: cancel, done: make(chan struct{})}
+	etcdClient.wg.Add(1)
+	go func() {
+		defer etcdClient.wg.Done()
+		defer close(registration.done)
+		etcdClient.keepAlive(keepAliveCtx, registration, instanceId, key, string(value))
+	}()
+
+	etcdClient.mutex.Lock()
+	previous := etcdClient.registrations[instanceId]
+	etcdClient.registrations[instanceId] = registration
+	etcdClient.mutex.Unlock()
+
+	// 重复注册时释放之前的租约
+	if previous != nil {
+		etcdClient.stop(context.Background(), previous)
+	}
+	return nil
+}
+
+func (etcdClient *EtcdDiscoverClient) DeRegister(ctx context.Context, instanceId string) error {
+	etcdClient.mutex.Lock()
+	registration, ok := etcdClient.registrations[instanceId]
+	delete(etcdClient.registrations, instanceId)
+	etcdClient.mutex.Unlock()
+	if !ok {
+		return ErrInstanceNotRegistered
+	}
+
+	// 停止续期并撤销租约, 租约下的实例键随之删除
+	return etcdClient.stop(ctx, registration)
+}
+
+// 创建租约并写入实例信息, 写入失败时撤销租约
+func (etcdClient *EtcdDiscoverClient) put(ctx context.Context, key, value string) (clientv3.LeaseID, error) {
+	lease, err := etcdClient.client.Grant(ctx, etcdClient.TTL)
+	if err != nil {
+		return 0, err
+	}
+	_, err = etcdClient.client.Put(ctx, key, value, clientv3.WithLease(lease.ID))
+	if err != nil {
+		etcdClient.client.Revoke(context.Background(), lease.ID)
+		return 0, err
+	}
+	return lease.ID, nil
+}
+
+// 续期租约, 租约过期或续期中断时按退避间隔重新创建租约并写入实例, 直到注销或关闭客户端
+func (etcdClient *EtcdDiscoverClient) keepAlive(ctx context.Context, registration *etcdRegistration, instanceId, key, value string) {
+	backoff := etcdRegisterMinBackoff
+	leaseId := registration.lease()
+	for {
+		keepAlive, err := etcdClient.client.KeepAlive(ctx, leaseId)
+		if err == nil {
+			// 消费续期响应, 通道关闭说明续期停止
+			for range keepAlive {
+				backoff = etcdRegisterMinBackoff
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("etcd keepalive for instance %s stopped, register again", instanceId)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > etcdRegisterMaxBackoff {
+				backoff = etcdRegisterMaxBackoff
+			}
+			if leaseId, err = etcdClient.put(ctx, key, value); err == nil {
+				registration.setLease(leaseId)
+				break
+			}
+			log.Printf("etcd register instance %s again error! %v", instanceId, err)
+		}
+	}
+}
+
+// 停止续期并撤销当前的租约
+func (etcdClient *EtcdDiscoverClient) stop(ctx context.Context, registration *etcdRegistration) error {
+	registration.cancel()
+	<-registration.done
+	_, err := etcdClient.client.Revoke(ctx, registration.lease())
+	return err
+}
+
+func (etcdClient *EtcdDiscoverClient) DiscoveryServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	// 该服务已监控并缓存
+	instanceList, ok := etcdClient.instancesMap.Load(serviceName)
+	if ok {
+		return instanceList.([]*ServiceInstance), nil
+	}
+
+	// 读取实例时不持有锁, 避免网络请求阻塞注册和注销
+	instances, revision, err := etcdClient.load(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	etcdClient.mutex.Lock()
+	defer etcdClient.mutex.Unlock()
+	// 再次判断是否监控, 并发查询同一服务时只保留先完成的结果和监控
+	instanceList, ok = etcdClient.instancesMap.Load(serviceName)
+	if ok {
+		return instanceList.([]*ServiceInstance), nil
+	}
+	list := etcdClient.snapshot(instances)
+	etcdClient.instancesMap.Store(serviceName, list)
+
+	// 从读取的版本之后开始监控前缀, 维护实例缓存
+	etcdClient.wg.Add(1)
+	go func() {
+		defer etcdClient.wg.Done()
+		etcdClient.watch(serviceName, instances, revision)
+	}()
+	return list, nil
+}
+
+func (etcdClient *EtcdDiscoverClient) LookupServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	instanceList, ok := etcdClient.instancesMap.Load(serviceName)
+	if ok {
+		return instanceList.([]*ServiceInstance), nil
+	}
+	instances, _, err := etcdClient.load(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return etcdClient.snapshot(instances), nil
+}
+
+// 停止续期和监控并关闭 etcd 连接, 已注册的实例在租约到期后失效
+func (etcdClient *EtcdDiscoverClient) Close() error {
+	etcdClient.cancel()
+	etcdClient.wg.Wait()
+	return etcdClient.client.Close()
+}
+
+func (etcdClient *EtcdDiscoverClient) servicePrefix(serviceName string) string {
+	return etcdClient.Prefix + serviceName + "/"
+}
+
+func (etcdClient *EtcdDiscoverClient) instanceKey(serviceName, instanceId string) string {
+	return etcdClient.servicePrefix(serviceName) + instanceId
+}
+
+// 读取服务的全部实例, 返回读取时的版本号
+func (etcdClient *EtcdDiscoverClient) load(ctx context.Context, serviceName string) (map[string]*ServiceInstance, int64, error) {
+	resp, err := etcdClient.client.Get(ctx, etcdClient.servicePrefix(serviceName), clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+	instances := make(map[string]*ServiceInstance, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		if instance, err := decodeEtcdInstance(kv.Value); err == nil {
+			instances[string(kv.Key)] = instance
+		}
+	}
+	return instances, resp.Header.Revision, nil
+}
+
+// 监控服务前缀, 监控中断(如版本被压缩)时重新读取全量实例
+func (etcdClient *EtcdDiscoverClient) watch(serviceName string, instances map[string]*ServiceInstance, revision int64) {
+	prefix := etcdClient.servicePrefix(serviceName)
+	for {
+		watchChan := etcdClient.client.Watch(etcdClient.ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+		for resp := range watchChan {
+			if resp.Err() != nil {
+				break
+			}
+			for _, event := range resp.Events {
+				key := string(event.Kv.Key)
+				switch event.Type {
+				case mvccpb.PUT:
+					if instance, err := decodeEtcdInstance(event.Kv.Value); err == nil {
+						instances[key] = instance
+					}
+				case mvccpb.DELETE:
+					delete(instances, key)
+				}
+			}
+			revision = resp.Header.Revision
+			etcdClient.store(serviceName, instances)
+		}
+
+		// 客户端已关闭
+		if etcdClient.ctx.Err() != nil {
+			return
+		}
+		for {
+			latest, latestRevision, err := etcdClient.load(etcdClient.ctx, serviceName)
+			if err == nil {
+				instances, revision = latest, latestRevision
+				etcdClient.store(serviceName, instances)
+				break
+			}
+			select {
+			case <-etcdClient.ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+func (etcdClient *EtcdDiscoverClient) store(serviceName string, instances map[string]*ServiceInstance) {
+	etcdClient.instancesMap.Store(serviceName, etcdClient.snapshot(instances))
+}
+
+func (etcdClient *EtcdDiscoverClient) snapshot(instances map[string]*ServiceInstance) []*ServiceInstance {
+	list := make([]*ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		list = append(list, instance)
+	}
+	return list
+}
+
+func decodeEtcdInstance(value []byte) (*ServiceInstance, error) {
+	instance := &ServiceInstance{}
+	if err := json.Unmarshal(value, instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// 创建 etcd 的服务注册客户端
+func NewEtcdDiscoverClient(endpoints []string, prefix string) (*EtcdDiscoverClient, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix == "" {
+		prefix = DefaultEtcdPrefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &EtcdDiscoverClient{
+		Endpoints:     endpoints,
+		Prefix:        prefix,
+		TTL:           DefaultEtcdLeaseTTL,
+		client:        client,
+		registrations: make(map[string]*etcdRegistration),
+		ctx:           ctx,
+		cancel:        cancel,
+	}, nil
+}
@@ -0,0 +1,208 @@
+package discover
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/etcd/embed"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// 启动内嵌的 etcd 服务, 返回客户端地址
+func startEmbedEtcd(t *testing.T) (string, func()) {
+	if raceEnabled {
+		t.Skip("coreos/bbolt v1.3.3 fails checkptr under -race")
+	}
+	dir, err := ioutil.TempDir("", "etcd-discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	clientUrl, _ := url.Parse("http://" + freeAddress(t))
+	peerUrl, _ := url.Parse("http://" + freeAddress(t))
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientUrl}, []url.URL{*clientUrl}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerUrl}, []url.URL{*peerUrl}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatal("embed etcd start timeout")
+	}
+
+	return clientUrl.Host, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// 等待服务实例数量达到预期
+func waitInstances(t *testing.T, client DiscoveryClientV2, serviceName string, expect int) []*ServiceInstance {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		instances, err := client.DiscoveryServices(context.Background(), serviceName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(instances) == expect {
+			return instances
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d instances of %s, got %d", expect, serviceName, len(instances))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestEtcdDiscoverClient(t *testing.T) {
+	endpoint, stop := startEmbedEtcd(t)
+	defer stop()
+
+	client, err := NewEtcdDiscoverClient([]string{endpoint}, "/test-services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	if err := client.Register(ctx, "string", "string-1", "/health", "127.0.0.1", 10085, &RegisterOptions{Meta: map[string]string{"zone": "cn-east"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 一次性查询不缓存也不开启监控
+	instances, err := client.LookupServices(ctx, "string")
+	if err != nil || len(instances) != 1 {
+		t.Fatalf("expect 1 instance from lookup, got %v %v", instances, err)
+	}
+	if _, ok := client.instancesMap.Load("string"); ok {
+		t.Fatal("expect lookup not to cache instances")
+	}
+
+	instances = waitInstances(t, client, "string", 1)
+	instance := instances[0]
+	if instance.ID != "string-1" || instance.Host != "127.0.0.1" || instance.Port != 10085 || instance.Meta["zone"] != "cn-east" {
+		t.Fatalf("unexpected instance %+v", instance)
+	}
+
+	// 注册后由监控更新缓存
+	if err := client.Register(ctx, "string", "string-2", "/health", "127.0.0.1", 10086, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitInstances(t, client, "string", 2)
+
+	// 注销后撤销租约, 实例被删除
+	if err := client.DeRegister(ctx, "string-1"); err != nil {
+		t.Fatal(err)
+	}
+	instances = waitInstances(t, client, "string", 1)
+	if instances[0].ID != "string-2" {
+		t.Fatalf("expect string-2 left, got %s", instances[0].ID)
+	}
+
+	if err := client.DeRegister(ctx, "string-1"); err != ErrInstanceNotRegistered {
+		t.Fatalf("expect ErrInstanceNotRegistered, got %v", err)
+	}
+
+	// 其他服务不受影响
+	instances, err = client.DiscoveryServices(ctx, "oauth")
+	if err != nil || len(instances) != 0 {
+		t.Fatalf("expect no oauth instances, got %v %v", instances, err)
+	}
+}
+
+func TestEtcdDiscoverClientLeaseExpire(t *testing.T) {
+	endpoint, stop := startEmbedEtcd(t)
+	defer stop()
+
+	watcher, err := NewEtcdDiscoverClient([]string{endpoint}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	// 注册方关闭后不再续期, 租约到期后实例失效
+	registrar, err := NewEtcdDiscoverClient([]string{endpoint}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrar.TTL = 2
+	for i := 0; i < 3; i++ {
+		err := registrar.Register(context.Background(), "use-string", fmt.Sprintf("use-string-%d", i), "/health", "127.0.0.1", 10090+i, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitInstances(t, watcher, "use-string", 3)
+
+	// 续期期间实例保持存在
+	time.Sleep(3 * time.Second)
+	waitInstances(t, watcher, "use-string", 3)
+
+	registrar.Close()
+	waitInstances(t, watcher, "use-string", 0)
+}
+
+func TestEtcdDiscoverClientRegisterAgain(t *testing.T) {
+	endpoint, stop := startEmbedEtcd(t)
+	defer stop()
+
+	client, err := NewEtcdDiscoverClient([]string{endpoint}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+	if err := client.Register(ctx, "string", "string-1", "/health", "127.0.0.1", 10085, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitInstances(t, client, "string", 1)
+
+	// 租约失效后重新创建租约并写入实例
+	client.mutex.Lock()
+	registration := client.registrations["string-1"]
+	client.mutex.Unlock()
+	expired := registration.lease()
+	if _, err := client.client.Revoke(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for registration.lease() == expired {
+		if time.Now().After(deadline) {
+			t.Fatal("expect instance registered again with a new lease")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	resp, err := client.client.Get(ctx, client.instanceKey("string", "string-1"))
+	if err != nil || len(resp.Kvs) != 1 || resp.Kvs[0].Lease != int64(registration.lease()) {
+		t.Fatalf("expect instance key with the new lease, got %v %v", resp, err)
+	}
+	waitInstances(t, client, "string", 1)
+
+	// 注销后撤销新的租约, 不再重新注册
+	if err := client.DeRegister(ctx, "string-1"); err != nil {
+		t.Fatal(err)
+	}
+	waitInstances(t, client, "string", 0)
+}
@@ -0,0 +1,97 @@
+package discover
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrInvalidMeta = errors.New("meta must be in key=value format")
+)
+
+// 服务实例过滤条件, 用于按版本、区域等选择服务实例
+type InstanceFilter struct {
+	Tags []string          // 需包含的全部标签, 如 v2、canary
+	Meta map[string]string // 需匹配的全部元数据, 如 zone=cn-east
+}
+
+// 判断服务实例是否满足过滤条件
+func (filter *InstanceFilter) Match(instance *ServiceInstance) bool {
+	if filter == nil {
+		return true
+	}
+	for _, tag := range filter.Tags {
+		if !hasTag(instance.Tags, tag) {
+			return false
+		}
+	}
+	for key, value := range filter.Meta {
+		if actual, ok := instance.Meta[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// 过滤服务实例, 不修改传入的列表
+func (filter *InstanceFilter) Filter(instances []*ServiceInstance) []*ServiceInstance {
+	if filter.empty() {
+		return instances
+	}
+	result := make([]*ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		if filter.Match(instance) {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
+
+func (filter *InstanceFilter) empty() bool {
+	return filter == nil || (len(filter.Tags) == 0 && len(filter.Meta) == 0)
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*
+解析命令行中的过滤条件
+@param tags 标签, 多个以逗号分隔, 如 v2,canary
+@param meta 元数据, 多个以逗号分隔, 如 zone=cn-east,env=prod
+*/
+func ParseInstanceFilter(tags, meta string) (*InstanceFilter, error) {
+	metaFilter, err := parseMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+	return &InstanceFilter{Tags: parseList(tags), Meta: metaFilter}, nil
+}
+
+// 按过滤条件返回服务实例的服务发现客户端
+// 过滤基于客户端缓存的健康实例进行, 各注册中心均适用
+type filteredDiscoveryClient struct {
+	DiscoveryClientV2
+	filter *InstanceFilter
+}
+
+func NewFilteredDiscoveryClient(client DiscoveryClientV2, filter *InstanceFilter) DiscoveryClientV2 {
+	if filter.empty() {
+		return client
+	}
+	return &filteredDiscoveryClient{DiscoveryClientV2: client, filter: filter}
+}
+
+func (filtered *filteredDiscoveryClient) DiscoveryServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	instances, err := filtered.DiscoveryClientV2.DiscoveryServices(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return filtered.filter.Filter(instances), nil
+}
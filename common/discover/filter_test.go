@@ -0,0 +1,88 @@
+package discover
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInstanceFilter(t *testing.T) {
+	instances := []*ServiceInstance{
+		{ID: "string-1", Tags: []string{"v1"}, Meta: map[string]string{"zone": "cn-east"}},
+		{ID: "string-2", Tags: []string{"v2"}, Meta: map[string]string{"zone": "cn-east"}},
+		{ID: "string-3", Tags: []string{"v2", "canary"}, Meta: map[string]string{"zone": "cn-north"}},
+	}
+
+	cases := []struct {
+		tags, meta string
+		expect     []string
+	}{
+		{"", "", []string{"string-1", "string-2", "string-3"}},
+		{"v2", "", []string{"string-2", "string-3"}},
+		{"v2,canary", "", []string{"string-3"}},
+		{"", "zone=cn-east", []string{"string-1", "string-2"}},
+		{"v2", "zone=cn-east", []string{"string-2"}},
+		{"v3", "", nil},
+	}
+	for _, c := range cases {
+		filter, err := ParseInstanceFilter(c.tags, c.meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := filter.Filter(instances)
+		if len(result) != len(c.expect) {
+			t.Fatalf("tags %q meta %q: expect %v, got %d instances", c.tags, c.meta, c.expect, len(result))
+		}
+		for i, instance := range result {
+			if instance.ID != c.expect[i] {
+				t.Fatalf("tags %q meta %q: expect %v, got %s at %d", c.tags, c.meta, c.expect, instance.ID, i)
+			}
+		}
+	}
+
+	if _, err := ParseInstanceFilter("", "zone"); err != ErrInvalidMeta {
+		t.Fatalf("expect ErrInvalidMeta, got %v", err)
+	}
+}
+
+func TestFilteredDiscoveryClient(t *testing.T) {
+	consul, host, port, stop := startFakeConsul(t)
+	defer stop()
+	v1, v2 := fakeEntry("string-1", 10085, true), fakeEntry("string-2", 10086, true)
+	v1.Service.Tags, v1.Service.Meta = []string{"v1"}, map[string]string{"zone": "cn-east"}
+	v2.Service.Tags, v2.Service.Meta = []string{"v2"}, map[string]string{"zone": "cn-north"}
+	consul.set("string", v1, v2)
+
+	kitClient, err := NewKitDiscoverClient(host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kitClient.Close()
+	myClient := NewMyDiscoverClient(host, port)
+	defer myClient.Close()
+
+	// 两种 consul 客户端均按标签与元数据过滤
+	for _, client := range []DiscoveryClientV2{kitClient, myClient} {
+		byTag := NewFilteredDiscoveryClient(client, &InstanceFilter{Tags: []string{"v2"}})
+		instances, err := byTag.DiscoveryServices(context.Background(), "string")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(instances) != 1 || instances[0].ID != "string-2" {
+			t.Fatalf("expect string-2 by tag, got %+v", instances)
+		}
+
+		byMeta := NewFilteredDiscoveryClient(client, &InstanceFilter{Meta: map[string]string{"zone": "cn-east"}})
+		instances, err = byMeta.DiscoveryServices(context.Background(), "string")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(instances) != 1 || instances[0].ID != "string-1" {
+			t.Fatalf("expect string-1 by meta, got %+v", instances)
+		}
+	}
+
+	// 没有过滤条件时直接使用原客户端
+	if NewFilteredDiscoveryClient(myClient, &InstanceFilter{}) != DiscoveryClientV2(myClient) {
+		t.Fatal("expect original client for empty filter")
+	}
+}
@@ -0,0 +1,57 @@
+package discover
+
+import (
+	"github.com/hashicorp/consul/api"
+)
+
+// 服务发现返回的服务实例
+type ServiceInstance struct {
+	ID      string            `json:"id"`                // 服务实例ID
+	Name    string            `json:"name"`              // 服务名
+	Host    string            `json:"host"`              // 服务实例HOST
+	Port    int               `json:"port"`              // 服务实例端口
+	Tags    []string          `json:"tags,omitempty"`    // 标签
+	Meta    map[string]string `json:"meta,omitempty"`    // 元数据
+	Weights Weights           `json:"weights,omitempty"` // 权重
+}
+
+// 转换为 consul 的服务实例结构, 供负载均衡器使用
+func (instance *ServiceInstance) AgentService() *api.AgentService {
+	return &api.AgentService{
+		ID:      instance.ID,
+		Service: instance.Name,
+		Tags:    instance.Tags,
+		Meta:    instance.Meta,
+		Port:    instance.Port,
+		Address: instance.Host,
+		Weights: api.AgentWeights{
+			Passing: instance.Weights.Passing,
+			Warning: instance.Weights.Warning,
+		},
+	}
+}
+
+// 批量转换为 consul 的服务实例结构
+func ToAgentServices(instances []*ServiceInstance) []*api.AgentService {
+	services := make([]*api.AgentService, len(instances))
+	for i := 0; i < len(instances); i++ {
+		services[i] = instances[i].AgentService()
+	}
+	return services
+}
+
+// 由 consul 的服务实例结构创建服务实例
+func newServiceInstance(service *api.AgentService) *ServiceInstance {
+	return &ServiceInstance{
+		ID:   service.ID,
+		Name: service.Service,
+		Host: service.Address,
+		Port: service.Port,
+		Tags: service.Tags,
+		Meta: service.Meta,
+		Weights: Weights{
+			Passing: service.Weights.Passing,
+			Warning: service.Weights.Warning,
+		},
+	}
+}
@@ -0,0 +1,183 @@
+package discover
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/hashicorp/consul/api"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 不支持订阅的服务发现客户端, 查询服务实例的间隔
+const DefaultInstancerPollInterval = time.Second
+
+// go-kit 的 sd.Instancer, 由服务发现客户端提供服务实例
+// 实例字符串为 host:port, 可配合 sd.NewEndpointer 为每个实例创建 Endpoint
+// 客户端实现 InstanceSubscriber 时订阅实例变化, 否则定时查询
+type Instancer struct {
+	client      DiscoveryClientV2
+	serviceName string
+	logger      log.Logger
+
+	mutex     sync.RWMutex
+	state     sd.Event
+	instances []*ServiceInstance
+	services  []*api.AgentService
+	registry  map[chan<- sd.Event]struct{}
+
+	quit     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+/*
+*
+创建服务实例的 Instancer, 返回前完成第一次查询
+@param client 服务发现客户端
+@param serviceName 服务名
+*/
+func NewInstancer(client DiscoveryClientV2, serviceName string, logger log.Logger) *Instancer {
+	instances, err := client.DiscoveryServices(context.Background(), serviceName)
+	return newInstancer(client, serviceName, instances, err, logger)
+}
+
+/*
+*
+使用已查询的实例创建 Instancer, 不再查询服务发现客户端, 之后的实例变化由订阅或定时查询更新
+@param client 服务发现客户端
+@param serviceName 服务名
+@param instances 已查询的服务实例, 如 LookupServices 的结果
+*/
+func NewInstancerFrom(client DiscoveryClientV2, serviceName string, instances []*ServiceInstance, logger log.Logger) *Instancer {
+	return newInstancer(client, serviceName, instances, nil, logger)
+}
+
+func newInstancer(client DiscoveryClientV2, serviceName string, instances []*ServiceInstance, err error, logger log.Logger) *Instancer {
+	instancer := &Instancer{
+		client:      client,
+		serviceName: serviceName,
+		logger:      logger,
+		registry:    make(map[chan<- sd.Event]struct{}),
+		quit:        make(chan struct{}),
+	}
+	instancer.update(instances, err)
+
+	instancer.wg.Add(1)
+	if subscriber, ok := client.(InstanceSubscriber); ok {
+		go instancer.subscribe(subscriber.Subscribe(serviceName))
+	} else {
+		go instancer.poll(DefaultInstancerPollInterval)
+	}
+	return instancer
+}
+
+func (instancer *Instancer) subscribe(ch <-chan []*ServiceInstance) {
+	defer instancer.wg.Done()
+	for {
+		select {
+		case instances, ok := <-ch:
+			// 客户端已关闭
+			if !ok {
+				return
+			}
+			instancer.update(instances, nil)
+		case <-instancer.quit:
+			return
+		}
+	}
+}
+
+func (instancer *Instancer) poll(interval time.Duration) {
+	defer instancer.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			instances, err := instancer.client.DiscoveryServices(context.Background(), instancer.serviceName)
+			instancer.update(instances, err)
+		case <-instancer.quit:
+			return
+		}
+	}
+}
+
+// 实例变化时通知所有注册的通道
+func (instancer *Instancer) update(instances []*ServiceInstance, err error) {
+	if err != nil {
+		instancer.logger.Log("service", instancer.serviceName, "err", err)
+	}
+	event := sd.Event{Err: err}
+	if err == nil {
+		event.Instances = make([]string, 0, len(instances))
+		for _, instance := range instances {
+			event.Instances = append(event.Instances, instance.Address())
+		}
+		sort.Strings(event.Instances)
+	}
+
+	instancer.mutex.Lock()
+	defer instancer.mutex.Unlock()
+	// 实例未变化时保持原有的实例, 便于负载均衡器复用按实例缓存的状态
+	if err == nil && !reflect.DeepEqual(instancer.instances, instances) {
+		instancer.instances = instances
+		instancer.services = ToAgentServices(instances)
+	}
+	if reflect.DeepEqual(instancer.state, event) {
+		return
+	}
+	instancer.state = event
+	for ch := range instancer.registry {
+		ch <- copyEvent(event)
+	}
+}
+
+// 当前的服务实例, 供负载均衡器按标签、元数据等选择实例
+func (instancer *Instancer) AgentServices() []*api.AgentService {
+	instancer.mutex.RLock()
+	defer instancer.mutex.RUnlock()
+	return instancer.services
+}
+
+// 实现 sd.Instancer, 注册时立即推送当前实例
+func (instancer *Instancer) Register(ch chan<- sd.Event) {
+	instancer.mutex.Lock()
+	defer instancer.mutex.Unlock()
+	instancer.registry[ch] = struct{}{}
+	ch <- copyEvent(instancer.state)
+}
+
+func (instancer *Instancer) Deregister(ch chan<- sd.Event) {
+	instancer.mutex.Lock()
+	defer instancer.mutex.Unlock()
+	delete(instancer.registry, ch)
+}
+
+// 停止订阅或查询, 不关闭服务发现客户端
+func (instancer *Instancer) Stop() {
+	instancer.stopOnce.Do(func() {
+		close(instancer.quit)
+	})
+	instancer.wg.Wait()
+}
+
+// 每个通道使用独立的实例列表, 避免接收方排序时互相影响
+func copyEvent(event sd.Event) sd.Event {
+	if event.Instances == nil {
+		return event
+	}
+	instances := make([]string, len(event.Instances))
+	copy(instances, event.Instances)
+	event.Instances = instances
+	return event
+}
+
+// 服务实例的地址 host:port
+func (instance *ServiceInstance) Address() string {
+	return net.JoinHostPort(instance.Host, strconv.Itoa(instance.Port))
+}
@@ -0,0 +1,104 @@
+package discover
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"testing"
+	"time"
+)
+
+// 读取 Instancer 推送的事件, 直到实例数量达到预期
+func waitEvent(t *testing.T, ch <-chan sd.Event, expect ...string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-ch:
+			if event.Err == nil && len(event.Instances) == len(expect) {
+				for i := range expect {
+					if event.Instances[i] != expect[i] {
+						t.Fatalf("expect instances %v, got %v", expect, event.Instances)
+					}
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("expect instances %v", expect)
+		}
+	}
+}
+
+func TestInstancerPoll(t *testing.T) {
+	client, err := NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+	client.Register(ctx, "string", "string-2", "", "127.0.0.1", 10086, nil)
+
+	instancer := NewInstancer(client, "string", log.NewNopLogger())
+	defer instancer.Stop()
+
+	// 注册时立即推送当前实例
+	ch := make(chan sd.Event, 1)
+	instancer.Register(ch)
+	waitEvent(t, ch, "127.0.0.1:10086")
+	services := instancer.AgentServices()
+	if len(services) != 1 || services[0].ID != "string-2" {
+		t.Fatalf("unexpected services %+v", services)
+	}
+
+	// 静态客户端不支持订阅, 定时查询实例变化
+	client.Register(ctx, "string", "string-1", "", "127.0.0.1", 10085, nil)
+	waitEvent(t, ch, "127.0.0.1:10085", "127.0.0.1:10086")
+
+	instancer.Deregister(ch)
+	client.DeRegister(ctx, "string-1")
+	time.Sleep(2 * DefaultInstancerPollInterval)
+	select {
+	case event := <-ch:
+		t.Fatalf("expect no event after deregister, got %v", event)
+	default:
+	}
+}
+
+func TestInstancerSubscribe(t *testing.T) {
+	consul, host, port, closeServer := startFakeConsul(t)
+	defer closeServer()
+	consul.set("string", fakeEntry("string-1", 10085, true), fakeEntry("string-2", 10086, false))
+
+	client := NewMyDiscoverClient(host, port)
+	defer client.Close()
+	instancer := NewInstancer(client, "string", log.NewNopLogger())
+
+	ch := make(chan sd.Event, 1)
+	instancer.Register(ch)
+	waitEvent(t, ch, "127.0.0.1:10085")
+
+	// 阻塞查询返回后立即推送
+	consul.set("string", fakeEntry("string-1", 10085, true), fakeEntry("string-2", 10086, true))
+	waitEvent(t, ch, "127.0.0.1:10085", "127.0.0.1:10086")
+
+	instancer.Stop()
+	instancer.Stop()
+}
+
+func TestNewInstancerFrom(t *testing.T) {
+	client, err := NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 使用已查询的实例, 不再查询客户端
+	instancer := NewInstancerFrom(client, "string", []*ServiceInstance{{ID: "string-1", Name: "string", Host: "127.0.0.1", Port: 10085}}, log.NewNopLogger())
+	defer instancer.Stop()
+	ch := make(chan sd.Event, 1)
+	instancer.Register(ch)
+	waitEvent(t, ch, "127.0.0.1:10085")
+
+	// 之后按客户端的实例更新
+	client.Register(context.Background(), "string", "string-2", "", "127.0.0.1", 10086, nil)
+	waitEvent(t, ch, "127.0.0.1:10086")
+}
@@ -1,133 +1,202 @@
 package discover
 
 import (
+	"context"
+	"errors"
 	"github.com/go-kit/kit/sd/consul"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/api/watch"
 	"log"
+	"os"
 	"strconv"
 	"sync"
+	"time"
+)
+
+var (
+	ErrClientClosed = errors.New("discovery client is closed")
 )
 
 type KitDiscoverClient struct {
 	Host   string // Consul Host
 	Port   int    // Consul Port
 	client consul.Client
+	// 用于上报 TTL 检查状态
+	apiClient *api.Client
 
 	// 连接 consul 的配置
 	config *api.Config
 	mutex  sync.Mutex
 	// 服务实例缓存字段
 	instancesMap sync.Map
+	// 各服务的实例监控
+	plans  map[string]*watch.Plan
+	closed bool
+	wg     sync.WaitGroup
+
+	// TTL 模式健康检查, 为空时由 Consul 主动进行 HTTP 检查
+	ttlCheck   *TTLCheck
+	heartbeats ttlHeartbeats
+}
+
+func (consulClient *KitDiscoverClient) SetTTLCheck(check *TTLCheck) {
+	consulClient.ttlCheck = check
 }
 
-func (consulClient *KitDiscoverClient) Register(serviceName, instanceId, healthCheckUrl, instanceHost string, instancePort int, meta map[string]string, logger *log.Logger) bool {
+func (consulClient *KitDiscoverClient) Register(ctx context.Context, serviceName, instanceId, healthCheckUrl, instanceHost string, instancePort int, options *RegisterOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var ttl time.Duration
+	if consulClient.ttlCheck != nil {
+		ttl = consulClient.ttlCheck.TTL
+	}
+	weights := options.weights()
+	checkUrl := ""
+	if healthCheckUrl != "" {
+		checkUrl = "http://" + instanceHost + ":" + strconv.Itoa(instancePort) + healthCheckUrl
+	}
+
 	// 构建服务实例元数据
 	serviceRegistration := &api.AgentServiceRegistration{
 		ID:      instanceId,
 		Name:    serviceName,
+		Tags:    options.tags(),
 		Port:    instancePort,
 		Address: instanceHost,
-		Meta:    meta,
-		Check: &api.AgentServiceCheck{
-			Interval:                       "15s",
-			HTTP:                           "http://" + instanceHost + ":" + strconv.Itoa(instancePort) + healthCheckUrl,
-			DeregisterCriticalServiceAfter: "30s",
-		},
+		Meta:    options.meta(),
+		Weights: &api.AgentWeights{Passing: weights.Passing, Warning: weights.Warning},
+		Checks:  options.agentServiceChecks(instanceId, checkUrl, ttl),
 	}
 
 	// 发送服务注册到Consul中
-	err := consulClient.client.Register(serviceRegistration)
-	if err != nil {
-		log.Println("Register service error!")
-		return false
+	if err := consulClient.client.Register(serviceRegistration); err != nil {
+		return err
 	}
-	log.Println("Register service success!")
-	return true
+	if consulClient.ttlCheck != nil {
+		consulClient.heartbeats.start(instanceId, consulClient.ttlCheck, consulClient.updateTTL)
+	}
+	return nil
+}
+
+// 上报 TTL 检查状态
+func (consulClient *KitDiscoverClient) updateTTL(ctx context.Context, checkId, status, output string) error {
+	return consulClient.apiClient.Agent().UpdateTTL(checkId, output, status)
 }
 
-func (consulClient *KitDiscoverClient) DeRegister(instanceId string, logger *log.Logger) bool {
+func (consulClient *KitDiscoverClient) DeRegister(ctx context.Context, instanceId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// 先停止心跳, 避免注销后继续上报
+	consulClient.heartbeats.stop(instanceId)
 	// 构建包含服务实例ID的元数据结构体
 	serviceRegistration := &api.AgentServiceRegistration{
 		ID: instanceId,
 	}
 	// 发送服务注销请求
-	err := consulClient.client.Deregister(serviceRegistration)
-
-	if err != nil {
-		logger.Println("deregister service Error!")
-		return false
-	}
-
-	logger.Println("Deregister Service success!")
-	return true
+	return consulClient.client.Deregister(serviceRegistration)
 }
 
-func (consulClient *KitDiscoverClient) DiscoveryServices(serviceName string, logger *log.Logger) []interface{} {
+func (consulClient *KitDiscoverClient) DiscoveryServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
 	// 该服务已监控并缓存
 	instanceList, ok := consulClient.instancesMap.Load(serviceName)
 	if ok {
-		return instanceList.([]interface{})
+		return instanceList.([]*ServiceInstance), nil
 	}
 
 	// 单例模型枷锁
 	consulClient.mutex.Lock()
+	defer consulClient.mutex.Unlock()
 	// 再次判断是否监控
 	instanceList, ok = consulClient.instancesMap.Load(serviceName)
 	if ok {
-		return instanceList.([]interface{})
+		return instanceList.([]*ServiceInstance), nil
 	}
-	// 注册监控
-	go func() {
-		// 使用consul 服务实例监控来监控某个服务名的服务实例列表变化
-		params := make(map[string]interface{})
-		params["type"] = "service"
-		params["service"] = serviceName
-		plan, _ := watch.Parse(params)
-		plan.Handler = func(u uint64, i interface{}) {
-			if i == nil {
-				return
-			}
-			v, ok := i.([]*api.ServiceEntry)
-			if !ok {
-				return // 数据异常，忽略
-			}
-			// 没有服务实例在线
-			if len(v) == 0 {
-				consulClient.instancesMap.Store(serviceName, []interface{}{})
-			} else {
-				var healthServices []interface{}
-				for _, service := range v {
-					if service.Checks.AggregatedStatus() == api.HealthPassing {
-						healthServices = append(healthServices, service.Service)
-					}
-				}
-				consulClient.instancesMap.Store(serviceName, healthServices)
-			}
+
+	if consulClient.closed {
+		return nil, ErrClientClosed
+	}
+
+	// 根据服务名请求健康的服务实例列表, 失败时不缓存, 以便下次重新查询
+	queryOptions := (&api.QueryOptions{}).WithContext(ctx)
+	entries, _, err := consulClient.client.Service(serviceName, "", true, queryOptions)
+	if err != nil {
+		return nil, err
+	}
+	instances := passingInstances(entries)
+
+	// 使用consul 服务实例监控来监控某个服务名的服务实例列表变化, 与首次查询一样只保留健康实例
+	plan, err := watch.Parse(map[string]interface{}{
+		"type":        "service",
+		"service":     serviceName,
+		"passingonly": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	plan.Handler = func(index uint64, result interface{}) {
+		entries, ok := result.([]*api.ServiceEntry)
+		if !ok {
+			return // 数据异常，忽略
 		}
-		defer plan.Stop()
-		plan.Run(consulClient.config.Address)
+		consulClient.instancesMap.Store(serviceName, passingInstances(entries))
+	}
+	consulClient.instancesMap.Store(serviceName, instances)
+	consulClient.plans[serviceName] = plan
+
+	// 注册监控, 与客户端共用连接, 由 Close 停止
+	consulClient.wg.Add(1)
+	go func() {
+		defer consulClient.wg.Done()
+		plan.RunWithClientAndLogger(consulClient.apiClient, log.New(os.Stderr, "", log.LstdFlags))
 	}()
-	defer consulClient.mutex.Unlock()
 
-	// 根据服务名请求服务实例列表
-	entries, _, err := consulClient.client.Service(serviceName, "", false, nil)
+	return instances, nil
+}
+
+func (consulClient *KitDiscoverClient) LookupServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	instanceList, ok := consulClient.instancesMap.Load(serviceName)
+	if ok {
+		return instanceList.([]*ServiceInstance), nil
+	}
+	queryOptions := (&api.QueryOptions{}).WithContext(ctx)
+	entries, _, err := consulClient.client.Service(serviceName, "", true, queryOptions)
 	if err != nil {
-		consulClient.instancesMap.Store(serviceName, []interface{}{})
-		logger.Println("Discover Service Error!")
-		return nil
+		return nil, err
 	}
+	return passingInstances(entries), nil
+}
 
-	instances := make([]interface{}, len(entries))
-	for i := 0; i < len(entries); i++ {
-		instances[i] = entries[i].Service
+// 停止所有服务实例监控和心跳, 并关闭空闲连接
+func (consulClient *KitDiscoverClient) Close() error {
+	consulClient.mutex.Lock()
+	consulClient.closed = true
+	for serviceName, plan := range consulClient.plans {
+		plan.Stop()
+		delete(consulClient.plans, serviceName)
+	}
+	consulClient.mutex.Unlock()
+
+	consulClient.wg.Wait()
+	consulClient.heartbeats.stopAll()
+	consulClient.config.Transport.CloseIdleConnections()
+	return nil
+}
+
+// 过滤出健康检查全部通过的服务实例
+func passingInstances(entries []*api.ServiceEntry) []*ServiceInstance {
+	instances := make([]*ServiceInstance, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Checks.AggregatedStatus() == api.HealthPassing {
+			instances = append(instances, newServiceInstance(entry.Service))
+		}
 	}
-	consulClient.instancesMap.Store(serviceName, instances)
 	return instances
 }
 
 // 创建kit的服务注册客户端
-func NewKitDiscoverClient(consulHost string, consulPort int) (DiscoveryClient, error) {
+func NewKitDiscoverClient(consulHost string, consulPort int) (*KitDiscoverClient, error) {
 	// 通过Consul Host和Consul Port创建一个consul.Client
 	consulConfig := api.DefaultConfig()
 
@@ -140,9 +209,11 @@ func NewKitDiscoverClient(consulHost string, consulPort int) (DiscoveryClient, e
 	client := consul.NewClient(apiClient)
 
 	return &KitDiscoverClient{
-		Host:   consulHost,
-		Port:   consulPort,
-		config: consulConfig,
-		client: client,
+		Host:      consulHost,
+		Port:      consulPort,
+		config:    consulConfig,
+		client:    client,
+		apiClient: apiClient,
+		plans:     make(map[string]*watch.Plan),
 	}, err
 }
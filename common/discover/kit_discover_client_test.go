@@ -0,0 +1,97 @@
+package discover
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// 等待协程数量回落, 用于检查协程泄漏
+func waitGoroutines(t *testing.T, expect int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > expect {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("expect at most %d goroutines, got %d\n%s", expect, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKitDiscoverClientWatch(t *testing.T) {
+	consul, host, port, stop := startFakeConsul(t)
+	defer stop()
+	consul.set("string", fakeEntry("string-1", 10085, true), fakeEntry("string-2", 10086, false))
+	consul.set("oauth", fakeEntry("oauth-1", 10098, true))
+	goroutines := runtime.NumGoroutine()
+
+	client, err := NewKitDiscoverClient(host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 首次查询与监控一致, 只返回健康实例
+	instances, err := client.DiscoveryServices(context.Background(), "string")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].ID != "string-1" {
+		t.Fatalf("unexpected instances %+v", instances)
+	}
+	waitInstances(t, client, "oauth", 1)
+
+	// 实例变为健康后由监控更新缓存
+	consul.set("string", fakeEntry("string-1", 10085, true), fakeEntry("string-2", 10086, true))
+	waitInstances(t, client, "string", 2)
+	consul.set("string", fakeEntry("string-1", 10085, false), fakeEntry("string-2", 10086, true))
+	instances = waitInstances(t, client, "string", 1)
+	if instances[0].ID != "string-2" {
+		t.Fatalf("expect string-2 left, got %s", instances[0].ID)
+	}
+
+	// 关闭后停止所有监控, 不再创建新的监控
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitGoroutines(t, goroutines)
+	if _, err := client.DiscoveryServices(context.Background(), "use-string"); err != ErrClientClosed {
+		t.Fatalf("expect ErrClientClosed, got %v", err)
+	}
+}
+
+func TestKitDiscoverClientLookup(t *testing.T) {
+	consul, host, port, stop := startFakeConsul(t)
+	defer stop()
+	consul.set("string", fakeEntry("string-1", 10085, true), fakeEntry("string-2", 10086, false))
+
+	client, err := NewKitDiscoverClient(host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 一次性查询只返回健康实例, 不缓存也不开启监控
+	instances, err := client.LookupServices(context.Background(), "string")
+	if err != nil || len(instances) != 1 || instances[0].ID != "string-1" {
+		t.Fatalf("unexpected instances %+v %v", instances, err)
+	}
+	if _, ok := client.instancesMap.Load("string"); ok || len(client.plans) != 0 {
+		t.Fatal("expect lookup not to watch the service")
+	}
+}
+
+func TestKitDiscoverClientUnavailable(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	client, err := NewKitDiscoverClient("127.0.0.1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 查询失败时不缓存也不开启监控
+	if _, err := client.DiscoveryServices(context.Background(), "string"); err == nil {
+		t.Fatal("expect error when consul is unavailable")
+	}
+	client.Close()
+	waitGoroutines(t, goroutines)
+}
@@ -0,0 +1,49 @@
+package discover
+
+import (
+	"context"
+	"log"
+)
+
+// 将 DiscoveryClientV2 适配为旧的 DiscoveryClient 接口
+// 服务发现返回的实例类型为 *api.AgentService
+type legacyDiscoveryClient struct {
+	client DiscoveryClientV2
+}
+
+func NewLegacyDiscoveryClient(client DiscoveryClientV2) DiscoveryClient {
+	return &legacyDiscoveryClient{client: client}
+}
+
+func (legacy *legacyDiscoveryClient) Register(serviceName, instanceId, healthCheckUrl, instanceHost string, instancePort int, meta map[string]string, logger *log.Logger) bool {
+	err := legacy.client.Register(context.Background(), serviceName, instanceId, healthCheckUrl, instanceHost, instancePort, &RegisterOptions{Meta: meta})
+	if err != nil {
+		logger.Println("Register service error!", err)
+		return false
+	}
+	logger.Println("Register service success!")
+	return true
+}
+
+func (legacy *legacyDiscoveryClient) DeRegister(instanceId string, logger *log.Logger) bool {
+	err := legacy.client.DeRegister(context.Background(), instanceId)
+	if err != nil {
+		logger.Println("Deregister service error!", err)
+		return false
+	}
+	logger.Println("Deregister service success!")
+	return true
+}
+
+func (legacy *legacyDiscoveryClient) DiscoveryServices(serviceName string, logger *log.Logger) []interface{} {
+	instances, err := legacy.client.DiscoveryServices(context.Background(), serviceName)
+	if err != nil {
+		logger.Println("Discover service error!", err)
+		return nil
+	}
+	services := make([]interface{}, len(instances))
+	for i := 0; i < len(instances); i++ {
+		services[i] = instances[i].AgentService()
+	}
+	return services
+}
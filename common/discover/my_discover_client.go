@@ -2,10 +2,16 @@ package discover
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/consul/api"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type InstanceInfo struct {
@@ -17,15 +23,22 @@ type InstanceInfo struct {
 	Port              int               `json:"port"`                // 服务实例端口
 	Meta              map[string]string `json:"meta,omitempty"`      // 元数据
 	EnableTagOverride bool              `json:"enable_tag_override"` // 是否允许标签覆盖
-	Check             Check             `json:"check,omitempty"`     // 健康检查相关配置
+	Check             *Check            `json:"check,omitempty"`     // 健康检查相关配置
+	Checks            []Check           `json:"checks,omitempty"`    // 附加的健康检查
 	Weights           Weights           `json:"weights,omitempty"`   // 权重相关
 }
 
 type Check struct {
+	CheckID                        string   `json:"CheckID,omitempty"`                 // 检查ID, 与 Consul 接口字段名一致
+	Name                           string   `json:"name,omitempty"`                    // 检查名称
 	DeregisterCriticalServiceAfter string   `json:"deregister_critical_service_after"` // 多久之前注销服务
 	Args                           []string `json:"args,omitempty"`                    // 请求参数
-	HTTP                           string   `json:"http"`                              // 健康检查地址
+	HTTP                           string   `json:"http,omitempty"`                    // 健康检查地址
+	TCP                            string   `json:"tcp,omitempty"`                     // TCP 检查地址
+	GRPC                           string   `json:"grpc,omitempty"`                    // gRPC 检查地址
+	GRPCUseTLS                     bool     `json:"grpc_use_tls,omitempty"`            // gRPC 检查是否使用 TLS
 	Interval                       string   `json:"interval,omitempty"`                // Consul主动进行健康检查
+	Timeout                        string   `json:"timeout,omitempty"`                 // 检查超时
 	TTL                            string   `json:"ttl,omitempty"`                     // 服务实例主动提交健康检查
 }
 
@@ -34,116 +47,363 @@ type Weights struct {
 	Warning int `json:"warning"`
 }
 
+// 阻塞查询的最长等待时间
+const blockingQueryWait = "5m"
+
+// 直接调用 Consul HTTP 接口的服务发现客户端, 可以使用 NewMyDiscoverClient 或结构体字面量创建
 type MyDiscoverClient struct {
 	Host string // Consul的端口
 	Port int    // consul的端口
+
+	// TTL 模式健康检查, 为空时由 Consul 主动进行 HTTP 检查
+	ttlCheck   *TTLCheck
+	heartbeats ttlHeartbeats
+
+	mutex sync.Mutex
+	// 服务实例缓存字段, 由阻塞查询维护
+	instancesMap sync.Map
+	// 已开启阻塞查询的服务
+	watching map[string]bool
+	// 服务实例变化的订阅者
+	subscribers map[string][]chan []*ServiceInstance
+	// 停止所有阻塞查询, 首次查询或订阅时创建
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func (consulClient *MyDiscoverClient) SetTTLCheck(check *TTLCheck) {
+	consulClient.ttlCheck = check
 }
 
-func (consulClient *MyDiscoverClient) Register(serviceName, instanceId, healthCheckUrl, instanceHost string, instancePort int, meta map[string]string, logger *log.Logger) bool {
+func (consulClient *MyDiscoverClient) Register(ctx context.Context, serviceName, instanceId, healthCheckUrl, instanceHost string, instancePort int, options *RegisterOptions) error {
+	var ttl time.Duration
+	if consulClient.ttlCheck != nil {
+		ttl = consulClient.ttlCheck.TTL
+	}
+	checkUrl := ""
+	if healthCheckUrl != "" {
+		checkUrl = "http://" + instanceHost + ":" + strconv.Itoa(instancePort) + healthCheckUrl
+	}
+	checks := options.agentServiceChecks(instanceId, checkUrl, ttl)
+
 	// 封装服务实例的元数据
 	instanceInfo := &InstanceInfo{
 		ID:                instanceId,
 		Name:              serviceName,
 		Address:           instanceHost,
 		Port:              instancePort,
-		Meta:              meta,
+		Tags:              options.tags(),
+		Meta:              options.meta(),
 		EnableTagOverride: false,
-		Check: Check{
-			DeregisterCriticalServiceAfter: "30s",
-			HTTP:                           "http://" + instanceHost + ":" + strconv.Itoa(instancePort) + healthCheckUrl,
-			Interval:                       "15s",
-		},
-		Weights: Weights{
-			Passing: 10,
-			Warning: 1,
-		},
+		Weights:           options.weights(),
+	}
+	for _, check := range checks {
+		instanceInfo.Checks = append(instanceInfo.Checks, newCheck(check))
 	}
 	byteData, _ := json.Marshal(instanceInfo)
 	// 向Consul发送服务注册的请求
-	req, err := http.NewRequest("PUT", "http://"+consulClient.Host+":"+strconv.Itoa(consulClient.Port)+"/v1/agent/service/register", bytes.NewReader(byteData))
+	req, err := http.NewRequestWithContext(ctx, "PUT", consulClient.address()+"/v1/agent/service/register", bytes.NewReader(byteData))
 	if err != nil {
-		return false
+		return err
 	}
 	// 检查注册结果
-
 	req.Header.Set("Content-Type", "application/json;charset=UTF-8")
-	client := http.Client{}
-	resp, err := client.Do(req)
+	if err = consulClient.do(req, nil); err != nil {
+		return err
+	}
+	if consulClient.ttlCheck != nil {
+		consulClient.heartbeats.start(instanceId, consulClient.ttlCheck, consulClient.updateTTL)
+	}
+	return nil
+}
+
+// 上报 TTL 检查状态, 对应 Consul 的 pass/warn/fail 接口
+func (consulClient *MyDiscoverClient) updateTTL(ctx context.Context, checkId, status, output string) error {
+	var action string
+	switch status {
+	case api.HealthPassing:
+		action = "pass"
+	case api.HealthWarning:
+		action = "warn"
+	default:
+		action = "fail"
+	}
+	query := url.Values{"note": []string{output}}
+	req, err := http.NewRequestWithContext(ctx, "PUT", consulClient.address()+"/v1/agent/check/"+action+"/"+checkId+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	return consulClient.do(req, nil)
+}
 
+func (consulClient *MyDiscoverClient) DeRegister(ctx context.Context, instanceId string) error {
+	// 先停止心跳, 避免注销后继续上报
+	consulClient.heartbeats.stop(instanceId)
+	// 发送注销请求
+	req, err := http.NewRequestWithContext(ctx, "PUT", consulClient.address()+"/v1/agent/service/deregister/"+instanceId, nil)
 	if err != nil {
-		log.Println("Register service error")
-		return false
+		return err
+	}
+	return consulClient.do(req, nil)
+}
+
+func (consulClient *MyDiscoverClient) DiscoveryServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	// 该服务已监控并缓存
+	instanceList, ok := consulClient.instancesMap.Load(serviceName)
+	if ok {
+		return instanceList.([]*ServiceInstance), nil
+	}
+
+	consulClient.mutex.Lock()
+	defer consulClient.mutex.Unlock()
+	// 再次判断是否监控
+	instanceList, ok = consulClient.instancesMap.Load(serviceName)
+	if ok {
+		return instanceList.([]*ServiceInstance), nil
+	}
+	if consulClient.closed {
+		return nil, ErrClientClosed
 	}
-	resp.Body.Close()
 
-	log.Println(string(byteData))
+	instances, index, err := consulClient.health(ctx, serviceName, 0)
+	if err != nil {
+		return nil, err
+	}
+	consulClient.store(serviceName, instances)
+	if !consulClient.watching[serviceName] {
+		consulClient.startWatch(serviceName, index)
+	}
+	return instances, nil
+}
 
-	if resp.StatusCode != 200 {
-		log.Println("Register service error")
-		return false
+func (consulClient *MyDiscoverClient) LookupServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	instanceList, ok := consulClient.instancesMap.Load(serviceName)
+	if ok {
+		return instanceList.([]*ServiceInstance), nil
+	}
+	consulClient.mutex.Lock()
+	closed := consulClient.closed
+	consulClient.mutex.Unlock()
+	if closed {
+		return nil, ErrClientClosed
 	}
+	instances, _, err := consulClient.health(ctx, serviceName, 0)
+	return instances, err
+}
 
-	log.Println("Register service success!")
+func (consulClient *MyDiscoverClient) Subscribe(serviceName string) <-chan []*ServiceInstance {
+	consulClient.mutex.Lock()
+	defer consulClient.mutex.Unlock()
 
-	return true
+	ch := make(chan []*ServiceInstance, 1)
+	// 客户端已关闭
+	if consulClient.closed {
+		close(ch)
+		return ch
+	}
+	consulClient.init()
+	consulClient.subscribers[serviceName] = append(consulClient.subscribers[serviceName], ch)
+	// 已有缓存时立即推送当前实例
+	if instanceList, ok := consulClient.instancesMap.Load(serviceName); ok {
+		ch <- instanceList.([]*ServiceInstance)
+	}
+	if !consulClient.watching[serviceName] {
+		consulClient.startWatch(serviceName, 0)
+	}
+	return ch
 }
 
-func (consulClient *MyDiscoverClient) DeRegister(instanceId string, logger *log.Logger) bool {
-	// 发送注销请求
-	req, err := http.NewRequest("PUT", "http://"+consulClient.Host+":"+strconv.Itoa(consulClient.Port)+"/v1/agent/service/deregister/"+instanceId, nil)
+// 停止阻塞查询和心跳, 关闭所有订阅通道, 之后的查询返回 ErrClientClosed
+func (consulClient *MyDiscoverClient) Close() error {
+	consulClient.mutex.Lock()
+	consulClient.closed = true
+	if consulClient.cancel != nil {
+		consulClient.cancel()
+	}
+	consulClient.mutex.Unlock()
+	consulClient.wg.Wait()
+	consulClient.heartbeats.stopAll()
+
+	consulClient.mutex.Lock()
+	defer consulClient.mutex.Unlock()
+	for serviceName, subscribers := range consulClient.subscribers {
+		for _, ch := range subscribers {
+			close(ch)
+		}
+		delete(consulClient.subscribers, serviceName)
+	}
+	// 清除缓存, 关闭后不再返回停止更新的实例
+	consulClient.instancesMap.Range(func(serviceName, _ interface{}) bool {
+		consulClient.instancesMap.Delete(serviceName)
+		return true
+	})
+	return nil
+}
+
+// 创建阻塞查询和订阅的状态, 调用方需持有锁
+func (consulClient *MyDiscoverClient) init() {
+	if consulClient.ctx != nil {
+		return
+	}
+	consulClient.ctx, consulClient.cancel = context.WithCancel(context.Background())
+	consulClient.watching = make(map[string]bool)
+	consulClient.subscribers = make(map[string][]chan []*ServiceInstance)
+}
+
+// 开启阻塞查询, 调用方需持有锁
+func (consulClient *MyDiscoverClient) startWatch(serviceName string, index uint64) {
+	consulClient.init()
+	consulClient.watching[serviceName] = true
+	consulClient.wg.Add(1)
+	go func() {
+		defer consulClient.wg.Done()
+		consulClient.watch(serviceName, index)
+	}()
+}
+
+// 使用 index 进行阻塞查询, 实例变化时更新缓存并通知订阅者
+func (consulClient *MyDiscoverClient) watch(serviceName string, index uint64) {
+	ctx := consulClient.ctx
+	for {
+		instances, latestIndex, err := consulClient.health(ctx, serviceName, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("Watch consul service error!", serviceName, err)
+			// 出错后等待一段时间重试
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		// 等待超时, 实例未变化
+		if index > 0 && latestIndex == index {
+			continue
+		}
+		// index 回退(如 Consul 重启)或缺失时从 1 开始, 避免持续发起非阻塞查询
+		if latestIndex < index || latestIndex == 0 {
+			latestIndex = 1
+		}
+		index = latestIndex
+
+		consulClient.mutex.Lock()
+		consulClient.store(serviceName, instances)
+		consulClient.notify(serviceName, instances)
+		consulClient.mutex.Unlock()
+	}
+}
+
+// 查询服务的健康实例, index 大于 0 时阻塞至实例变化或超时
+func (consulClient *MyDiscoverClient) health(ctx context.Context, serviceName string, index uint64) ([]*ServiceInstance, uint64, error) {
+	query := url.Values{"passing": []string{"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", blockingQueryWait)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", consulClient.address()+"/v1/health/service/"+serviceName+"?"+query.Encode(), nil)
 	if err != nil {
-		logger.Println("DeRegister service err", err)
-		return false
+		return nil, 0, err
 	}
-	// 起一个http链接
-	client := http.Client{}
-	resp, err := client.Do(req)
+
+	var serviceList []struct {
+		Service InstanceInfo `json:"service"`
+	}
+	header, err := consulClient.doRequest(req, &serviceList)
 	if err != nil {
-		logger.Println("DeRegister service err", err)
-		return false
+		return nil, 0, err
 	}
-	resp.Body.Close()
-	if resp.StatusCode != 200 {
-		logger.Println("DeRegister service err", err)
-		return false
+
+	instances := make([]*ServiceInstance, len(serviceList))
+	for i := 0; i < len(serviceList); i++ {
+		instances[i] = serviceList[i].Service.serviceInstance()
 	}
-	logger.Println("DeRegister service Success")
-	return true
+	latestIndex, _ := strconv.ParseUint(header.Get("X-Consul-Index"), 10, 64)
+	return instances, latestIndex, nil
 }
 
-func (consulClient *MyDiscoverClient) DiscoveryServices(serviceName string, logger *log.Logger) []interface{} {
-	// 从Consul中获取服务实例列表
-	req, err := http.NewRequest("GET", "http://"+consulClient.Host+":"+strconv.Itoa(consulClient.Port)+"/v1/health/service/"+serviceName, nil)
-	if err != nil {
-		logger.Println("DiscoveryServices req err", err)
-		return nil
+func (consulClient *MyDiscoverClient) store(serviceName string, instances []*ServiceInstance) {
+	consulClient.instancesMap.Store(serviceName, instances)
+}
+
+// 推送最新实例, 订阅者未及时读取时丢弃旧的实例列表, 调用方需持有锁
+func (consulClient *MyDiscoverClient) notify(serviceName string, instances []*ServiceInstance) {
+	for _, ch := range consulClient.subscribers[serviceName] {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- instances
 	}
+}
+
+// consul http api 地址
+func (consulClient *MyDiscoverClient) address() string {
+	return "http://" + consulClient.Host + ":" + strconv.Itoa(consulClient.Port)
+}
+
+// 发送请求, 非 200 响应视为错误, result 不为空时解析响应体
+func (consulClient *MyDiscoverClient) do(req *http.Request, result interface{}) error {
+	_, err := consulClient.doRequest(req, result)
+	return err
+}
+
+// 同 do, 并返回响应头
+func (consulClient *MyDiscoverClient) doRequest(req *http.Request, result interface{}) (http.Header, error) {
 	client := http.Client{}
 	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != 200 {
-		logger.Println("Discovery Services error !", err)
-		return nil
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	var serviceList []struct {
-		Service InstanceInfo `json:"service"`
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul %s %s: unexpected status %d", req.Method, req.URL.Path, resp.StatusCode)
 	}
-	err = json.NewDecoder(resp.Body).Decode(&serviceList)
-	resp.Body.Close()
+	if result == nil {
+		return resp.Header, nil
+	}
+	return resp.Header, json.NewDecoder(resp.Body).Decode(result)
+}
 
-	if err != nil {
-		logger.Println("Discovery Services error !", err)
-		return nil
+func newCheck(check *api.AgentServiceCheck) Check {
+	return Check{
+		CheckID:                        check.CheckID,
+		Name:                           check.Name,
+		DeregisterCriticalServiceAfter: check.DeregisterCriticalServiceAfter,
+		HTTP:                           check.HTTP,
+		TCP:                            check.TCP,
+		GRPC:                           check.GRPC,
+		GRPCUseTLS:                     check.GRPCUseTLS,
+		Interval:                       check.Interval,
+		Timeout:                        check.Timeout,
+		TTL:                            check.TTL,
 	}
+}
 
-	instances := make([]interface{}, len(serviceList))
-	for i := 0; i < len(serviceList); i++ {
-		instances[i] = serviceList[i].Service
+// 转换为服务实例, 服务发现时服务名在 Service 字段中
+func (info InstanceInfo) serviceInstance() *ServiceInstance {
+	name := info.Service
+	if name == "" {
+		name = info.Name
+	}
+	return &ServiceInstance{
+		ID:      info.ID,
+		Name:    name,
+		Host:    info.Address,
+		Port:    info.Port,
+		Tags:    info.Tags,
+		Meta:    info.Meta,
+		Weights: info.Weights,
 	}
-	return instances
 }
 
-func NewMyDiscoverClient(consulHost string, consulPort int) DiscoveryClient {
+func NewMyDiscoverClient(consulHost string, consulPort int) *MyDiscoverClient {
 	return &MyDiscoverClient{
 		Host: consulHost,
 		Port: consulPort,
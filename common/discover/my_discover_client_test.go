@@ -0,0 +1,230 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hashicorp/consul/api"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 支持阻塞查询的 Consul 健康接口模拟服务
+type fakeConsul struct {
+	mutex    sync.Mutex
+	index    uint64
+	services map[string][]fakeConsulEntry
+	// 实例变化时关闭并替换, 唤醒阻塞查询
+	changed chan struct{}
+}
+
+type fakeConsulEntry struct {
+	Service InstanceInfo
+	Checks  []*api.HealthCheck
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:    1,
+		services: make(map[string][]fakeConsulEntry),
+		changed:  make(chan struct{}),
+	}
+}
+
+func (consul *fakeConsul) set(serviceName string, entries ...fakeConsulEntry) {
+	consul.mutex.Lock()
+	defer consul.mutex.Unlock()
+	consul.services[serviceName] = entries
+	consul.index++
+	close(consul.changed)
+	consul.changed = make(chan struct{})
+}
+
+func (consul *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v1/health/service/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	serviceName := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+	consul.mutex.Lock()
+	if index > 0 && index == consul.index {
+		changed := consul.changed
+		consul.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		consul.mutex.Lock()
+	}
+	defer consul.mutex.Unlock()
+
+	var result []fakeConsulEntry
+	for _, entry := range consul.services[serviceName] {
+		if entry.Checks[0].Status == api.HealthPassing || r.URL.Query().Get("passing") == "" {
+			result = append(result, entry)
+		}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(consul.index, 10))
+	json.NewEncoder(w).Encode(result)
+}
+
+func startFakeConsul(t *testing.T) (*fakeConsul, string, int, func()) {
+	consul := newFakeConsul()
+	server := httptest.NewServer(consul)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	consulPort, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return consul, host, consulPort, server.Close
+}
+
+func fakeEntry(id string, port int, passing bool) fakeConsulEntry {
+	status := api.HealthCritical
+	if passing {
+		status = api.HealthPassing
+	}
+	return fakeConsulEntry{
+		Service: InstanceInfo{ID: id, Service: "string", Address: "127.0.0.1", Port: port},
+		Checks:  []*api.HealthCheck{{CheckID: "service:" + id, ServiceID: id, Status: status}},
+	}
+}
+
+// 读取订阅通道, 直到实例数量达到预期
+func waitSubscribe(t *testing.T, ch <-chan []*ServiceInstance, expect int) []*ServiceInstance {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case instances, ok := <-ch:
+			if !ok {
+				t.Fatal("subscribe channel closed")
+			}
+			if len(instances) == expect {
+				return instances
+			}
+		case <-timeout:
+			t.Fatalf("expect %d instances from subscribe", expect)
+		}
+	}
+}
+
+func TestMyDiscoverClientWatch(t *testing.T) {
+	consul, host, port, stop := startFakeConsul(t)
+	defer stop()
+	consul.set("string", fakeEntry("string-1", 10085, true), fakeEntry("string-2", 10086, false))
+
+	client := NewMyDiscoverClient(host, port)
+	defer client.Close()
+
+	// 只返回健康实例
+	instances, err := client.DiscoveryServices(context.Background(), "string")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].ID != "string-1" || instances[0].Name != "string" {
+		t.Fatalf("unexpected instances %+v", instances)
+	}
+
+	// 订阅时立即推送缓存的实例
+	ch := client.Subscribe("string")
+	waitSubscribe(t, ch, 1)
+
+	// 实例变化后由阻塞查询更新缓存并通知订阅者
+	consul.set("string", fakeEntry("string-1", 10085, true), fakeEntry("string-2", 10086, true))
+	waitSubscribe(t, ch, 2)
+	waitInstances(t, client, "string", 2)
+
+	consul.set("string")
+	waitSubscribe(t, ch, 0)
+	waitInstances(t, client, "string", 0)
+}
+
+func TestMyDiscoverClientLookup(t *testing.T) {
+	consul, host, port, stop := startFakeConsul(t)
+	defer stop()
+	consul.set("string", fakeEntry("string-1", 10085, true), fakeEntry("string-2", 10086, false))
+
+	client := NewMyDiscoverClient(host, port)
+	defer client.Close()
+
+	// 一次性查询只返回健康实例, 不缓存也不开启阻塞查询
+	instances, err := client.LookupServices(context.Background(), "string")
+	if err != nil || len(instances) != 1 || instances[0].ID != "string-1" {
+		t.Fatalf("unexpected instances %+v %v", instances, err)
+	}
+	if _, ok := client.instancesMap.Load("string"); ok || client.watching["string"] {
+		t.Fatal("expect lookup not to watch the service")
+	}
+}
+
+func TestMyDiscoverClientSubscribe(t *testing.T) {
+	consul, host, port, stop := startFakeConsul(t)
+	defer stop()
+
+	client := NewMyDiscoverClient(host, port)
+	// 未查询过的服务由订阅开启阻塞查询
+	ch := client.Subscribe("string")
+	waitSubscribe(t, ch, 0)
+
+	consul.set("string", fakeEntry("string-1", 10085, true))
+	instances := waitSubscribe(t, ch, 1)
+	if instances[0].Port != 10085 {
+		t.Fatalf("unexpected instance %+v", instances[0])
+	}
+
+	// 关闭客户端后停止阻塞查询并关闭订阅通道
+	client.Close()
+	if _, ok := <-ch; ok {
+		t.Fatal("expect subscribe channel closed")
+	}
+	if _, ok := <-client.Subscribe("string"); ok {
+		t.Fatal("expect closed channel after client closed")
+	}
+}
+
+func TestMyDiscoverClientLiteral(t *testing.T) {
+	consul, host, port, stop := startFakeConsul(t)
+	defer stop()
+	consul.set("string", fakeEntry("string-1", 10085, true))
+
+	// 结构体字面量创建的客户端同样可以查询和订阅
+	client := &MyDiscoverClient{Host: host, Port: port}
+	if instances, err := client.DiscoveryServices(context.Background(), "string"); err != nil || len(instances) != 1 {
+		t.Fatalf("unexpected instances %+v %v", instances, err)
+	}
+	ch := client.Subscribe("string")
+	waitSubscribe(t, ch, 1)
+
+	// 关闭后不再查询, 返回 ErrClientClosed
+	client.Close()
+	if _, err := client.DiscoveryServices(context.Background(), "string"); err != ErrClientClosed {
+		t.Fatalf("expect ErrClientClosed, got %v", err)
+	}
+	if _, err := client.LookupServices(context.Background(), "string"); err != ErrClientClosed {
+		t.Fatalf("expect ErrClientClosed, got %v", err)
+	}
+	if len(client.subscribers) != 0 {
+		t.Fatal("expect subscribers removed after close")
+	}
+
+	// 未使用的客户端可以直接关闭
+	if err := (&MyDiscoverClient{Host: host, Port: port}).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMyDiscoverClientUnavailable(t *testing.T) {
+	client := NewMyDiscoverClient("127.0.0.1", 1)
+	defer client.Close()
+	if _, err := client.DiscoveryServices(context.Background(), "string"); err == nil {
+		t.Fatal("expect error when consul is unavailable")
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package discover
+
+// 内嵌 etcd 依赖的 coreos/bbolt v1.3.3 在 -race 开启 checkptr 时崩溃, 竞态检测时跳过
+const raceEnabled = true
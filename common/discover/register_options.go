@@ -0,0 +1,225 @@
+package discover
+
+import (
+	"github.com/hashicorp/consul/api"
+	"strings"
+	"time"
+)
+
+// 默认的注册配置
+const (
+	// Consul 主动进行健康检查的间隔
+	DefaultCheckInterval = 15 * time.Second
+	// 健康检查持续失败多久后注销服务
+	DefaultDeregisterCriticalServiceAfter = 30 * time.Second
+)
+
+// 默认权重, 实例健康时为 10, 告警时为 1
+var DefaultWeights = Weights{Passing: 10, Warning: 1}
+
+// 服务注册选项, 为空时使用默认配置
+type RegisterOptions struct {
+	Tags    []string          // 标签, 如版本 v2
+	Meta    map[string]string // 元数据, 如区域 zone
+	Weights *Weights          // 权重, 为空时使用 DefaultWeights
+
+	Checks                         []*CheckOptions // 除 healthCheckUrl 外附加的健康检查
+	CheckInterval                  time.Duration   // 健康检查间隔, 默认 15s
+	CheckTimeout                   time.Duration   // 健康检查超时, 为 0 时使用 Consul 的默认值
+	DeregisterCriticalServiceAfter time.Duration   // 健康检查持续失败多久后注销服务, 默认 30s
+}
+
+// 附加的健康检查, HTTP、TCP、GRPC 设置其中一项
+type CheckOptions struct {
+	Name       string
+	HTTP       string        // 完整的检查地址, 如 http://127.0.0.1:10085/health
+	TCP        string        // host:port
+	GRPC       string        // host:port 或 host:port/service, 使用 grpc.health.v1 协议
+	GRPCUseTLS bool          // gRPC 检查是否使用 TLS
+	Interval   time.Duration // 为 0 时使用 RegisterOptions.CheckInterval
+	Timeout    time.Duration // 为 0 时使用 RegisterOptions.CheckTimeout
+}
+
+func (options *RegisterOptions) tags() []string {
+	if options == nil {
+		return nil
+	}
+	return options.Tags
+}
+
+func (options *RegisterOptions) meta() map[string]string {
+	if options == nil {
+		return nil
+	}
+	return options.Meta
+}
+
+func (options *RegisterOptions) weights() Weights {
+	if options == nil || options.Weights == nil {
+		return DefaultWeights
+	}
+	return *options.Weights
+}
+
+func (options *RegisterOptions) checks() []*CheckOptions {
+	if options == nil {
+		return nil
+	}
+	return options.Checks
+}
+
+func (options *RegisterOptions) checkInterval(check *CheckOptions) time.Duration {
+	if check != nil && check.Interval > 0 {
+		return check.Interval
+	}
+	if options == nil || options.CheckInterval <= 0 {
+		return DefaultCheckInterval
+	}
+	return options.CheckInterval
+}
+
+func (options *RegisterOptions) checkTimeout(check *CheckOptions) time.Duration {
+	if check != nil && check.Timeout > 0 {
+		return check.Timeout
+	}
+	if options == nil {
+		return 0
+	}
+	return options.CheckTimeout
+}
+
+func (options *RegisterOptions) deregisterCriticalServiceAfter() time.Duration {
+	if options == nil || options.DeregisterCriticalServiceAfter <= 0 {
+		return DefaultDeregisterCriticalServiceAfter
+	}
+	return options.DeregisterCriticalServiceAfter
+}
+
+// 服务实例, 用于不进行健康检查的注册中心
+func (options *RegisterOptions) serviceInstance(serviceName, instanceId, instanceHost string, instancePort int) *ServiceInstance {
+	return &ServiceInstance{
+		ID:      instanceId,
+		Name:    serviceName,
+		Host:    instanceHost,
+		Port:    instancePort,
+		Tags:    options.tags(),
+		Meta:    options.meta(),
+		Weights: options.weights(),
+	}
+}
+
+// 转换为 consul 的健康检查结构, ttl 大于 0 时主检查使用 TTL 模式
+// 主检查的 ID 固定为 service:{instanceId}, 附加检查由 Consul 生成 ID
+// 非 TTL 模式且 healthCheckUrl 为空时(如只提供 gRPC 服务)不注册主检查
+func (options *RegisterOptions) agentServiceChecks(instanceId, healthCheckUrl string, ttl time.Duration) api.AgentServiceChecks {
+	deregisterAfter := options.deregisterCriticalServiceAfter().String()
+	var checks api.AgentServiceChecks
+	if ttl > 0 || healthCheckUrl != "" {
+		primary := &api.AgentServiceCheck{
+			CheckID:                        serviceCheckId(instanceId),
+			DeregisterCriticalServiceAfter: deregisterAfter,
+		}
+		if ttl > 0 {
+			primary.TTL = ttl.String()
+		} else {
+			primary.HTTP = healthCheckUrl
+			primary.Interval = options.checkInterval(nil).String()
+			primary.Timeout = durationString(options.checkTimeout(nil))
+		}
+		checks = append(checks, primary)
+	}
+
+	for _, check := range options.checks() {
+		checks = append(checks, &api.AgentServiceCheck{
+			Name:                           check.Name,
+			HTTP:                           check.HTTP,
+			TCP:                            check.TCP,
+			GRPC:                           check.GRPC,
+			GRPCUseTLS:                     check.GRPCUseTLS,
+			Interval:                       options.checkInterval(check).String(),
+			Timeout:                        durationString(options.checkTimeout(check)),
+			DeregisterCriticalServiceAfter: deregisterAfter,
+		})
+	}
+	return checks
+}
+
+// 服务主检查的 ID, 与 Consul 为单个服务检查生成的 ID 一致
+func serviceCheckId(instanceId string) string {
+	return "service:" + instanceId
+}
+
+// 时长为 0 时返回空字符串, 由 Consul 使用默认值
+func durationString(duration time.Duration) string {
+	if duration <= 0 {
+		return ""
+	}
+	return duration.String()
+}
+
+// 由命令行参数创建注册选项的配置
+type RegisterConfig struct {
+	Tags   string // 标签, 多个以逗号分隔
+	Meta   string // 元数据, 多个以逗号分隔, 如 version=v2,zone=cn-east
+	Weight int    // 实例健康时的权重, 为 0 时使用默认权重
+
+	HTTPChecks string // 附加的 HTTP 检查地址, 多个以逗号分隔
+	TCPChecks  string // 附加的 TCP 检查地址, 多个以逗号分隔
+	GRPCChecks string // 附加的 gRPC 检查地址, 多个以逗号分隔
+
+	CheckInterval                  time.Duration
+	CheckTimeout                   time.Duration
+	DeregisterCriticalServiceAfter time.Duration
+}
+
+// 根据命令行参数创建注册选项
+func NewRegisterOptions(config *RegisterConfig) (*RegisterOptions, error) {
+	meta, err := parseMeta(config.Meta)
+	if err != nil {
+		return nil, err
+	}
+	options := &RegisterOptions{
+		Tags:                           parseList(config.Tags),
+		Meta:                           meta,
+		CheckInterval:                  config.CheckInterval,
+		CheckTimeout:                   config.CheckTimeout,
+		DeregisterCriticalServiceAfter: config.DeregisterCriticalServiceAfter,
+	}
+	if config.Weight > 0 {
+		options.Weights = &Weights{Passing: config.Weight, Warning: DefaultWeights.Warning}
+	}
+	for _, address := range parseList(config.HTTPChecks) {
+		options.Checks = append(options.Checks, &CheckOptions{Name: "http " + address, HTTP: address})
+	}
+	for _, address := range parseList(config.TCPChecks) {
+		options.Checks = append(options.Checks, &CheckOptions{Name: "tcp " + address, TCP: address})
+	}
+	for _, address := range parseList(config.GRPCChecks) {
+		options.Checks = append(options.Checks, &CheckOptions{Name: "grpc " + address, GRPC: address})
+	}
+	return options, nil
+}
+
+// 解析以逗号分隔的列表, 忽略空项
+func parseList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// 解析以逗号分隔的 key=value 列表
+func parseMeta(value string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range parseList(value) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, ErrInvalidMeta
+		}
+		meta[kv[0]] = kv[1]
+	}
+	return meta, nil
+}
@@ -0,0 +1,110 @@
+package discover
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRegisterOptions(t *testing.T) {
+	options, err := NewRegisterOptions(&RegisterConfig{
+		Tags:         "v2, canary",
+		Meta:         "version=v2,zone=cn-east",
+		Weight:       5,
+		TCPChecks:    "127.0.0.1:10085",
+		GRPCChecks:   "127.0.0.1:10086/pb.StringService",
+		CheckTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options.Tags) != 2 || options.Tags[1] != "canary" || options.Meta["zone"] != "cn-east" {
+		t.Fatalf("unexpected tags or meta %+v", options)
+	}
+	if options.weights() != (Weights{Passing: 5, Warning: 1}) {
+		t.Fatalf("unexpected weights %+v", options.weights())
+	}
+	if len(options.Checks) != 2 || options.Checks[0].TCP != "127.0.0.1:10085" || options.Checks[1].GRPC != "127.0.0.1:10086/pb.StringService" {
+		t.Fatalf("unexpected checks %+v", options.Checks)
+	}
+
+	if _, err := NewRegisterOptions(&RegisterConfig{Meta: "zone"}); err != ErrInvalidMeta {
+		t.Fatalf("expect ErrInvalidMeta, got %v", err)
+	}
+
+	// 未设置时使用默认配置
+	var empty *RegisterOptions
+	checks := empty.agentServiceChecks("string-1", "http://127.0.0.1:10085/health", 0)
+	if empty.weights() != DefaultWeights || len(checks) != 1 || checks[0].Interval != "15s" ||
+		checks[0].DeregisterCriticalServiceAfter != "30s" || checks[0].Timeout != "" {
+		t.Fatalf("unexpected default checks %+v", checks[0])
+	}
+
+	// 没有 HTTP 检查地址时只注册附加检查
+	checks = options.agentServiceChecks("string-1", "", 0)
+	if len(checks) != 2 || checks[0].TCP == "" || checks[1].GRPC == "" {
+		t.Fatalf("expect extra checks only, got %+v", checks)
+	}
+
+	// TTL 模式下主检查不再由 Consul 主动访问
+	options.DeregisterCriticalServiceAfter = time.Minute
+	checks = options.agentServiceChecks("string-1", "http://127.0.0.1:10085/health", 10*time.Second)
+	if len(checks) != 3 || checks[0].TTL != "10s" || checks[0].HTTP != "" || checks[0].Interval != "" ||
+		checks[0].DeregisterCriticalServiceAfter != "1m0s" || checks[1].DeregisterCriticalServiceAfter != "1m0s" || checks[1].Timeout != "1s" {
+		t.Fatalf("unexpected ttl checks %+v %+v", checks[0], checks[1])
+	}
+}
+
+func TestRegisterWithOptions(t *testing.T) {
+	consul := &fakeTTLConsul{}
+	server := httptest.NewServer(consul)
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	consulPort, _ := strconv.Atoi(port)
+
+	kitClient, err := NewKitDiscoverClient(host, consulPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kitClient.Close()
+	myClient := NewMyDiscoverClient(host, consulPort)
+	defer myClient.Close()
+
+	options := &RegisterOptions{
+		Tags:                           []string{"v2"},
+		Meta:                           map[string]string{"zone": "cn-east"},
+		Weights:                        &Weights{Passing: 3, Warning: 1},
+		Checks:                         []*CheckOptions{{Name: "tcp", TCP: "127.0.0.1:10085"}, {Name: "grpc", GRPC: "127.0.0.1:10086", Interval: 5 * time.Second}},
+		CheckTimeout:                   2 * time.Second,
+		DeregisterCriticalServiceAfter: time.Minute,
+	}
+	for _, client := range []DiscoveryClientV2{kitClient, myClient} {
+		if err := client.Register(context.Background(), "string", "string-1", "/health", "127.0.0.1", 10085, options); err != nil {
+			t.Fatal(err)
+		}
+
+		consul.mutex.Lock()
+		info := consul.registered
+		consul.mutex.Unlock()
+		if len(info.Tags) != 1 || info.Tags[0] != "v2" || info.Meta["zone"] != "cn-east" || info.Weights.Passing != 3 {
+			t.Fatalf("unexpected registration %+v", info)
+		}
+
+		// 主检查与附加检查一起注册
+		checks := info.Checks
+		if len(checks) != 3 {
+			t.Fatalf("expect 3 checks, got %+v", checks)
+		}
+		if checks[0].CheckID != "service:string-1" || checks[0].HTTP != "http://127.0.0.1:10085/health" || checks[0].Timeout != "2s" {
+			t.Fatalf("unexpected primary check %+v", checks[0])
+		}
+		if checks[1].TCP != "127.0.0.1:10085" || checks[1].Interval != "15s" ||
+			checks[2].GRPC != "127.0.0.1:10086" || checks[2].Interval != "5s" {
+			t.Fatalf("unexpected extra checks %+v", checks[1:])
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package discover
+
+import (
+	"context"
+	"micro-go/common/filewatch"
+	"sigs.k8s.io/yaml"
+	"sync"
+)
+
+// 服务实例文件结构, 支持 YAML 与 JSON
+//
+//	services:
+//	  string:
+//	    - id: string-1
+//	      host: 127.0.0.1
+//	      port: 10085
+type staticServiceFile struct {
+	Services map[string][]*ServiceInstance `json:"services"`
+}
+
+// 基于文件和内存注册表的服务发现客户端, 用于本地开发与测试
+// 文件中的实例与通过 Register 注册到内存中的实例合并返回
+type StaticDiscoveryClient struct {
+	File string // 服务实例文件, 为空时仅使用内存注册表
+
+	mutex sync.RWMutex
+	// 文件中的服务实例
+	fileInstances map[string][]*ServiceInstance
+	// 内存中注册的服务实例
+	registered map[string]*ServiceInstance
+
+	watcher *filewatch.FileWatcher
+}
+
+func (staticClient *StaticDiscoveryClient) Register(ctx context.Context, serviceName, instanceId, healthCheckUrl, instanceHost string, instancePort int, options *RegisterOptions) error {
+	staticClient.mutex.Lock()
+	defer staticClient.mutex.Unlock()
+	staticClient.registered[instanceId] = options.serviceInstance(serviceName, instanceId, instanceHost, instancePort)
+	return nil
+}
+
+func (staticClient *StaticDiscoveryClient) DeRegister(ctx context.Context, instanceId string) error {
+	staticClient.mutex.Lock()
+	defer staticClient.mutex.Unlock()
+	if _, ok := staticClient.registered[instanceId]; !ok {
+		return ErrInstanceNotRegistered
+	}
+	delete(staticClient.registered, instanceId)
+	return nil
+}
+
+func (staticClient *StaticDiscoveryClient) DiscoveryServices(ctx context.Context, serviceName string) ([]*ServiceInstance, error) {
+	staticClient.mutex.RLock()
+	defer staticClient.mutex.RUnlock()
+
+	fileInstances := staticClient.fileInstances[serviceName]
+	instances := make([]*ServiceInstance, 0, len(fileInstances))
+	instances = append(instances, fileInstances...)
+	for _, instance := range staticClient.registered {
+		if instance.Name == serviceName {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+// 停止监控服务实例文件
+func (staticClient *StaticDiscoveryClient) Close() error {
+	if staticClient.watcher == nil {
+		return nil
+	}
+	return staticClient.watcher.Close()
+}
+
+// 解析服务实例文件
+func (staticClient *StaticDiscoveryClient) parse(data []byte) error {
+	serviceFile := &staticServiceFile{}
+	if err := yaml.Unmarshal(data, serviceFile); err != nil {
+		return err
+	}
+	// 未填写服务名时使用所属服务的名称
+	for serviceName, instances := range serviceFile.Services {
+		for _, instance := range instances {
+			if instance.Name == "" {
+				instance.Name = serviceName
+			}
+		}
+	}
+
+	staticClient.mutex.Lock()
+	staticClient.fileInstances = serviceFile.Services
+	staticClient.mutex.Unlock()
+	return nil
+}
+
+// 创建基于文件的服务发现客户端, file 为空时仅使用内存注册表
+func NewStaticDiscoveryClient(file string) (*StaticDiscoveryClient, error) {
+	staticClient := &StaticDiscoveryClient{
+		File:          file,
+		fileInstances: make(map[string][]*ServiceInstance),
+		registered:    make(map[string]*ServiceInstance),
+	}
+	if file == "" {
+		return staticClient, nil
+	}
+
+	// 修改文件后重新读取, 读取失败时保留之前的服务实例
+	watcher, err := filewatch.NewFileWatcher(file, "static services", staticClient.parse)
+	if err != nil {
+		return nil, err
+	}
+	staticClient.watcher = watcher
+	return staticClient, nil
+}
@@ -0,0 +1,109 @@
+package discover
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const staticServicesYaml = `
+services:
+  string:
+    - id: string-1
+      host: 127.0.0.1
+      port: 10085
+      tags: [v1]
+      meta:
+        zone: cn-east
+`
+
+const staticServicesJson = `{
+  "services": {
+    "string": [
+      {"id": "string-1", "host": "127.0.0.1", "port": 10085},
+      {"id": "string-2", "host": "127.0.0.1", "port": 10086}
+    ],
+    "oauth": [
+      {"id": "oauth-1", "host": "127.0.0.1", "port": 10098}
+    ]
+  }
+}`
+
+func TestStaticDiscoveryClientFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static-discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "services.yaml")
+	if err := ioutil.WriteFile(file, []byte(staticServicesYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewStaticDiscoveryClient(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	instances := waitInstances(t, client, "string", 1)
+	instance := instances[0]
+	if instance.ID != "string-1" || instance.Name != "string" || instance.Port != 10085 ||
+		instance.Meta["zone"] != "cn-east" || len(instance.Tags) != 1 || instance.Tags[0] != "v1" {
+		t.Fatalf("unexpected instance %+v", instance)
+	}
+
+	// 修改文件后自动重新加载, JSON 同样支持
+	if err := ioutil.WriteFile(file, []byte(staticServicesJson), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitInstances(t, client, "string", 2)
+	waitInstances(t, client, "oauth", 1)
+
+	// 文件格式错误时保留之前的实例
+	if err := ioutil.WriteFile(file, []byte("services: ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitInstances(t, client, "string", 2)
+}
+
+func TestStaticDiscoveryClientMemory(t *testing.T) {
+	client, err := NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	instances, err := client.DiscoveryServices(ctx, "string")
+	if err != nil || len(instances) != 0 {
+		t.Fatalf("expect no instances, got %v %v", instances, err)
+	}
+
+	if err := client.Register(ctx, "string", "string-1", "/health", "127.0.0.1", 10085, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Register(ctx, "use-string", "use-string-1", "/health", "127.0.0.1", 10086, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitInstances(t, client, "string", 1)
+
+	if err := client.DeRegister(ctx, "string-1"); err != nil {
+		t.Fatal(err)
+	}
+	waitInstances(t, client, "string", 0)
+	waitInstances(t, client, "use-string", 1)
+
+	if err := client.DeRegister(ctx, "string-1"); err != ErrInstanceNotRegistered {
+		t.Fatalf("expect ErrInstanceNotRegistered, got %v", err)
+	}
+}
+
+func TestNewStaticDiscoveryClientMissingFile(t *testing.T) {
+	if _, err := NewStaticDiscoveryClient(filepath.Join(os.TempDir(), "not-exist-services.yaml")); err == nil {
+		t.Fatal("expect error for missing services file")
+	}
+}
@@ -0,0 +1,150 @@
+package discover
+
+import (
+	"context"
+	"errors"
+	"github.com/hashicorp/consul/api"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTTLCheckNotSupported = errors.New("discovery client does not support ttl check")
+	ErrTTLCheckInvalid      = errors.New("ttl check requires a positive ttl and interval")
+	ErrTTLCheckNoHealth     = errors.New("ttl check requires a health check")
+)
+
+// 服务自身的健康检查, 返回 api.HealthPassing、api.HealthWarning 或 api.HealthCritical 及说明
+type HealthChecker func() (status string, output string)
+
+// 将返回 bool 的 HealthCheck 转换为 HealthChecker
+func BoolHealthChecker(healthCheck func() bool) HealthChecker {
+	return func() (string, string) {
+		if healthCheck() {
+			return api.HealthPassing, ""
+		}
+		return api.HealthCritical, "service health check failed"
+	}
+}
+
+// TTL 模式健康检查配置
+// 注册时不再由 Consul 主动访问服务实例, 而是由客户端定时上报健康状态
+type TTLCheck struct {
+	TTL         time.Duration // 超过该时长未上报, Consul 将实例标记为 critical
+	Interval    time.Duration // 上报间隔, 默认为 TTL 的三分之一
+	HealthCheck HealthChecker // 服务自身的健康检查
+}
+
+func (check *TTLCheck) interval() time.Duration {
+	if check.Interval > 0 {
+		return check.Interval
+	}
+	return check.TTL / 3
+}
+
+// 支持 TTL 模式注册的服务发现客户端
+type ttlCheckClient interface {
+	SetTTLCheck(check *TTLCheck)
+}
+
+// 检查 TTL 和上报间隔, 间隔不大于 0 时无法创建心跳的定时器
+func (check *TTLCheck) validate() error {
+	if check.TTL <= 0 || check.interval() <= 0 {
+		return ErrTTLCheckInvalid
+	}
+	if check.HealthCheck == nil {
+		return ErrTTLCheckNoHealth
+	}
+	return nil
+}
+
+// 为服务发现客户端开启 TTL 模式, 需要在注册服务前调用
+func UseTTLCheck(client DiscoveryClientV2, check *TTLCheck) error {
+	if err := check.validate(); err != nil {
+		return err
+	}
+	ttlClient, ok := client.(ttlCheckClient)
+	if !ok {
+		return ErrTTLCheckNotSupported
+	}
+	ttlClient.SetTTLCheck(check)
+	return nil
+}
+
+// 上报检查状态
+type ttlUpdateFunc func(ctx context.Context, checkId, status, output string) error
+
+// 单个服务实例的心跳
+type ttlHeartbeat struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// 按服务实例管理心跳协程
+type ttlHeartbeats struct {
+	mutex   sync.Mutex
+	running map[string]*ttlHeartbeat
+}
+
+// 开始上报服务实例心跳, 注册后立即上报一次
+func (heartbeats *ttlHeartbeats) start(instanceId string, check *TTLCheck, update ttlUpdateFunc) {
+	checkId := serviceCheckId(instanceId)
+	ctx, cancel := context.WithCancel(context.Background())
+	heartbeat := &ttlHeartbeat{cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(heartbeat.done)
+		ticker := time.NewTicker(check.interval())
+		defer ticker.Stop()
+		for {
+			status, output := check.HealthCheck()
+			if err := update(ctx, checkId, status, output); err != nil && ctx.Err() == nil {
+				log.Println("Update ttl check error!", checkId, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	heartbeats.mutex.Lock()
+	if heartbeats.running == nil {
+		heartbeats.running = make(map[string]*ttlHeartbeat)
+	}
+	previous := heartbeats.running[instanceId]
+	heartbeats.running[instanceId] = heartbeat
+	heartbeats.mutex.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+}
+
+// 停止上报服务实例心跳
+func (heartbeats *ttlHeartbeats) stop(instanceId string) {
+	heartbeats.mutex.Lock()
+	heartbeat, ok := heartbeats.running[instanceId]
+	delete(heartbeats.running, instanceId)
+	heartbeats.mutex.Unlock()
+	if ok {
+		heartbeat.stop()
+	}
+}
+
+// 停止所有服务实例心跳
+func (heartbeats *ttlHeartbeats) stopAll() {
+	heartbeats.mutex.Lock()
+	running := heartbeats.running
+	heartbeats.running = nil
+	heartbeats.mutex.Unlock()
+	for _, heartbeat := range running {
+		heartbeat.stop()
+	}
+}
+
+func (heartbeat *ttlHeartbeat) stop() {
+	heartbeat.cancel()
+	<-heartbeat.done
+}
@@ -0,0 +1,132 @@
+package discover
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 记录 TTL 上报请求的 Consul 模拟服务
+type fakeTTLConsul struct {
+	mutex      sync.Mutex
+	registered *InstanceInfo
+	updates    []string
+}
+
+func (consul *fakeTTLConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	consul.mutex.Lock()
+	defer consul.mutex.Unlock()
+	switch {
+	case r.URL.Path == "/v1/agent/service/register":
+		info := &InstanceInfo{}
+		json.NewDecoder(r.Body).Decode(info)
+		consul.registered = info
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/"):
+		consul.updates = append(consul.updates, strings.TrimPrefix(r.URL.Path, "/v1/agent/check/"))
+	}
+}
+
+func (consul *fakeTTLConsul) updateCount() int {
+	consul.mutex.Lock()
+	defer consul.mutex.Unlock()
+	return len(consul.updates)
+}
+
+func TestMyDiscoverClientTTLCheck(t *testing.T) {
+	consul := &fakeTTLConsul{}
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	consulPort, _ := strconv.Atoi(port)
+	client := NewMyDiscoverClient(host, consulPort)
+
+	// 第一次检查失败, 之后恢复
+	var calls int32
+	err := UseTTLCheck(client, &TTLCheck{
+		TTL:      time.Second,
+		Interval: 20 * time.Millisecond,
+		HealthCheck: BoolHealthChecker(func() bool {
+			return atomic.AddInt32(&calls, 1) > 1
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := client.Register(ctx, "string", "string-1", "/health", "127.0.0.1", 10085, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for consul.updateCount() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect ttl updates, got %d", consul.updateCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := client.DeRegister(ctx, "string-1"); err != nil {
+		t.Fatal(err)
+	}
+	stopped := consul.updateCount()
+
+	consul.mutex.Lock()
+	checks := consul.registered.Checks
+	updates := consul.updates
+	consul.mutex.Unlock()
+	if len(checks) != 1 || checks[0].CheckID != "service:string-1" || checks[0].TTL != "1s" || checks[0].HTTP != "" || checks[0].Interval != "" {
+		t.Fatalf("expect ttl check only, got %+v", checks)
+	}
+	if updates[0] != "fail/service:string-1" || updates[1] != "pass/service:string-1" {
+		t.Fatalf("unexpected ttl updates %v", updates)
+	}
+
+	// 注销后不再上报
+	time.Sleep(100 * time.Millisecond)
+	if count := consul.updateCount(); count != stopped {
+		t.Fatalf("expect heartbeat stopped after deregister, got %d updates after %d", count, stopped)
+	}
+}
+
+func TestUseTTLCheckNotSupported(t *testing.T) {
+	client, err := NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := UseTTLCheck(client, &TTLCheck{TTL: time.Second, HealthCheck: BoolHealthChecker(func() bool { return true })}); err != ErrTTLCheckNotSupported {
+		t.Fatalf("expect ErrTTLCheckNotSupported, got %v", err)
+	}
+}
+
+func TestUseTTLCheckInvalid(t *testing.T) {
+	client := NewMyDiscoverClient("127.0.0.1", 8500)
+	defer client.Close()
+	healthy := BoolHealthChecker(func() bool { return true })
+
+	// TTL 或上报间隔不大于 0 时无法上报
+	for _, check := range []*TTLCheck{
+		{HealthCheck: healthy},
+		{TTL: -time.Second, HealthCheck: healthy},
+		{TTL: 2 * time.Nanosecond, HealthCheck: healthy},
+	} {
+		if err := UseTTLCheck(client, check); err != ErrTTLCheckInvalid {
+			t.Fatalf("expect ErrTTLCheckInvalid for %+v, got %v", check, err)
+		}
+	}
+	if err := UseTTLCheck(client, &TTLCheck{TTL: time.Second}); err != ErrTTLCheckNoHealth {
+		t.Fatalf("expect ErrTTLCheckNoHealth, got %v", err)
+	}
+	if err := UseTTLCheck(client, &TTLCheck{TTL: 2 * time.Nanosecond, Interval: time.Nanosecond, HealthCheck: healthy}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,97 @@
+package filewatch
+
+import (
+	"bytes"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// 监控配置文件, 修改后重新读取并交给解析回调, 如路由表和静态服务实例文件
+// 监控文件所在目录, 编辑器保存文件时可能先删除再创建
+type FileWatcher struct {
+	File string
+
+	name    string
+	parse   func(data []byte) error
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+/*
+*
+读取文件并监控修改, 首次读取或解析失败时返回错误, 之后失败时保留之前的内容
+@param file 文件路径
+@param name 日志中的文件说明, 如 gateway routes
+@param parse 解析文件内容, 返回错误时不更新
+*/
+func NewFileWatcher(file, name string, parse func(data []byte) error) (*FileWatcher, error) {
+	fileWatcher := &FileWatcher{File: file, name: name, parse: parse}
+	if err := fileWatcher.load(false); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	fileWatcher.watcher = watcher
+	fileWatcher.done = make(chan struct{})
+	fileWatcher.wg.Add(1)
+	go fileWatcher.watch()
+	return fileWatcher, nil
+}
+
+// 停止监控文件
+func (fileWatcher *FileWatcher) Close() error {
+	close(fileWatcher.done)
+	err := fileWatcher.watcher.Close()
+	fileWatcher.wg.Wait()
+	return err
+}
+
+// 读取文件, reload 时忽略空文件(写入文件时会先清空内容)
+func (fileWatcher *FileWatcher) load(reload bool) error {
+	data, err := ioutil.ReadFile(fileWatcher.File)
+	if err != nil {
+		return err
+	}
+	if reload && len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	return fileWatcher.parse(data)
+}
+
+func (fileWatcher *FileWatcher) watch() {
+	defer fileWatcher.wg.Done()
+	fileName := filepath.Clean(fileWatcher.File)
+	for {
+		select {
+		case <-fileWatcher.done:
+			return
+		case event, ok := <-fileWatcher.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != fileName || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			// 读取失败时保留之前的内容
+			if err := fileWatcher.load(true); err != nil {
+				log.Println("Reload "+fileWatcher.name+" file error!", err)
+			}
+		case err, ok := <-fileWatcher.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("Watch "+fileWatcher.name+" file error!", err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package filewatch
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	var content string
+	parse := func(data []byte) error {
+		if string(data) == "invalid" {
+			return errors.New("invalid content")
+		}
+		mutex.Lock()
+		content = string(data)
+		mutex.Unlock()
+		return nil
+	}
+	current := func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return content
+	}
+	waitContent := func(expect string) {
+		for i := 0; current() != expect; i++ {
+			if i == 100 {
+				t.Fatalf("expect %q, got %q", expect, current())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	watcher, err := NewFileWatcher(file, "test", parse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if current() != "v1" {
+		t.Fatalf("expect v1 loaded, got %q", current())
+	}
+
+	// 修改后重新读取, 空文件和解析失败时保留之前的内容
+	for _, data := range []string{"", "invalid", "v2"} {
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitContent("v2")
+
+	// 编辑器先删除再创建文件
+	os.Remove(file)
+	if err := ioutil.WriteFile(file, []byte("v3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitContent("v3")
+
+	// 首次读取失败时返回错误
+	if _, err := NewFileWatcher(filepath.Join(dir, "missing.yaml"), "test", parse); err == nil {
+		t.Fatal("expect error for missing file")
+	}
+	if err := ioutil.WriteFile(file, []byte("invalid"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileWatcher(file, "test", parse); err == nil {
+		t.Fatal("expect error for invalid file")
+	}
+}
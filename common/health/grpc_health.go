@@ -0,0 +1,89 @@
+package health
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// Watch 检查服务状态变化的间隔
+const DefaultWatchInterval = time.Second
+
+// 基于服务自身 HealthCheck 的 grpc.health.v1.Health 实现
+// 每次检查都调用 HealthCheck, 服务名为空时表示整个服务器
+type GrpcHealthServer struct {
+	healthCheck   func() bool
+	services      map[string]bool
+	WatchInterval time.Duration // Watch 检查服务状态变化的间隔
+}
+
+/*
+*
+创建 gRPC 健康检查服务
+@param healthCheck 服务自身的健康检查
+@param services 接受检查的 gRPC 服务全名, 如 pd.StringService
+*/
+func NewGrpcHealthServer(healthCheck func() bool, services ...string) *GrpcHealthServer {
+	server := &GrpcHealthServer{
+		healthCheck:   healthCheck,
+		services:      map[string]bool{"": true},
+		WatchInterval: DefaultWatchInterval,
+	}
+	for _, service := range services {
+		server.services[service] = true
+	}
+	return server
+}
+
+// 注册到 gRPC 服务器
+func RegisterGrpcHealthServer(server *grpc.Server, healthCheck func() bool, services ...string) *GrpcHealthServer {
+	healthServer := NewGrpcHealthServer(healthCheck, services...)
+	healthpb.RegisterHealthServer(server, healthServer)
+	return healthServer
+}
+
+func (server *GrpcHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if !server.services[req.GetService()] {
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	return &healthpb.HealthCheckResponse{Status: server.status()}, nil
+}
+
+// 先返回当前状态, 之后在状态变化时推送
+func (server *GrpcHealthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	// 未知服务返回 SERVICE_UNKNOWN, 保持连接直到客户端结束
+	if !server.services[req.GetService()] {
+		if err := stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVICE_UNKNOWN}); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return status.Error(codes.Canceled, "stream has ended")
+	}
+
+	ticker := time.NewTicker(server.WatchInterval)
+	defer ticker.Stop()
+	last := healthpb.HealthCheckResponse_UNKNOWN
+	for {
+		if current := server.status(); current != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: current}); err != nil {
+				return err
+			}
+			last = current
+		}
+		select {
+		case <-stream.Context().Done():
+			return status.Error(codes.Canceled, "stream has ended")
+		case <-ticker.C:
+		}
+	}
+}
+
+func (server *GrpcHealthServer) status() healthpb.HealthCheckResponse_ServingStatus {
+	if server.healthCheck() {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
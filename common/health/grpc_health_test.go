@@ -0,0 +1,77 @@
+package health
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGrpcHealthServer(t *testing.T) {
+	var healthy int32 = 1
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	healthServer := RegisterGrpcHealthServer(server, func() bool {
+		return atomic.LoadInt32(&healthy) == 1
+	}, "pd.StringService")
+	healthServer.WatchInterval = 10 * time.Millisecond
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 服务器整体与指定服务均由 HealthCheck 决定
+	for _, service := range []string{"", "pd.StringService"} {
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("expect SERVING for %q, got %v", service, resp.Status)
+		}
+	}
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expect NotFound for unknown service, got %v", err)
+	}
+
+	// Watch 在状态变化时推送
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "pd.StringService"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus := func(expect healthpb.HealthCheckResponse_ServingStatus) {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != expect {
+			t.Fatalf("expect %v, got %v", expect, resp.Status)
+		}
+	}
+	expectStatus(healthpb.HealthCheckResponse_SERVING)
+	atomic.StoreInt32(&healthy, 0)
+	expectStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("expect NOT_SERVING, got %v", resp.Status)
+	}
+}
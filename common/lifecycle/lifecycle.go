@@ -0,0 +1,134 @@
+package lifecycle
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 默认的关闭配置
+const (
+	// 注销后等待调用方更新服务实例的时间
+	DefaultDrainTimeout = 5 * time.Second
+	// 等待处理中的请求完成的最长时间
+	DefaultShutdownTimeout = 15 * time.Second
+)
+
+// 服务优雅关闭流程:
+// 1. 从注册中心注销, 不再接收新的流量
+// 2. 等待 DrainTimeout, 调用方的服务实例缓存更新后流量停止
+// 3. 关闭 HTTP 与 gRPC 服务器, 等待处理中的请求完成, 超过 ShutdownTimeout 后强制关闭
+// 4. 上报链路追踪数据, 关闭服务发现客户端等资源
+type Lifecycle struct {
+	DrainTimeout    time.Duration
+	ShutdownTimeout time.Duration
+
+	mutex       sync.Mutex
+	deregisters []func(ctx context.Context) error
+	shutdowns   []func(ctx context.Context) error
+	flushes     []func() error
+}
+
+func NewLifecycle(drainTimeout, shutdownTimeout time.Duration) *Lifecycle {
+	return &Lifecycle{
+		DrainTimeout:    drainTimeout,
+		ShutdownTimeout: shutdownTimeout,
+	}
+}
+
+// 添加注销操作, 关闭时最先执行
+func (lifecycle *Lifecycle) OnDeregister(deregister func(ctx context.Context) error) {
+	lifecycle.mutex.Lock()
+	defer lifecycle.mutex.Unlock()
+	lifecycle.deregisters = append(lifecycle.deregisters, deregister)
+}
+
+// 添加 HTTP 服务器, 等待处理中的请求完成后关闭
+func (lifecycle *Lifecycle) AddHTTPServer(server *http.Server) {
+	lifecycle.mutex.Lock()
+	defer lifecycle.mutex.Unlock()
+	lifecycle.shutdowns = append(lifecycle.shutdowns, server.Shutdown)
+}
+
+// 添加 gRPC 服务器, 超时后强制关闭
+func (lifecycle *Lifecycle) AddGRPCServer(server *grpc.Server) {
+	lifecycle.mutex.Lock()
+	defer lifecycle.mutex.Unlock()
+	lifecycle.shutdowns = append(lifecycle.shutdowns, func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			server.Stop()
+			return ctx.Err()
+		}
+	})
+}
+
+// 添加服务器关闭后执行的操作, 如上报链路追踪数据、关闭客户端
+func (lifecycle *Lifecycle) OnFlush(flush func() error) {
+	lifecycle.mutex.Lock()
+	defer lifecycle.mutex.Unlock()
+	lifecycle.flushes = append(lifecycle.flushes, flush)
+}
+
+// 按顺序执行关闭流程, 返回第一个错误, 出错时继续执行后续步骤
+func (lifecycle *Lifecycle) Shutdown() error {
+	lifecycle.mutex.Lock()
+	deregisters, shutdowns, flushes := lifecycle.deregisters, lifecycle.shutdowns, lifecycle.flushes
+	lifecycle.mutex.Unlock()
+
+	var firstErr error
+	record := func(step string, err error) {
+		if err == nil {
+			return
+		}
+		log.Println("Shutdown", step, "error!", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lifecycle.ShutdownTimeout)
+	defer cancel()
+
+	// 注销服务实例
+	for _, deregister := range deregisters {
+		record("deregister", deregister(ctx))
+	}
+
+	// 等待调用方不再发送新的请求
+	if len(deregisters) > 0 && lifecycle.DrainTimeout > 0 {
+		time.Sleep(lifecycle.DrainTimeout)
+	}
+
+	// 同时关闭所有服务器, 共用关闭超时
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), lifecycle.ShutdownTimeout)
+	defer shutdownCancel()
+	errs := make([]error, len(shutdowns))
+	var wg sync.WaitGroup
+	for i, shutdown := range shutdowns {
+		wg.Add(1)
+		go func(i int, shutdown func(ctx context.Context) error) {
+			defer wg.Done()
+			errs[i] = shutdown(shutdownCtx)
+		}(i, shutdown)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		record("server", err)
+	}
+
+	for _, flush := range flushes {
+		record("flush", flush())
+	}
+	return firstErr
+}
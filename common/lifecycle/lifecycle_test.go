@@ -0,0 +1,108 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLifecycleShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	var (
+		mutex  sync.Mutex
+		events []string
+	)
+	event := func(name string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, name)
+	}
+
+	lifecycle := NewLifecycle(50*time.Millisecond, time.Second)
+	lifecycle.OnDeregister(func(ctx context.Context) error {
+		event("deregister")
+		return nil
+	})
+	lifecycle.AddHTTPServer(server)
+	flushErr := errors.New("flush failed")
+	lifecycle.OnFlush(func() error {
+		event("flush")
+		return flushErr
+	})
+
+	// 关闭前发出的请求正常完成
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		result <- string(body)
+	}()
+	<-started
+
+	if err := lifecycle.Shutdown(); err != flushErr {
+		t.Fatalf("expect flush error, got %v", err)
+	}
+	if body := <-result; body != "ok" {
+		t.Fatalf("expect in-flight request to finish, got %q", body)
+	}
+	if err := <-serveErr; err != http.ErrServerClosed {
+		t.Fatalf("expect ErrServerClosed, got %v", err)
+	}
+	if len(events) != 2 || events[0] != "deregister" || events[1] != "flush" {
+		t.Fatalf("unexpected shutdown order %v", events)
+	}
+}
+
+func TestLifecycleGRPCServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	// 等待服务器开始处理连接
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, listener.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	lifecycle := NewLifecycle(0, time.Second)
+	lifecycle.AddGRPCServer(server)
+	if err := lifecycle.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serveErr; err != nil {
+		t.Fatalf("expect serve to return nil after graceful stop, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package loadbalance
+
+import (
+	"context"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/hashicorp/consul/api"
+	"io"
+	"micro-go/common/discover"
+	"sync"
+	"time"
+)
+
+// go-kit 的 lb.Balancer, 使用 LoadBalance 选择实例
+// 由 sd.Endpointer 按实例创建和关闭 Endpoint, 实例未变化时复用 Endpoint 及其连接
+// 调用结束后将耗时和错误反馈给 LoadBalance, 可配合 lb.Retry 重试其他实例
+//
+//	instancer := discover.NewInstancer(client, "string", logger)
+//	balancer := loadbalance.NewBalancer(instancer, factory, &loadbalance.PeakEwmaLoadBalance{}, logger)
+//	endpoint := lb.Retry(3, time.Second, balancer)
+type Balancer struct {
+	instancer  *discover.Instancer
+	endpointer *sd.DefaultEndpointer
+	lb         LoadBalance
+
+	mutex sync.RWMutex
+	// 各实例的 Endpoint, 以实例地址 host:port 为键
+	endpoints map[string]endpoint.Endpoint
+
+	// 实例变化时通知 LoadBalance 清理下线实例的状态
+	events chan sd.Event
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+/*
+*
+创建 go-kit 负载均衡器
+@param instancer 服务实例
+@param factory 为实例地址创建 Endpoint, 如 kithttp.Client
+@param loadBalance 选择实例的负载均衡器
+*/
+func NewBalancer(instancer *discover.Instancer, factory sd.Factory, loadBalance LoadBalance, logger log.Logger) *Balancer {
+	balancer := &Balancer{
+		instancer: instancer,
+		lb:        loadBalance,
+		endpoints: make(map[string]endpoint.Endpoint),
+		events:    make(chan sd.Event),
+		quit:      make(chan struct{}),
+	}
+	balancer.wg.Add(1)
+	go balancer.watch()
+	instancer.Register(balancer.events)
+	registered := &registeredInstancer{Instancer: instancer}
+	balancer.endpointer = sd.NewEndpointer(registered, balancer.factory(factory), logger)
+	// Endpointer 在后台处理实例变化, 再次推送当前实例, 推送完成时第一次推送已处理完毕
+	// 保证返回时已创建当前实例的 Endpoint
+	instancer.Register(registered.ch)
+	return balancer
+}
+
+// 记录 Endpointer 注册的通道
+type registeredInstancer struct {
+	*discover.Instancer
+	ch chan<- sd.Event
+}
+
+func (instancer *registeredInstancer) Register(ch chan<- sd.Event) {
+	instancer.ch = ch
+	instancer.Instancer.Register(ch)
+}
+
+// 记录 Endpointer 创建的 Endpoint, 实例下线时删除
+func (balancer *Balancer) factory(factory sd.Factory) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		e, closer, err := factory(instance)
+		if err != nil {
+			return nil, nil, err
+		}
+		balancer.mutex.Lock()
+		balancer.endpoints[instance] = e
+		balancer.mutex.Unlock()
+		return e, endpointCloser(func() error {
+			balancer.mutex.Lock()
+			delete(balancer.endpoints, instance)
+			balancer.mutex.Unlock()
+			if closer != nil {
+				return closer.Close()
+			}
+			return nil
+		}), nil
+	}
+}
+
+// 实现 lb.Balancer
+func (balancer *Balancer) Endpoint() (endpoint.Endpoint, error) {
+	return balancer.EndpointFor(context.Background(), "")
+}
+
+// 根据请求的键选择实例, 如按用户ID保持会话
+// 调用返回的 Endpoint 时才选择实例, 处理中的请求数在调用前增加、调用后减少, 未调用的 Endpoint 不影响负载均衡器
+func (balancer *Balancer) EndpointFor(ctx context.Context, key string) (endpoint.Endpoint, error) {
+	if _, err := balancer.endpointer.Endpoints(); err != nil {
+		return nil, err
+	}
+	balancer.mutex.RLock()
+	count := len(balancer.endpoints)
+	balancer.mutex.RUnlock()
+	if count == 0 {
+		return nil, lb.ErrNoEndpoints
+	}
+
+	// 反馈调用结果
+	return func(callCtx context.Context, request interface{}) (interface{}, error) {
+		service, e, err := balancer.selectEndpoint(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		response, err := e(callCtx, request)
+		Done(balancer.lb, service, time.Since(start), err)
+		return response, err
+	}, nil
+}
+
+// 从已创建 Endpoint 的实例中选择, 选择期间持有读锁, 选中的实例不会被关闭
+func (balancer *Balancer) selectEndpoint(ctx context.Context, key string) (*api.AgentService, endpoint.Endpoint, error) {
+	balancer.mutex.RLock()
+	defer balancer.mutex.RUnlock()
+	services := make([]*api.AgentService, 0, len(balancer.endpoints))
+	for _, service := range balancer.instancer.AgentServices() {
+		if _, ok := balancer.endpoints[address(service)]; ok {
+			services = append(services, service)
+		}
+	}
+	if len(services) == 0 {
+		return nil, nil, lb.ErrNoEndpoints
+	}
+
+	service, err := SelectServiceFor(balancer.lb, ctx, key, services)
+	if err != nil {
+		return nil, nil, err
+	}
+	return service, balancer.endpoints[address(service)], nil
+}
+
+// 实例变化时以全部实例更新 LoadBalance
+func (balancer *Balancer) watch() {
+	defer balancer.wg.Done()
+	for {
+		select {
+		case event := <-balancer.events:
+			if event.Err == nil {
+				Update(balancer.lb, balancer.instancer.AgentServices())
+			}
+		case <-balancer.quit:
+			return
+		}
+	}
+}
+
+// 关闭所有 Endpoint, 不停止 Instancer
+func (balancer *Balancer) Close() {
+	balancer.instancer.Deregister(balancer.events)
+	close(balancer.quit)
+	balancer.wg.Wait()
+	balancer.endpointer.Close()
+}
+
+func address(service *api.AgentService) string {
+	return (&discover.ServiceInstance{Host: service.Address, Port: service.Port}).Address()
+}
+
+type endpointCloser func() error
+
+func (closer endpointCloser) Close() error {
+	return closer()
+}
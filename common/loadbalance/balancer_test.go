@@ -0,0 +1,215 @@
+package loadbalance
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd/lb"
+	"io"
+	"micro-go/common/discover"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录创建和关闭的 Endpoint, 端口 10085 的实例调用失败
+type fakeFactory struct {
+	mutex  sync.Mutex
+	closed []string
+}
+
+func (factory *fakeFactory) factory(instance string) (endpoint.Endpoint, io.Closer, error) {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if instance == "127.0.0.1:10085" {
+				return nil, errors.New("503 Service Unavailable")
+			}
+			return instance, nil
+		}, endpointCloser(func() error {
+			factory.mutex.Lock()
+			defer factory.mutex.Unlock()
+			factory.closed = append(factory.closed, instance)
+			return nil
+		}), nil
+}
+
+func newTestBalancer(t *testing.T, loadBalance LoadBalance, ports ...int) (*Balancer, *discover.StaticDiscoveryClient, *fakeFactory, func()) {
+	client, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, port := range ports {
+		client.Register(context.Background(), "string", "string-"+strconv.Itoa(i), "", "127.0.0.1", port, nil)
+	}
+	factory := &fakeFactory{}
+	instancer := discover.NewInstancer(client, "string", log.NewNopLogger())
+	balancer := NewBalancer(instancer, factory.factory, loadBalance, log.NewNopLogger())
+	return balancer, client, factory, func() {
+		balancer.Close()
+		instancer.Stop()
+		client.Close()
+	}
+}
+
+// 等待 Endpointer 创建实例的 Endpoint
+func waitEndpoints(t *testing.T, balancer *Balancer, expect int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		balancer.mutex.RLock()
+		count := len(balancer.endpoints)
+		balancer.mutex.RUnlock()
+		if count == expect {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d endpoints, got %d", expect, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBalancerRetryAndFeedback(t *testing.T) {
+	loadBalance := &PeakEwmaLoadBalance{}
+	balancer, _, _, stop := newTestBalancer(t, loadBalance, 10085, 10086)
+	defer stop()
+	waitEndpoints(t, balancer, 2)
+
+	// 失败的实例按 Penalty 记录延迟, 重试时选择另一个实例
+	retry := lb.Retry(3, time.Second, balancer)
+	for i := 0; i < 10; i++ {
+		response, err := retry(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response != "127.0.0.1:10086" {
+			t.Fatalf("expect response from healthy instance, got %v", response)
+		}
+	}
+
+	// 调用结束后反馈给负载均衡器
+	loadBalance.mutex.Lock()
+	defer loadBalance.mutex.Unlock()
+	for id, state := range loadBalance.states {
+		if state.pending != 0 {
+			t.Fatalf("expect %s pending released, got %d", id, state.pending)
+		}
+	}
+	if state := loadBalance.states["string-0"]; state == nil || state.cost != float64(DefaultEwmaPenalty) {
+		t.Fatalf("expect failing instance penalized, got %+v", state)
+	}
+}
+
+func TestBalancerEndpointLifecycle(t *testing.T) {
+	balancer, client, factory, stop := newTestBalancer(t, &RoundRobinLoadBalance{})
+	defer stop()
+	if _, err := balancer.Endpoint(); err != lb.ErrNoEndpoints {
+		t.Fatalf("expect ErrNoEndpoints, got %v", err)
+	}
+
+	client.Register(context.Background(), "string", "string-1", "", "127.0.0.1", 10086, nil)
+	client.Register(context.Background(), "string", "string-2", "", "127.0.0.1", 10087, nil)
+	waitEndpoints(t, balancer, 2)
+
+	// 实例下线后关闭其 Endpoint
+	client.DeRegister(context.Background(), "string-1")
+	waitEndpoints(t, balancer, 1)
+	factory.mutex.Lock()
+	closed := factory.closed
+	factory.mutex.Unlock()
+	if len(closed) != 1 || closed[0] != "127.0.0.1:10086" {
+		t.Fatalf("expect closed endpoint of removed instance, got %v", closed)
+	}
+
+	e, err := balancer.Endpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, _ := e(context.Background(), nil); response != "127.0.0.1:10087" {
+		t.Fatalf("expect remaining instance, got %v", response)
+	}
+}
+
+func TestBalancerEndpointFor(t *testing.T) {
+	balancer, _, _, stop := newTestBalancer(t, &ConsistentHashLoadBalance{}, 10086, 10087, 10088)
+	defer stop()
+	waitEndpoints(t, balancer, 3)
+
+	e, err := balancer.EndpointFor(context.Background(), "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := e(context.Background(), nil)
+	for i := 0; i < 10; i++ {
+		e, _ := balancer.EndpointFor(context.Background(), "user-1")
+		if response, _ := e(context.Background(), nil); response != first {
+			t.Fatalf("expect sticky instance %v, got %v", first, response)
+		}
+	}
+}
+
+func TestBalancerPendingOnCall(t *testing.T) {
+	loadBalance := &LeastConnectionLoadBalance{}
+	balancer, _, _, stop := newTestBalancer(t, loadBalance, 10086, 10087)
+	defer stop()
+	waitEndpoints(t, balancer, 2)
+
+	// 只选择不调用的 Endpoint 不计入处理中的请求
+	var endpoints []endpoint.Endpoint
+	for i := 0; i < 3; i++ {
+		e, err := balancer.Endpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints = append(endpoints, e)
+	}
+	loadBalance.mutex.Lock()
+	pending := len(loadBalance.connections)
+	loadBalance.mutex.Unlock()
+	if pending != 0 {
+		t.Fatalf("expect no pending requests before call, got %d", pending)
+	}
+
+	// 调用时计入, 调用结束后释放
+	for _, e := range endpoints {
+		if _, err := e(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loadBalance.mutex.Lock()
+	pending = len(loadBalance.connections)
+	loadBalance.mutex.Unlock()
+	if pending != 0 {
+		t.Fatalf("expect pending requests released after call, got %d", pending)
+	}
+}
+
+func TestBalancerUpdatesLoadBalance(t *testing.T) {
+	loadBalance := &WeightedRoundRobinLoadBalance{}
+	balancer, client, _, stop := newTestBalancer(t, loadBalance, 10086, 10087)
+	defer stop()
+	waitEndpoints(t, balancer, 2)
+	for i := 0; i < 2; i++ {
+		e, err := balancer.Endpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e(context.Background(), nil)
+	}
+
+	// 实例下线后清理负载均衡器中的状态
+	client.DeRegister(context.Background(), "string-0")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		loadBalance.mutex.Lock()
+		count := len(loadBalance.currentWeights)
+		loadBalance.mutex.Unlock()
+		if count == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect offline instance pruned, got %d", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,169 @@
+package loadbalance
+
+import (
+	"github.com/hashicorp/consul/api"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 根据调用结果调整选择的负载均衡器
+type FeedbackLoadBalance interface {
+	LoadBalance
+	// 调用结束后反馈实例的耗时和错误
+	Done(service *api.AgentService, latency time.Duration, err error)
+}
+
+// 反馈调用结果, 负载均衡器不需要反馈时忽略
+func Done(loadBalance LoadBalance, service *api.AgentService, latency time.Duration, err error) {
+	if feedbackLoadBalance, ok := loadBalance.(FeedbackLoadBalance); ok {
+		feedbackLoadBalance.Done(service, latency, err)
+	}
+}
+
+// peak-EWMA 默认配置
+const (
+	// 延迟的衰减时间, 越小越关注最近的调用
+	DefaultEwmaDecay = 10 * time.Second
+	// 调用失败时记录的延迟
+	DefaultEwmaPenalty = time.Second
+)
+
+// peak-EWMA 延迟感知负载均衡
+// 随机选取两个实例(power of two choices), 选择 延迟*(处理中请求数+1) 较小的实例
+// 延迟变大时立即生效, 变小时按指数加权平滑, 调用失败按 Penalty 记录延迟
+type PeakEwmaLoadBalance struct {
+	Decay   time.Duration // 延迟的衰减时间, 默认 10s
+	Penalty time.Duration // 调用失败时记录的延迟, 默认 1s
+
+	mutex sync.Mutex
+	// 各实例的延迟统计, 以实例ID为键
+	states map[string]*ewmaState
+	rand   *rand.Rand
+	now    func() time.Time
+}
+
+// 实例的延迟统计
+type ewmaState struct {
+	cost    float64 // 平滑后的延迟, 纳秒
+	stamp   time.Time
+	pending int // 处理中的请求数
+}
+
+func (loadBalance *PeakEwmaLoadBalance) SelectService(services []*api.AgentService) (*api.AgentService, error) {
+	if len(services) < 1 {
+		return nil, ErrServiceInstancesNotExist
+	}
+
+	loadBalance.mutex.Lock()
+	defer loadBalance.mutex.Unlock()
+	if loadBalance.states == nil {
+		loadBalance.states = make(map[string]*ewmaState)
+	}
+	if loadBalance.rand == nil {
+		loadBalance.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	selected := services[0]
+	if len(services) > 1 {
+		i := loadBalance.rand.Intn(len(services))
+		j := loadBalance.rand.Intn(len(services) - 1)
+		if j >= i {
+			j++
+		}
+		selected = services[i]
+		if loadBalance.score(services[j]) < loadBalance.score(selected) {
+			selected = services[j]
+		}
+	}
+	loadBalance.state(selected.ID).pending++
+	return selected, nil
+}
+
+func (loadBalance *PeakEwmaLoadBalance) Done(service *api.AgentService, latency time.Duration, err error) {
+	loadBalance.mutex.Lock()
+	defer loadBalance.mutex.Unlock()
+	state, ok := loadBalance.states[service.ID]
+	if !ok {
+		return
+	}
+	if state.pending > 0 {
+		state.pending--
+	}
+	if err != nil && latency < loadBalance.penalty() {
+		latency = loadBalance.penalty()
+	}
+
+	now := loadBalance.clock()
+	observed := float64(latency)
+	if observed > state.cost || state.stamp.IsZero() {
+		// 延迟变大时立即生效
+		state.cost = observed
+	} else {
+		elapsed := now.Sub(state.stamp)
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		weight := math.Exp(-float64(elapsed) / float64(loadBalance.decay()))
+		state.cost = state.cost*weight + observed*(1-weight)
+	}
+	state.stamp = now
+}
+
+// 实例的负载, 未有调用结果的实例在处理请求时按 Penalty 计算, 避免新实例瞬间涌入大量请求
+func (loadBalance *PeakEwmaLoadBalance) score(service *api.AgentService) float64 {
+	state, ok := loadBalance.states[service.ID]
+	if !ok {
+		return 0
+	}
+	if state.stamp.IsZero() {
+		return float64(loadBalance.penalty()) * float64(state.pending)
+	}
+	return state.cost * float64(state.pending+1)
+}
+
+func (loadBalance *PeakEwmaLoadBalance) state(id string) *ewmaState {
+	state, ok := loadBalance.states[id]
+	if !ok {
+		state = &ewmaState{}
+		loadBalance.states[id] = state
+	}
+	return state
+}
+
+// 清理已下线实例的统计, 实现 UpdatableLoadBalance
+func (loadBalance *PeakEwmaLoadBalance) Update(services []*api.AgentService) {
+	loadBalance.mutex.Lock()
+	defer loadBalance.mutex.Unlock()
+	alive := make(map[string]bool, len(services))
+	for _, service := range services {
+		alive[service.ID] = true
+	}
+	for id := range loadBalance.states {
+		if !alive[id] {
+			delete(loadBalance.states, id)
+		}
+	}
+}
+
+func (loadBalance *PeakEwmaLoadBalance) decay() time.Duration {
+	if loadBalance.Decay <= 0 {
+		return DefaultEwmaDecay
+	}
+	return loadBalance.Decay
+}
+
+func (loadBalance *PeakEwmaLoadBalance) penalty() time.Duration {
+	if loadBalance.Penalty <= 0 {
+		return DefaultEwmaPenalty
+	}
+	return loadBalance.Penalty
+}
+
+func (loadBalance *PeakEwmaLoadBalance) clock() time.Time {
+	if loadBalance.now == nil {
+		return time.Now()
+	}
+	return loadBalance.now()
+}
@@ -0,0 +1,171 @@
+package loadbalance
+
+import (
+	"errors"
+	"github.com/hashicorp/consul/api"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// 使用固定随机数和时钟的 peak-EWMA 负载均衡器
+func newTestPeakEwma(now *time.Time) *PeakEwmaLoadBalance {
+	return &PeakEwmaLoadBalance{
+		states: make(map[string]*ewmaState),
+		rand:   rand.New(rand.NewSource(1)),
+		now:    func() time.Time { return *now },
+	}
+}
+
+func TestDone(t *testing.T) {
+	services := newServices(2)
+
+	// 不需要反馈的负载均衡器忽略结果
+	Done(&RoundRobinLoadBalance{}, services[0], time.Millisecond, nil)
+
+	loadBalance := &LeastConnectionLoadBalance{}
+	first, _ := loadBalance.SelectService(services)
+	second, _ := loadBalance.SelectService(services)
+	Done(loadBalance, first, time.Millisecond, nil)
+	if service, _ := loadBalance.SelectService(services); service != first {
+		t.Fatalf("expect %s after done, got %s", first.ID, service.ID)
+	}
+	if second == first {
+		t.Fatal("expect different instances before done")
+	}
+}
+
+func TestPeakEwmaLoadBalancePrefersFastInstance(t *testing.T) {
+	now := time.Unix(0, 0)
+	loadBalance := newTestPeakEwma(&now)
+	services := newServices(3)
+	latencies := map[string]time.Duration{
+		"string-0": 100 * time.Millisecond,
+		"string-1": 10 * time.Millisecond,
+		"string-2": 10 * time.Millisecond,
+	}
+
+	// 每个实例先得到一次调用结果
+	for _, service := range services {
+		loadBalance.state(service.ID).pending++
+		loadBalance.Done(service, latencies[service.ID], nil)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		now = now.Add(10 * time.Millisecond)
+		service, err := loadBalance.SelectService(services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[service.ID]++
+		loadBalance.Done(service, latencies[service.ID], nil)
+	}
+	if counts["string-0"] != 0 || counts["string-1"] == 0 || counts["string-2"] == 0 {
+		t.Fatalf("expect slow instance avoided, got %v", counts)
+	}
+}
+
+func TestPeakEwmaLoadBalanceFailure(t *testing.T) {
+	now := time.Unix(0, 0)
+	loadBalance := newTestPeakEwma(&now)
+	services := newServices(2)
+
+	for _, service := range services {
+		loadBalance.state(service.ID).pending++
+	}
+	loadBalance.Done(services[0], time.Millisecond, errors.New("connection refused"))
+	loadBalance.Done(services[1], 20*time.Millisecond, nil)
+
+	// 失败按 Penalty 记录延迟
+	if cost := loadBalance.states["string-0"].cost; cost != float64(DefaultEwmaPenalty) {
+		t.Fatalf("expect penalty cost, got %v", time.Duration(cost))
+	}
+	for i := 0; i < 10; i++ {
+		service, _ := loadBalance.SelectService(services)
+		if service.ID != "string-1" {
+			t.Fatalf("expect failing instance avoided, got %s", service.ID)
+		}
+		loadBalance.Done(service, 20*time.Millisecond, nil)
+	}
+}
+
+func TestPeakEwmaLoadBalanceDecay(t *testing.T) {
+	now := time.Unix(0, 0)
+	loadBalance := newTestPeakEwma(&now)
+	service := &api.AgentService{ID: "a"}
+
+	observe := func(latency time.Duration) time.Duration {
+		loadBalance.SelectService([]*api.AgentService{service})
+		loadBalance.Done(service, latency, nil)
+		return time.Duration(loadBalance.states["a"].cost)
+	}
+
+	observe(10 * time.Millisecond)
+	// 延迟变大时立即生效
+	if cost := observe(200 * time.Millisecond); cost != 200*time.Millisecond {
+		t.Fatalf("expect peak cost, got %v", cost)
+	}
+	// 延迟变小时按时间衰减
+	now = now.Add(DefaultEwmaDecay)
+	cost := observe(10 * time.Millisecond)
+	if cost <= 10*time.Millisecond || cost >= 200*time.Millisecond {
+		t.Fatalf("expect smoothed cost, got %v", cost)
+	}
+	now = now.Add(10 * DefaultEwmaDecay)
+	if cost := observe(10 * time.Millisecond); cost > 11*time.Millisecond {
+		t.Fatalf("expect cost decayed, got %v", cost)
+	}
+}
+
+func TestPeakEwmaLoadBalanceColdInstance(t *testing.T) {
+	now := time.Unix(0, 0)
+	loadBalance := newTestPeakEwma(&now)
+	services := newServices(2)
+
+	loadBalance.state("string-0").pending++
+	loadBalance.Done(services[0], 50*time.Millisecond, nil)
+
+	// 新实例处理请求且未返回结果时, 不再继续分配请求
+	loadBalance.state("string-1").pending++
+	for i := 0; i < 10; i++ {
+		service, _ := loadBalance.SelectService(services)
+		if service.ID != "string-0" {
+			t.Fatalf("expect warm instance while cold probe pending, got %s", service.ID)
+		}
+		loadBalance.Done(service, 50*time.Millisecond, nil)
+	}
+}
+
+func TestPeakEwmaLoadBalanceUpdate(t *testing.T) {
+	now := time.Unix(0, 0)
+	loadBalance := newTestPeakEwma(&now)
+	services := newServices(3)
+	for _, service := range services {
+		loadBalance.state(service.ID).pending++
+		loadBalance.Done(service, time.Duration(len(service.ID))*time.Millisecond, nil)
+	}
+
+	// 选择部分实例时保留其他实例的延迟统计
+	loadBalance.SelectService(services[:1])
+	if len(loadBalance.states) != 3 {
+		t.Fatalf("expect states kept for subset, got %d", len(loadBalance.states))
+	}
+
+	// 实例下线后清理统计
+	loadBalance.Update(services[:2])
+	if _, ok := loadBalance.states["string-2"]; ok || len(loadBalance.states) != 2 {
+		t.Fatalf("expect offline instance pruned, got %v", loadBalance.states)
+	}
+}
+
+func BenchmarkPeakEwmaLoadBalance(b *testing.B) {
+	loadBalance := &PeakEwmaLoadBalance{}
+	services := newServices(10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		service, _ := loadBalance.SelectService(services)
+		loadBalance.Done(service, time.Millisecond, nil)
+	}
+}
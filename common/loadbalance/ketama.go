@@ -0,0 +1,238 @@
+package loadbalance
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"github.com/hashicorp/consul/api"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ketama 默认每个实例的虚拟节点数
+const DefaultReplicas = 160
+
+// ketama 一致性哈希环
+// 每个实例按 ID 生成 Replicas 个虚拟节点, 每次 md5 生成 4 个节点
+// 服务发现的实例列表变化时只增删变化实例的虚拟节点, 不重建整个哈希环
+type KetamaRing struct {
+	replicas int
+
+	mutex sync.RWMutex
+	// 按哈希值排序的虚拟节点
+	points []ketamaPoint
+	// 环上的实例, 以实例ID为键
+	services map[string]*api.AgentService
+}
+
+// 虚拟节点
+type ketamaPoint struct {
+	hash uint32
+	id   string
+}
+
+/*
+*
+创建 ketama 哈希环
+@param replicas 每个实例的虚拟节点数, 小于等于 0 时使用 DefaultReplicas
+*/
+func NewKetamaRing(replicas int) *KetamaRing {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	return &KetamaRing{
+		replicas: replicas,
+		services: make(map[string]*api.AgentService),
+	}
+}
+
+// 根据最新的实例列表增量更新哈希环, 实例未变化时只加读锁
+func (ring *KetamaRing) Update(services []*api.AgentService) {
+	ring.mutex.RLock()
+	changed := ring.changed(services)
+	ring.mutex.RUnlock()
+	if !changed {
+		return
+	}
+
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	if !ring.changed(services) {
+		return
+	}
+
+	var (
+		current = make(map[string]*api.AgentService, len(services))
+		added   []ketamaPoint
+		kept    int
+	)
+	for _, service := range services {
+		if _, ok := current[service.ID]; ok {
+			continue
+		}
+		current[service.ID] = service
+		if _, ok := ring.services[service.ID]; ok {
+			kept++
+		} else {
+			added = append(added, ring.servicePoints(service.ID)...)
+		}
+	}
+
+	// 删除已下线实例的虚拟节点
+	points := ring.points
+	if kept < len(ring.services) {
+		points = make([]ketamaPoint, 0, len(ring.points))
+		for _, point := range ring.points {
+			if _, ok := current[point.id]; ok {
+				points = append(points, point)
+			}
+		}
+	}
+
+	// 新增实例的虚拟节点排序后与原有节点归并
+	if len(added) > 0 {
+		sort.Slice(added, func(i, j int) bool { return added[i].less(added[j]) })
+		points = mergePoints(points, added)
+	}
+	ring.points = points
+	ring.services = current
+}
+
+// 实例的 ID 集合或地址是否变化
+func (ring *KetamaRing) changed(services []*api.AgentService) bool {
+	if len(services) != len(ring.services) {
+		return true
+	}
+	for _, service := range services {
+		current, ok := ring.services[service.ID]
+		if !ok || current.Address != service.Address || current.Port != service.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// 将哈希环上没有的实例加入, 不删除实例, 下线的实例由 Update 删除
+func (ring *KetamaRing) Add(services []*api.AgentService) {
+	ring.mutex.RLock()
+	missing := ring.missing(services)
+	ring.mutex.RUnlock()
+	if !missing {
+		return
+	}
+
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	current := make(map[string]*api.AgentService, len(ring.services)+len(services))
+	for id, service := range ring.services {
+		current[id] = service
+	}
+	var added []ketamaPoint
+	for _, service := range services {
+		if _, ok := current[service.ID]; !ok {
+			current[service.ID] = service
+			added = append(added, ring.servicePoints(service.ID)...)
+		}
+	}
+	if len(added) > 0 {
+		sort.Slice(added, func(i, j int) bool { return added[i].less(added[j]) })
+		ring.points = mergePoints(ring.points, added)
+	}
+	ring.services = current
+}
+
+// 是否有实例不在哈希环上
+func (ring *KetamaRing) missing(services []*api.AgentService) bool {
+	for _, service := range services {
+		if _, ok := ring.services[service.ID]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+*
+顺时针查找键对应的第一个属于 services 的虚拟节点, 返回 services 中的实例
+services 为环上实例的子集(如按区域、版本过滤)时不修改哈希环, 子集不变时相同的键总是选中同一实例
+@param key 键, 如用户ID
+@param services 候选实例, 不在哈希环上的实例不会被选中
+*/
+func (ring *KetamaRing) GetFrom(key string, services []*api.AgentService) *api.AgentService {
+	candidates := make(map[string]*api.AgentService, len(services))
+	for _, service := range services {
+		candidates[service.ID] = service
+	}
+	hash := ketamaHash(md5.Sum([]byte(key)), 0)
+
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	index := sort.Search(len(ring.points), func(i int) bool { return ring.points[i].hash >= hash })
+	for i := 0; i < len(ring.points); i++ {
+		if service, ok := candidates[ring.points[(index+i)%len(ring.points)].id]; ok {
+			return service
+		}
+	}
+	return nil
+}
+
+// 顺时针查找键对应的第一个虚拟节点, 哈希环为空时返回 nil
+func (ring *KetamaRing) Get(key string) *api.AgentService {
+	hash := ketamaHash(md5.Sum([]byte(key)), 0)
+
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	if len(ring.points) == 0 {
+		return nil
+	}
+	index := sort.Search(len(ring.points), func(i int) bool { return ring.points[i].hash >= hash })
+	if index == len(ring.points) {
+		index = 0
+	}
+	return ring.services[ring.points[index].id]
+}
+
+func (ring *KetamaRing) pointsPerService() int {
+	return (ring.replicas + 3) / 4 * 4
+}
+
+func (ring *KetamaRing) servicePoints(id string) []ketamaPoint {
+	points := make([]ketamaPoint, 0, ring.pointsPerService())
+	for i := 0; i < ring.pointsPerService()/4; i++ {
+		digest := md5.Sum([]byte(id + "-" + strconv.Itoa(i)))
+		for j := 0; j < 4; j++ {
+			points = append(points, ketamaPoint{hash: ketamaHash(digest, j), id: id})
+		}
+	}
+	return points
+}
+
+// 取 md5 的第 n 组 4 字节作为哈希值
+func ketamaHash(digest [md5.Size]byte, n int) uint32 {
+	return binary.LittleEndian.Uint32(digest[n*4 : n*4+4])
+}
+
+// 哈希值相同时按实例ID排序, 保证结果与实例顺序无关
+func (point ketamaPoint) less(other ketamaPoint) bool {
+	if point.hash != other.hash {
+		return point.hash < other.hash
+	}
+	return point.id < other.id
+}
+
+// 归并两个有序的虚拟节点列表
+func mergePoints(a, b []ketamaPoint) []ketamaPoint {
+	merged := make([]ketamaPoint, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if b[j].less(a[i]) {
+			merged = append(merged, b[j])
+			j++
+		} else {
+			merged = append(merged, a[i])
+			i++
+		}
+	}
+	merged = append(merged, a[i:]...)
+	return append(merged, b[j:]...)
+}
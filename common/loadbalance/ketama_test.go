@@ -0,0 +1,117 @@
+package loadbalance
+
+import (
+	"context"
+	"github.com/hashicorp/consul/api"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestKetamaRingIncrementalUpdate(t *testing.T) {
+	services := newServices(10)
+
+	// 逐步增删实例后的哈希环与直接构建的一致
+	incremental := NewKetamaRing(0)
+	incremental.Update(services[:3])
+	incremental.Update(services[:8])
+	incremental.Update(append(services[2:5:5], services[6:]...))
+	incremental.Update(services[1:])
+
+	full := NewKetamaRing(0)
+	full.Update(services[1:])
+
+	if len(full.points) != 9*DefaultReplicas {
+		t.Fatalf("expect %d points, got %d", 9*DefaultReplicas, len(full.points))
+	}
+	if !reflect.DeepEqual(incremental.points, full.points) {
+		t.Fatal("expect incremental ring equal to full ring")
+	}
+	for i := 0; i < 1000; i++ {
+		key := "user-" + strconv.Itoa(i)
+		if incremental.Get(key) != full.Get(key) {
+			t.Fatalf("key %s selected different instances", key)
+		}
+	}
+}
+
+func TestKetamaRingUpdateAddress(t *testing.T) {
+	ring := NewKetamaRing(4)
+	ring.Update([]*api.AgentService{{ID: "a", Port: 1}})
+
+	// 实例ID不变但地址变化时返回新的实例
+	ring.Update([]*api.AgentService{{ID: "a", Port: 2}})
+	if service := ring.Get("user"); service.Port != 2 {
+		t.Fatalf("expect updated instance, got %+v", service)
+	}
+	if len(ring.points) != 4 {
+		t.Fatalf("expect 4 points, got %d", len(ring.points))
+	}
+}
+
+func TestKetamaRingUpdateCopies(t *testing.T) {
+	ring := NewKetamaRing(0)
+	ring.Update(newServices(3))
+	points := ring.points
+
+	// 每次传入新创建的相同实例时不重建哈希环
+	copies := newServices(3)
+	if ring.changed(copies) {
+		t.Fatal("expect unchanged for copied instances")
+	}
+	ring.Update(copies)
+	if &ring.points[0] != &points[0] {
+		t.Fatal("expect ring not rebuilt")
+	}
+}
+
+func TestKetamaRingEmpty(t *testing.T) {
+	ring := NewKetamaRing(0)
+	if ring.Get("user") != nil {
+		t.Fatal("expect nil on empty ring")
+	}
+	ring.Update(newServices(2))
+	ring.Update(nil)
+	if ring.Get("user") != nil || len(ring.points) != 0 {
+		t.Fatal("expect all points removed")
+	}
+}
+
+func TestSelectServiceFor(t *testing.T) {
+	ctx := context.Background()
+	services := newServices(5)
+
+	// 相同的用户选中相同的实例
+	consistentHash := &ConsistentHashLoadBalance{}
+	first, err := SelectServiceFor(consistentHash, ctx, "user-1", services)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		service, _ := SelectServiceFor(consistentHash, ctx, "user-1", services)
+		if service != first {
+			t.Fatalf("expect sticky instance %s, got %s", first.ID, service.ID)
+		}
+	}
+
+	// 不感知请求的负载均衡器退化为 SelectService
+	ids := make([]string, 3)
+	roundRobin := &RoundRobinLoadBalance{}
+	for i := range ids {
+		service, _ := SelectServiceFor(roundRobin, ctx, "user-1", services)
+		ids[i] = service.ID
+	}
+	expectIds(t, ids, "string-0", "string-1", "string-2")
+}
+
+func BenchmarkKetamaRingUpdate(b *testing.B) {
+	services := newServices(50)
+	ring := NewKetamaRing(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// 每次下线一个实例再恢复
+		ring.Update(append(services[:i%50:i%50], services[i%50+1:]...))
+		ring.Update(services)
+	}
+}
@@ -1,9 +1,19 @@
 package loadbalance
 
 import (
+	"context"
 	"errors"
 	"github.com/hashicorp/consul/api"
 	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrServiceInstancesNotExist = errors.New("service instances are not exist")
+	ErrUnknownStrategy          = errors.New("unknown load balance strategy")
 )
 
 // 负载均衡器
@@ -11,21 +21,256 @@ type LoadBalance interface {
 	SelectService(service []*api.AgentService) (*api.AgentService, error)
 }
 
+// 感知请求的负载均衡器, 可根据请求的键(如用户ID)将同一用户路由到同一实例
+type RequestLoadBalance interface {
+	LoadBalance
+	SelectServiceFor(ctx context.Context, key string, services []*api.AgentService) (*api.AgentService, error)
+}
+
+// 感知实例变化的负载均衡器, 服务的实例变化时清理已下线实例的状态
+// SelectService 传入的可能是按区域、版本筛选后的部分实例, 不能据此清理
+type UpdatableLoadBalance interface {
+	LoadBalance
+	Update(services []*api.AgentService)
+}
+
+// 通知服务当前的全部实例, 负载均衡器不需要时忽略
+func Update(loadBalance LoadBalance, services []*api.AgentService) {
+	if updatableLoadBalance, ok := loadBalance.(UpdatableLoadBalance); ok {
+		updatableLoadBalance.Update(services)
+	}
+}
+
+// 根据请求选择实例, 负载均衡器不感知请求时退化为 SelectService
+func SelectServiceFor(loadBalance LoadBalance, ctx context.Context, key string, services []*api.AgentService) (*api.AgentService, error) {
+	if requestLoadBalance, ok := loadBalance.(RequestLoadBalance); ok {
+		return requestLoadBalance.SelectServiceFor(ctx, key, services)
+	}
+	return loadBalance.SelectService(services)
+}
+
 // 随机
 type RandomLoadBalance struct {
 }
 
 func (LoadBalance *RandomLoadBalance) SelectService(services []*api.AgentService) (*api.AgentService, error) {
 	if services == nil || len(services) < 1 {
-		return nil, errors.New("service instances are not exist")
+		return nil, ErrServiceInstancesNotExist
 	}
 	return services[rand.Intn(len(services))], nil
 }
 
 // 轮询
+type RoundRobinLoadBalance struct {
+	next uint64
+}
+
+func (loadBalance *RoundRobinLoadBalance) SelectService(services []*api.AgentService) (*api.AgentService, error) {
+	if len(services) < 1 {
+		return nil, ErrServiceInstancesNotExist
+	}
+	next := atomic.AddUint64(&loadBalance.next, 1) - 1
+	return services[next%uint64(len(services))], nil
+}
 
 // 轮询加权法
+// 使用平滑加权轮询, 权重高的实例不会被连续选中
+// 权重优先读取元数据中的 weight, 其次为 Consul 的 Weights.Passing, 都未设置时为 1
+type WeightedRoundRobinLoadBalance struct {
+	mutex sync.Mutex
+	// 各实例当前的权重, 以实例ID为键
+	currentWeights map[string]int
+}
+
+// 元数据中的权重键
+const MetaWeightKey = "weight"
+
+func (loadBalance *WeightedRoundRobinLoadBalance) SelectService(services []*api.AgentService) (*api.AgentService, error) {
+	if len(services) < 1 {
+		return nil, ErrServiceInstancesNotExist
+	}
+
+	loadBalance.mutex.Lock()
+	defer loadBalance.mutex.Unlock()
+	if loadBalance.currentWeights == nil {
+		loadBalance.currentWeights = make(map[string]int)
+	}
+
+	var (
+		selected    *api.AgentService
+		totalWeight int
+	)
+	for _, service := range services {
+		weight := ServiceWeight(service)
+		totalWeight += weight
+		loadBalance.currentWeights[service.ID] += weight
+		if selected == nil || loadBalance.currentWeights[service.ID] > loadBalance.currentWeights[selected.ID] {
+			selected = service
+		}
+	}
+	loadBalance.currentWeights[selected.ID] -= totalWeight
+	return selected, nil
+}
+
+// 清理已下线实例的权重, 实现 UpdatableLoadBalance
+func (loadBalance *WeightedRoundRobinLoadBalance) Update(services []*api.AgentService) {
+	loadBalance.mutex.Lock()
+	defer loadBalance.mutex.Unlock()
+	alive := make(map[string]bool, len(services))
+	for _, service := range services {
+		alive[service.ID] = true
+	}
+	for id := range loadBalance.currentWeights {
+		if !alive[id] {
+			delete(loadBalance.currentWeights, id)
+		}
+	}
+}
+
+// 实例的权重, 元数据中的 weight 优先于 Consul 的 Weights.Passing
+func ServiceWeight(service *api.AgentService) int {
+	if value, ok := service.Meta[MetaWeightKey]; ok {
+		if weight, err := strconv.Atoi(value); err == nil && weight > 0 {
+			return weight
+		}
+	}
+	if service.Weights.Passing > 0 {
+		return service.Weights.Passing
+	}
+	return 1
+}
 
 // 一致性hash 法
+// 使用 ketama 哈希环, 相同的键总是选中同一个实例, 实例增减时只影响相邻的部分键
+type ConsistentHashLoadBalance struct {
+	Replicas int // 每个实例的虚拟节点数, 默认 160
+
+	once sync.Once
+	ring *KetamaRing
+}
+
+// 没有键时随机选择
+func (loadBalance *ConsistentHashLoadBalance) SelectService(services []*api.AgentService) (*api.AgentService, error) {
+	return loadBalance.SelectServiceByKey(strconv.Itoa(rand.Int()), services)
+}
+
+// 根据请求的键(如用户ID)选择实例, 实现 RequestLoadBalance
+func (loadBalance *ConsistentHashLoadBalance) SelectServiceFor(ctx context.Context, key string, services []*api.AgentService) (*api.AgentService, error) {
+	if key == "" {
+		return loadBalance.SelectService(services)
+	}
+	return loadBalance.SelectServiceByKey(key, services)
+}
+
+// 根据键(如用户ID、请求参数)选择实例
+func (loadBalance *ConsistentHashLoadBalance) SelectServiceByKey(key string, services []*api.AgentService) (*api.AgentService, error) {
+	if len(services) < 1 {
+		return nil, ErrServiceInstancesNotExist
+	}
+	ring := loadBalance.getRing()
+	// 实例下线只在 Update 时从哈希环删除, 这里只加入尚未在环上的实例
+	// 区域、摘除和版本过滤后的子集不修改哈希环, 只从子集中选择
+	ring.Add(services)
+	return ring.GetFrom(key, services), nil
+}
+
+// 服务发现的实例列表变化时增量更新哈希环, 实现 UpdatableLoadBalance
+func (loadBalance *ConsistentHashLoadBalance) Update(services []*api.AgentService) {
+	loadBalance.getRing().Update(services)
+}
+
+func (loadBalance *ConsistentHashLoadBalance) getRing() *KetamaRing {
+	loadBalance.once.Do(func() {
+		loadBalance.ring = NewKetamaRing(loadBalance.Replicas)
+	})
+	return loadBalance.ring
+}
 
 // 最小连接数法
+// 选择处理中请求(least outstanding requests)最少的实例, 数量相同时选择靠前的实例
+// 调用方在请求结束后需要调用 Release 或 Done
+type LeastConnectionLoadBalance struct {
+	mutex sync.Mutex
+	// 各实例处理中的请求数, 以实例ID为键
+	connections map[string]int
+}
+
+func (loadBalance *LeastConnectionLoadBalance) SelectService(services []*api.AgentService) (*api.AgentService, error) {
+	if len(services) < 1 {
+		return nil, ErrServiceInstancesNotExist
+	}
+
+	loadBalance.mutex.Lock()
+	defer loadBalance.mutex.Unlock()
+	if loadBalance.connections == nil {
+		loadBalance.connections = make(map[string]int)
+	}
+	selected := services[0]
+	for _, service := range services[1:] {
+		if loadBalance.connections[service.ID] < loadBalance.connections[selected.ID] {
+			selected = service
+		}
+	}
+	loadBalance.connections[selected.ID]++
+	return selected, nil
+}
+
+// 请求结束, 释放实例的连接数
+func (loadBalance *LeastConnectionLoadBalance) Release(service *api.AgentService) {
+	loadBalance.mutex.Lock()
+	defer loadBalance.mutex.Unlock()
+	if loadBalance.connections[service.ID] <= 1 {
+		delete(loadBalance.connections, service.ID)
+		return
+	}
+	loadBalance.connections[service.ID]--
+}
+
+// 请求结束, 实现 FeedbackLoadBalance
+func (loadBalance *LeastConnectionLoadBalance) Done(service *api.AgentService, latency time.Duration, err error) {
+	loadBalance.Release(service)
+}
+
+// 负载均衡策略
+const (
+	StrategyRandom             = "random"
+	StrategyRoundRobin         = "round-robin"
+	StrategyWeightedRoundRobin = "weighted-round-robin"
+	StrategyConsistentHash     = "consistent-hash"
+	StrategyLeastConnection    = "least-connection"
+	StrategyPeakEwma           = "peak-ewma"
+)
+
+// 根据策略名称创建负载均衡器, 用于命令行参数
+func NewLoadBalance(strategy string) (LoadBalance, error) {
+	switch strategy {
+	case StrategyRandom:
+		return &RandomLoadBalance{}, nil
+	case StrategyRoundRobin:
+		return &RoundRobinLoadBalance{}, nil
+	case StrategyWeightedRoundRobin:
+		return &WeightedRoundRobinLoadBalance{}, nil
+	case StrategyConsistentHash:
+		return &ConsistentHashLoadBalance{}, nil
+	case StrategyLeastConnection:
+		return &LeastConnectionLoadBalance{}, nil
+	case StrategyPeakEwma:
+		return &PeakEwmaLoadBalance{}, nil
+	default:
+		return nil, ErrUnknownStrategy
+	}
+}
+
+// 创建负载均衡器, 同时访问多个服务时每个服务使用独立的负载均衡器, 避免实例状态互相影响
+type Factory func() LoadBalance
+
+// 根据策略名称创建负载均衡器工厂, 策略未知时返回错误
+func NewFactory(strategy string) (Factory, error) {
+	if _, err := NewLoadBalance(strategy); err != nil {
+		return nil, err
+	}
+	return func() LoadBalance {
+		lb, _ := NewLoadBalance(strategy)
+		return lb
+	}, nil
+}
@@ -0,0 +1,294 @@
+package loadbalance
+
+import (
+	"github.com/hashicorp/consul/api"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func newServices(n int) []*api.AgentService {
+	services := make([]*api.AgentService, n)
+	for i := 0; i < n; i++ {
+		services[i] = &api.AgentService{
+			ID:      "string-" + strconv.Itoa(i),
+			Service: "string",
+			Address: "127.0.0.1",
+			Port:    10085 + i,
+		}
+	}
+	return services
+}
+
+func selectIds(t *testing.T, loadBalance LoadBalance, services []*api.AgentService, times int) []string {
+	ids := make([]string, times)
+	for i := 0; i < times; i++ {
+		service, err := loadBalance.SelectService(services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = service.ID
+	}
+	return ids
+}
+
+func expectIds(t *testing.T, actual []string, expect ...string) {
+	if len(actual) != len(expect) {
+		t.Fatalf("expect %v, got %v", expect, actual)
+	}
+	for i := range expect {
+		if actual[i] != expect[i] {
+			t.Fatalf("expect %v, got %v", expect, actual)
+		}
+	}
+}
+
+func TestEmptyServices(t *testing.T) {
+	for _, loadBalance := range []LoadBalance{
+		&RandomLoadBalance{},
+		&RoundRobinLoadBalance{},
+		&WeightedRoundRobinLoadBalance{},
+		&ConsistentHashLoadBalance{},
+		&LeastConnectionLoadBalance{},
+	} {
+		if _, err := loadBalance.SelectService(nil); err != ErrServiceInstancesNotExist {
+			t.Fatalf("%T: expect ErrServiceInstancesNotExist, got %v", loadBalance, err)
+		}
+	}
+}
+
+func TestRoundRobinLoadBalance(t *testing.T) {
+	services := newServices(3)
+	ids := selectIds(t, &RoundRobinLoadBalance{}, services, 6)
+	expectIds(t, ids, "string-0", "string-1", "string-2", "string-0", "string-1", "string-2")
+}
+
+func TestWeightedRoundRobinLoadBalance(t *testing.T) {
+	// 权重 5:1:1, 平滑加权轮询不会连续选中 a
+	services := []*api.AgentService{
+		{ID: "a", Weights: api.AgentWeights{Passing: 5}},
+		{ID: "b", Weights: api.AgentWeights{Passing: 1}},
+		{ID: "c", Weights: api.AgentWeights{Passing: 1}},
+	}
+	ids := selectIds(t, &WeightedRoundRobinLoadBalance{}, services, 7)
+	expectIds(t, ids, "a", "a", "b", "a", "c", "a", "a")
+
+	// 元数据中的权重优先, 未设置时为 1
+	services = []*api.AgentService{
+		{ID: "a", Weights: api.AgentWeights{Passing: 10}, Meta: map[string]string{MetaWeightKey: "1"}},
+		{ID: "b", Meta: map[string]string{MetaWeightKey: "2"}},
+		{ID: "c"},
+	}
+	counts := make(map[string]int)
+	for _, id := range selectIds(t, &WeightedRoundRobinLoadBalance{}, services, 400) {
+		counts[id]++
+	}
+	if counts["a"] != 100 || counts["b"] != 200 || counts["c"] != 100 {
+		t.Fatalf("expect 1:2:1, got %v", counts)
+	}
+}
+
+func TestWeightedRoundRobinLoadBalanceUpdate(t *testing.T) {
+	// 交替选择不同的实例列表时不清理权重, 各实例仍然均匀分配
+	loadBalance := &WeightedRoundRobinLoadBalance{}
+	services := newServices(3)
+	others := []*api.AgentService{{ID: "other-1"}, {ID: "other-2"}}
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		counts[selectIds(t, loadBalance, services, 1)[0]]++
+		selectIds(t, loadBalance, others, 1)
+	}
+	for _, service := range services {
+		if counts[service.ID] != 10 {
+			t.Fatalf("expect even picks, got %v", counts)
+		}
+	}
+
+	// 实例下线后清理权重
+	loadBalance.Update(services[:2])
+	if len(loadBalance.currentWeights) != 2 {
+		t.Fatalf("expect offline instances pruned, got %v", loadBalance.currentWeights)
+	}
+}
+
+func TestConsistentHashLoadBalance(t *testing.T) {
+	loadBalance := &ConsistentHashLoadBalance{}
+	services := newServices(5)
+
+	// 相同的键选中相同的实例, 与实例顺序无关
+	reversed := make([]*api.AgentService, len(services))
+	for i, service := range services {
+		reversed[len(services)-1-i] = service
+	}
+	selected := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := "user-" + strconv.Itoa(i)
+		first, _ := loadBalance.SelectServiceByKey(key, services)
+		second, _ := loadBalance.SelectServiceByKey(key, reversed)
+		if first.ID != second.ID {
+			t.Fatalf("key %s selected %s and %s", key, first.ID, second.ID)
+		}
+		selected[key] = first.ID
+	}
+
+	// 移除一个实例后, 只有原本属于该实例的键发生变化
+	removed := services[2].ID
+	moved := 0
+	for key, id := range selected {
+		service, _ := loadBalance.SelectServiceByKey(key, append(services[:2:2], services[3:]...))
+		if service.ID != id {
+			if id != removed {
+				t.Fatalf("key %s moved from %s to %s", key, id, service.ID)
+			}
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("expect keys of removed instance moved")
+	}
+}
+
+func TestConsistentHashLoadBalanceSubsets(t *testing.T) {
+	loadBalance := &ConsistentHashLoadBalance{}
+	services := newServices(6)
+	loadBalance.Update(services)
+	points := len(loadBalance.ring.points)
+
+	// 并发使用不相交的子集, 选中的实例总在传入的子集中, 且不修改哈希环
+	subsets := [][]*api.AgentService{services[:3], services[3:]}
+	var wg sync.WaitGroup
+	errs := make(chan string, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(subset []*api.AgentService) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				service, _ := loadBalance.SelectServiceByKey("user-"+strconv.Itoa(i), subset)
+				if !containsService(subset, service) {
+					errs <- service.ID
+					return
+				}
+			}
+		}(subsets[g%2])
+	}
+	wg.Wait()
+	close(errs)
+	for id := range errs {
+		t.Fatalf("selected %s not in subset", id)
+	}
+	if len(loadBalance.ring.points) != points || len(loadBalance.ring.services) != len(services) {
+		t.Fatal("expect ring changed only by Update")
+	}
+
+	// 子集内选择稳定, 与其他实例的选择一致
+	for i := 0; i < 100; i++ {
+		key := "user-" + strconv.Itoa(i)
+		all, _ := loadBalance.SelectServiceByKey(key, services)
+		subset, _ := loadBalance.SelectServiceByKey(key, append([]*api.AgentService{all}, services[:1]...))
+		if subset.ID != all.ID {
+			t.Fatalf("key %s selected %s in subset and %s in all", key, subset.ID, all.ID)
+		}
+	}
+
+	// Update 删除下线实例
+	loadBalance.Update(services[:3])
+	if len(loadBalance.ring.services) != 3 {
+		t.Fatalf("expect 3 services on ring, got %d", len(loadBalance.ring.services))
+	}
+}
+
+func containsService(services []*api.AgentService, service *api.AgentService) bool {
+	for _, s := range services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLeastConnectionLoadBalance(t *testing.T) {
+	loadBalance := &LeastConnectionLoadBalance{}
+	services := newServices(3)
+
+	ids := selectIds(t, loadBalance, services, 4)
+	expectIds(t, ids, "string-0", "string-1", "string-2", "string-0")
+
+	// 释放后优先选择连接数最少的实例
+	loadBalance.Release(services[1])
+	ids = selectIds(t, loadBalance, services, 2)
+	expectIds(t, ids, "string-1", "string-1")
+	loadBalance.Release(services[2])
+	ids = selectIds(t, loadBalance, services, 1)
+	expectIds(t, ids, "string-2")
+}
+
+func benchmarkLoadBalance(b *testing.B, loadBalance LoadBalance) {
+	services := newServices(10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		loadBalance.SelectService(services)
+	}
+}
+
+func BenchmarkRandomLoadBalance(b *testing.B) {
+	benchmarkLoadBalance(b, &RandomLoadBalance{})
+}
+
+func BenchmarkRoundRobinLoadBalance(b *testing.B) {
+	benchmarkLoadBalance(b, &RoundRobinLoadBalance{})
+}
+
+func BenchmarkWeightedRoundRobinLoadBalance(b *testing.B) {
+	benchmarkLoadBalance(b, &WeightedRoundRobinLoadBalance{})
+}
+
+func BenchmarkConsistentHashLoadBalance(b *testing.B) {
+	loadBalance := &ConsistentHashLoadBalance{}
+	services := newServices(10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		loadBalance.SelectServiceByKey("user-"+strconv.Itoa(i), services)
+	}
+}
+
+func BenchmarkLeastConnectionLoadBalance(b *testing.B) {
+	loadBalance := &LeastConnectionLoadBalance{}
+	services := newServices(10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		service, _ := loadBalance.SelectService(services)
+		loadBalance.Release(service)
+	}
+}
+
+func TestNewLoadBalance(t *testing.T) {
+	for _, strategy := range []string{StrategyRandom, StrategyRoundRobin, StrategyWeightedRoundRobin, StrategyConsistentHash, StrategyLeastConnection, StrategyPeakEwma} {
+		loadBalance, err := NewLoadBalance(strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadBalance.SelectService(newServices(2)); err != nil {
+			t.Fatalf("%s: %v", strategy, err)
+		}
+	}
+	if _, err := NewLoadBalance("unknown"); err != ErrUnknownStrategy {
+		t.Fatalf("expect ErrUnknownStrategy, got %v", err)
+	}
+}
+
+func TestNewFactory(t *testing.T) {
+	factory, err := NewFactory(StrategyWeightedRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每次创建独立的负载均衡器
+	if factory() == factory() {
+		t.Fatal("expect a new load balancer for each call")
+	}
+	if _, err := NewFactory("unknown"); err != ErrUnknownStrategy {
+		t.Fatalf("expect ErrUnknownStrategy, got %v", err)
+	}
+}
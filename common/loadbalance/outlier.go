@@ -0,0 +1,260 @@
+package loadbalance
+
+import (
+	"context"
+	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/hashicorp/consul/api"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+// 异常实例检测的默认配置
+const (
+	DefaultConsecutiveFailures = 5
+	DefaultFailureRate         = 0.5
+	DefaultFailureRateRequests = 10
+	DefaultOutlierInterval     = 10 * time.Second
+	DefaultBaseEjectionTime    = 30 * time.Second
+	DefaultMaxEjectionTime     = 5 * time.Minute
+	DefaultMaxEjectionPercent  = 50
+)
+
+// 异常实例检测配置, 为 0 的字段使用默认值
+type OutlierConfig struct {
+	ConsecutiveFailures int           // 连续失败多少次后摘除, 默认 5
+	FailureRate         float64       // 统计窗口内的失败率达到多少后摘除, 默认 0.5
+	FailureRateRequests int           // 计算失败率所需的最少请求数, 默认 10
+	Interval            time.Duration // 失败率的统计窗口, 默认 10s
+	BaseEjectionTime    time.Duration // 首次摘除的时长, 之后每次摘除翻倍, 默认 30s
+	MaxEjectionTime     time.Duration // 摘除时长的上限, 默认 5m
+	MaxEjectionPercent  int           // 最多摘除的实例比例, 默认 50
+}
+
+// 异常实例检测的监控指标, 为空时不上报
+type OutlierMetrics struct {
+	Ejected   metrics.Gauge   // 实例是否被摘除, 标签 service、instance
+	Ejections metrics.Counter // 实例被摘除的次数, 标签 service、instance
+}
+
+// 创建注册到 Prometheus 的监控指标
+func NewPrometheusOutlierMetrics(namespace, subsystem string) *OutlierMetrics {
+	labels := []string{"service", "instance"}
+	return &OutlierMetrics{
+		Ejected: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "outlier_ejected",
+			Help:      "Whether the instance is ejected by outlier detection.",
+		}, labels),
+		Ejections: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "outlier_ejections_total",
+			Help:      "Total number of times the instance was ejected by outlier detection.",
+		}, labels),
+	}
+}
+
+// 异常实例检测, 包装任意负载均衡器
+// Consul 的健康检查间隔内, 根据调用结果被动摘除连续失败或失败率过高的实例
+// 摘除时长随摘除次数指数增长, 摘除的实例不超过 MaxEjectionPercent, 全部被摘除时仍使用全部实例
+type OutlierDetector struct {
+	next    LoadBalance
+	config  OutlierConfig
+	metrics *OutlierMetrics
+
+	mutex sync.Mutex
+	// 各实例的调用统计, 以实例ID为键
+	hosts map[string]*outlierHost
+	now   func() time.Time
+}
+
+// 实例的调用统计
+type outlierHost struct {
+	service      *api.AgentService
+	consecutive  int // 连续失败次数
+	requests     int // 统计窗口内的请求数
+	failures     int // 统计窗口内的失败数
+	windowStart  time.Time
+	ejections    int // 摘除次数, 决定下次摘除的时长
+	ejected      bool
+	ejectedUntil time.Time
+}
+
+/*
+*
+创建异常实例检测
+@param next 选择实例的负载均衡器
+@param config 检测配置, 为空时使用默认配置
+@param metrics 监控指标, 为空时不上报
+*/
+func NewOutlierDetector(next LoadBalance, config *OutlierConfig, metrics *OutlierMetrics) *OutlierDetector {
+	detector := &OutlierDetector{
+		next:    next,
+		metrics: metrics,
+		hosts:   make(map[string]*outlierHost),
+		now:     time.Now,
+	}
+	if config != nil {
+		detector.config = *config
+	}
+	detector.config.withDefaults()
+	return detector
+}
+
+func (config *OutlierConfig) withDefaults() {
+	if config.ConsecutiveFailures <= 0 {
+		config.ConsecutiveFailures = DefaultConsecutiveFailures
+	}
+	if config.FailureRate <= 0 {
+		config.FailureRate = DefaultFailureRate
+	}
+	if config.FailureRateRequests <= 0 {
+		config.FailureRateRequests = DefaultFailureRateRequests
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultOutlierInterval
+	}
+	if config.BaseEjectionTime <= 0 {
+		config.BaseEjectionTime = DefaultBaseEjectionTime
+	}
+	if config.MaxEjectionTime <= 0 {
+		config.MaxEjectionTime = DefaultMaxEjectionTime
+	}
+	if config.MaxEjectionPercent <= 0 {
+		config.MaxEjectionPercent = DefaultMaxEjectionPercent
+	}
+}
+
+func (detector *OutlierDetector) SelectService(services []*api.AgentService) (*api.AgentService, error) {
+	return detector.next.SelectService(detector.available(services))
+}
+
+// 透传请求的键, 摘除实例后仍然保持一致性哈希
+func (detector *OutlierDetector) SelectServiceFor(ctx context.Context, key string, services []*api.AgentService) (*api.AgentService, error) {
+	return SelectServiceFor(detector.next, ctx, key, detector.available(services))
+}
+
+// 记录调用结果, 并反馈给内部的负载均衡器
+func (detector *OutlierDetector) Done(service *api.AgentService, latency time.Duration, err error) {
+	Done(detector.next, service, latency, err)
+
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+	host, ok := detector.hosts[service.ID]
+	if !ok || host.ejected {
+		return
+	}
+
+	now := detector.now()
+	if now.Sub(host.windowStart) > detector.config.Interval {
+		host.requests, host.failures, host.windowStart = 0, 0, now
+	}
+	host.requests++
+	if err == nil {
+		host.consecutive = 0
+		// 长时间未被摘除后, 摘除时长恢复为初始值
+		if host.ejections > 0 && now.Sub(host.ejectedUntil) > detector.config.MaxEjectionTime {
+			host.ejections = 0
+		}
+		return
+	}
+	host.consecutive++
+	host.failures++
+
+	if host.consecutive >= detector.config.ConsecutiveFailures ||
+		(host.requests >= detector.config.FailureRateRequests &&
+			float64(host.failures)/float64(host.requests) >= detector.config.FailureRate) {
+		detector.eject(host, now)
+	}
+}
+
+// 摘除实例, 已摘除的实例达到上限时不再摘除
+func (detector *OutlierDetector) eject(host *outlierHost, now time.Time) {
+	ejected := 0
+	for _, h := range detector.hosts {
+		if h.ejected {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > len(detector.hosts)*detector.config.MaxEjectionPercent {
+		return
+	}
+
+	ejectionTime := detector.config.BaseEjectionTime << uint(host.ejections)
+	if ejectionTime > detector.config.MaxEjectionTime || ejectionTime <= 0 {
+		ejectionTime = detector.config.MaxEjectionTime
+	}
+	host.ejections++
+	host.ejected = true
+	host.ejectedUntil = now.Add(ejectionTime)
+	host.consecutive, host.requests, host.failures = 0, 0, 0
+	if detector.metrics != nil {
+		detector.metrics.Ejected.With(host.labels()...).Set(1)
+		detector.metrics.Ejections.With(host.labels()...).Add(1)
+	}
+}
+
+// 清理已下线实例的统计, 并以全部实例更新内部的负载均衡器
+// SelectService 传入的可能是部分实例, 只在实例变化时清理, 避免被摘除的实例提前恢复
+func (detector *OutlierDetector) Update(services []*api.AgentService) {
+	Update(detector.next, services)
+
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+	alive := make(map[string]bool, len(services))
+	for _, service := range services {
+		alive[service.ID] = true
+	}
+	for id, host := range detector.hosts {
+		if !alive[id] {
+			detector.restore(host)
+			delete(detector.hosts, id)
+		}
+	}
+}
+
+// 过滤掉被摘除的实例, 并恢复摘除时间已过的实例
+func (detector *OutlierDetector) available(services []*api.AgentService) []*api.AgentService {
+	detector.mutex.Lock()
+	defer detector.mutex.Unlock()
+	now := detector.now()
+
+	available := make([]*api.AgentService, 0, len(services))
+	for _, service := range services {
+		host, ok := detector.hosts[service.ID]
+		if !ok {
+			host = &outlierHost{windowStart: now}
+			detector.hosts[service.ID] = host
+		}
+		host.service = service
+		if host.ejected && !now.Before(host.ejectedUntil) {
+			detector.restore(host)
+		}
+		if !host.ejected {
+			available = append(available, service)
+		}
+	}
+	// 全部被摘除时仍使用全部实例
+	if len(available) == 0 {
+		return services
+	}
+	return available
+}
+
+func (detector *OutlierDetector) restore(host *outlierHost) {
+	if !host.ejected {
+		return
+	}
+	host.ejected = false
+	host.windowStart = detector.now()
+	if detector.metrics != nil {
+		detector.metrics.Ejected.With(host.labels()...).Set(0)
+	}
+}
+
+func (host *outlierHost) labels() []string {
+	return []string{"service", host.service.Service, "instance", host.service.ID}
+}
@@ -0,0 +1,167 @@
+package loadbalance
+
+import (
+	"errors"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+var errTestFailure = errors.New("503 Service Unavailable")
+
+func newTestOutlierDetector(config *OutlierConfig, now *time.Time) (*OutlierDetector, *stdprometheus.GaugeVec, *stdprometheus.CounterVec) {
+	ejected := stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{Name: "ejected"}, []string{"service", "instance"})
+	ejections := stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "ejections"}, []string{"service", "instance"})
+	detector := NewOutlierDetector(&RoundRobinLoadBalance{}, config, &OutlierMetrics{
+		Ejected:   kitprometheus.NewGauge(ejected),
+		Ejections: kitprometheus.NewCounter(ejections),
+	})
+	detector.now = func() time.Time { return *now }
+	return detector, ejected, ejections
+}
+
+func containsId(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOutlierDetectorConsecutiveFailures(t *testing.T) {
+	now := time.Unix(0, 0)
+	detector, ejected, ejections := newTestOutlierDetector(&OutlierConfig{ConsecutiveFailures: 3}, &now)
+	services := newServices(3)
+	detector.SelectService(services)
+
+	// 成功调用会重置连续失败次数
+	for i := 0; i < 2; i++ {
+		detector.Done(services[0], time.Millisecond, errTestFailure)
+	}
+	detector.Done(services[0], time.Millisecond, nil)
+	detector.Done(services[0], time.Millisecond, errTestFailure)
+	if ids := selectIds(t, detector, services, 3); !containsId(ids, "string-0") {
+		t.Fatalf("expect string-0 available, got %v", ids)
+	}
+
+	for i := 0; i < 2; i++ {
+		detector.Done(services[0], time.Millisecond, errTestFailure)
+	}
+	if ids := selectIds(t, detector, services, 6); containsId(ids, "string-0") {
+		t.Fatalf("expect string-0 ejected, got %v", ids)
+	}
+	if value := testutil.ToFloat64(ejected.WithLabelValues("string", "string-0")); value != 1 {
+		t.Fatalf("expect ejected gauge 1, got %v", value)
+	}
+	if value := testutil.ToFloat64(ejections.WithLabelValues("string", "string-0")); value != 1 {
+		t.Fatalf("expect 1 ejection, got %v", value)
+	}
+
+	// 摘除时间过后恢复
+	now = now.Add(DefaultBaseEjectionTime)
+	ids := selectIds(t, detector, services, 3)
+	expectIds(t, ids[2:], "string-0")
+	if value := testutil.ToFloat64(ejected.WithLabelValues("string", "string-0")); value != 0 {
+		t.Fatalf("expect ejected gauge 0, got %v", value)
+	}
+}
+
+func TestOutlierDetectorUpdate(t *testing.T) {
+	now := time.Unix(0, 0)
+	detector, ejected, _ := newTestOutlierDetector(&OutlierConfig{ConsecutiveFailures: 1}, &now)
+	services := newServices(3)
+	detector.SelectService(services)
+	detector.Done(services[0], time.Millisecond, errTestFailure)
+
+	// 选择部分实例时被摘除的实例不会恢复
+	selectIds(t, detector, services[1:], 2)
+	if ids := selectIds(t, detector, services, 4); containsId(ids, "string-0") {
+		t.Fatalf("expect string-0 still ejected, got %v", ids)
+	}
+
+	// 实例下线后清理统计
+	detector.Update(services[1:])
+	if _, ok := detector.hosts["string-0"]; ok {
+		t.Fatal("expect offline instance removed")
+	}
+	if value := testutil.ToFloat64(ejected.WithLabelValues("string", "string-0")); value != 0 {
+		t.Fatalf("expect ejected gauge 0 after removal, got %v", value)
+	}
+}
+
+func TestOutlierDetectorFailureRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	detector, _, _ := newTestOutlierDetector(&OutlierConfig{FailureRate: 0.5, FailureRateRequests: 4}, &now)
+	services := newServices(2)
+	detector.SelectService(services)
+
+	// 交替失败, 连续失败次数不会达到阈值, 失败率达到 50%
+	detector.Done(services[1], time.Millisecond, errTestFailure)
+	detector.Done(services[1], time.Millisecond, nil)
+	detector.Done(services[1], time.Millisecond, errTestFailure)
+	detector.Done(services[1], time.Millisecond, nil)
+	if detector.hosts["string-1"].ejected {
+		t.Fatal("expect not ejected below failure rate")
+	}
+	detector.Done(services[1], time.Millisecond, errTestFailure)
+	if !detector.hosts["string-1"].ejected {
+		t.Fatal("expect ejected by failure rate")
+	}
+}
+
+func TestOutlierDetectorEjectionTimeGrows(t *testing.T) {
+	now := time.Unix(0, 0)
+	detector, _, _ := newTestOutlierDetector(&OutlierConfig{ConsecutiveFailures: 1, BaseEjectionTime: time.Second, MaxEjectionTime: 3 * time.Second}, &now)
+	services := newServices(2)
+
+	for _, expect := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		detector.SelectService(services)
+		detector.Done(services[0], time.Millisecond, errTestFailure)
+		host := detector.hosts["string-0"]
+		if ejectionTime := host.ejectedUntil.Sub(now); !host.ejected || ejectionTime != expect {
+			t.Fatalf("expect ejected for %v, got %v", expect, ejectionTime)
+		}
+		now = host.ejectedUntil
+	}
+}
+
+func TestOutlierDetectorMaxEjectionPercent(t *testing.T) {
+	now := time.Unix(0, 0)
+	detector, _, _ := newTestOutlierDetector(&OutlierConfig{ConsecutiveFailures: 1, MaxEjectionPercent: 50}, &now)
+	services := newServices(4)
+	detector.SelectService(services)
+
+	for _, service := range services {
+		detector.Done(service, time.Millisecond, errTestFailure)
+	}
+	ejected := 0
+	for _, host := range detector.hosts {
+		if host.ejected {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Fatalf("expect 2 instances ejected, got %d", ejected)
+	}
+	if available := detector.available(services); len(available) != 2 {
+		t.Fatalf("expect 2 instances available, got %d", len(available))
+	}
+}
+
+func TestOutlierDetectorAllEjected(t *testing.T) {
+	now := time.Unix(0, 0)
+	detector, _, _ := newTestOutlierDetector(&OutlierConfig{ConsecutiveFailures: 1, MaxEjectionPercent: 100}, &now)
+	services := newServices(2)
+	detector.SelectService(services)
+	for _, service := range services {
+		detector.Done(service, time.Millisecond, errTestFailure)
+	}
+
+	// 全部被摘除时仍使用全部实例
+	if available := detector.available(services); len(available) != 2 {
+		t.Fatalf("expect all instances used, got %d", len(available))
+	}
+}
@@ -0,0 +1,104 @@
+package loadbalance
+
+import (
+	"context"
+	"github.com/hashicorp/consul/api"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 元数据中的区域键
+const MetaZoneKey = "zone"
+
+// 本区域默认至少需要的健康实例数
+const DefaultMinLocalInstances = 1
+
+// 区域感知负载均衡
+// 优先选择元数据 zone 与调用方相同的实例, 本区域健康实例少于 MinLocalInstances 时
+// 按 本区域实例数/MinLocalInstances 的比例选择本区域, 其余请求溢出到其他区域
+type ZoneAwareLoadBalance struct {
+	zone              string
+	minLocalInstances int
+	next              LoadBalance
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+/*
+*
+创建区域感知负载均衡
+@param zone 调用方所在的区域, 为空时不区分区域
+@param minLocalInstances 本区域至少需要的健康实例数, 小于等于 0 时使用 DefaultMinLocalInstances
+@param next 在选定的区域内选择实例的负载均衡器
+*/
+func NewZoneAwareLoadBalance(zone string, minLocalInstances int, next LoadBalance) *ZoneAwareLoadBalance {
+	if minLocalInstances <= 0 {
+		minLocalInstances = DefaultMinLocalInstances
+	}
+	return &ZoneAwareLoadBalance{
+		zone:              zone,
+		minLocalInstances: minLocalInstances,
+		next:              next,
+		rand:              rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (loadBalance *ZoneAwareLoadBalance) SelectService(services []*api.AgentService) (*api.AgentService, error) {
+	return loadBalance.next.SelectService(loadBalance.zoneServices(services))
+}
+
+// 透传请求的键, 在选定的区域内保持一致性哈希
+func (loadBalance *ZoneAwareLoadBalance) SelectServiceFor(ctx context.Context, key string, services []*api.AgentService) (*api.AgentService, error) {
+	return SelectServiceFor(loadBalance.next, ctx, key, loadBalance.zoneServices(services))
+}
+
+// 反馈给内部的负载均衡器
+func (loadBalance *ZoneAwareLoadBalance) Done(service *api.AgentService, latency time.Duration, err error) {
+	Done(loadBalance.next, service, latency, err)
+}
+
+// 以全部实例更新内部的负载均衡器
+func (loadBalance *ZoneAwareLoadBalance) Update(services []*api.AgentService) {
+	Update(loadBalance.next, services)
+}
+
+// 选择本次请求使用的区域的实例
+func (loadBalance *ZoneAwareLoadBalance) zoneServices(services []*api.AgentService) []*api.AgentService {
+	if loadBalance.zone == "" {
+		return services
+	}
+	local := make([]*api.AgentService, 0, len(services))
+	remote := make([]*api.AgentService, 0, len(services))
+	for _, service := range services {
+		if service.Meta[MetaZoneKey] == loadBalance.zone {
+			local = append(local, service)
+		} else {
+			remote = append(remote, service)
+		}
+	}
+	if len(local) >= loadBalance.minLocalInstances || len(remote) == 0 {
+		return local
+	}
+	if len(local) == 0 {
+		return remote
+	}
+
+	// 本区域容量不足, 按比例溢出到其他区域
+	loadBalance.mutex.Lock()
+	spill := loadBalance.rand.Intn(loadBalance.minLocalInstances) >= len(local)
+	loadBalance.mutex.Unlock()
+	if spill {
+		return remote
+	}
+	return local
+}
+
+// 调用方的区域, 未指定时读取注册元数据中的 zone
+func LocalZone(zone string, meta map[string]string) string {
+	if zone != "" {
+		return zone
+	}
+	return meta[MetaZoneKey]
+}
@@ -0,0 +1,94 @@
+package loadbalance
+
+import (
+	"github.com/hashicorp/consul/api"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func newZoneServices(zones ...string) []*api.AgentService {
+	services := make([]*api.AgentService, len(zones))
+	for i, zone := range zones {
+		services[i] = &api.AgentService{ID: zone + "-" + strconv.Itoa(i), Meta: map[string]string{MetaZoneKey: zone}}
+	}
+	return services
+}
+
+func countZones(t *testing.T, loadBalance LoadBalance, services []*api.AgentService, times int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < times; i++ {
+		service, err := loadBalance.SelectService(services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[service.Meta[MetaZoneKey]]++
+	}
+	return counts
+}
+
+func TestZoneAwareLoadBalancePrefersLocalZone(t *testing.T) {
+	loadBalance := NewZoneAwareLoadBalance("cn-east", 2, &RoundRobinLoadBalance{})
+	services := newZoneServices("cn-east", "cn-north", "cn-east", "cn-north")
+
+	counts := countZones(t, loadBalance, services, 100)
+	if counts["cn-east"] != 100 {
+		t.Fatalf("expect local zone only, got %v", counts)
+	}
+}
+
+func TestZoneAwareLoadBalanceSpillover(t *testing.T) {
+	loadBalance := NewZoneAwareLoadBalance("cn-east", 4, &RoundRobinLoadBalance{})
+	loadBalance.rand = rand.New(rand.NewSource(1))
+
+	// 本区域只剩 1/4 的容量, 约 3/4 的请求溢出到其他区域
+	services := newZoneServices("cn-east", "cn-north", "cn-north", "cn-south")
+	counts := countZones(t, loadBalance, services, 1000)
+	if counts["cn-east"] < 200 || counts["cn-east"] > 300 {
+		t.Fatalf("expect about 25%% local, got %v", counts)
+	}
+
+	// 本区域没有实例时全部溢出
+	counts = countZones(t, loadBalance, newZoneServices("cn-north", "cn-south"), 10)
+	if counts["cn-north"]+counts["cn-south"] != 10 {
+		t.Fatalf("expect all remote, got %v", counts)
+	}
+
+	// 其他区域没有实例时使用本区域
+	counts = countZones(t, loadBalance, newZoneServices("cn-east"), 10)
+	if counts["cn-east"] != 10 {
+		t.Fatalf("expect all local, got %v", counts)
+	}
+}
+
+func TestZoneAwareLoadBalanceWithoutZone(t *testing.T) {
+	loadBalance := NewZoneAwareLoadBalance("", 0, &RoundRobinLoadBalance{})
+	services := newZoneServices("cn-east", "cn-north")
+	counts := countZones(t, loadBalance, services, 10)
+	if counts["cn-east"] != 5 || counts["cn-north"] != 5 {
+		t.Fatalf("expect zones ignored, got %v", counts)
+	}
+	if _, err := loadBalance.SelectService(nil); err != ErrServiceInstancesNotExist {
+		t.Fatalf("expect ErrServiceInstancesNotExist, got %v", err)
+	}
+}
+
+func TestLocalZone(t *testing.T) {
+	if zone := LocalZone("", map[string]string{MetaZoneKey: "cn-east"}); zone != "cn-east" {
+		t.Fatalf("expect zone from meta, got %s", zone)
+	}
+	if zone := LocalZone("cn-north", map[string]string{MetaZoneKey: "cn-east"}); zone != "cn-north" {
+		t.Fatalf("expect configured zone, got %s", zone)
+	}
+}
+
+func TestZoneAwareLoadBalanceUpdate(t *testing.T) {
+	next := &WeightedRoundRobinLoadBalance{}
+	loadBalance := NewZoneAwareLoadBalance("cn-east", 1, next)
+	services := newServices(3)
+	selectIds(t, next, services, 3)
+	loadBalance.Update(services[:1])
+	if len(next.currentWeights) != 1 {
+		t.Fatalf("expect update forwarded, got %v", next.currentWeights)
+	}
+}
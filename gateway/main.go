@@ -3,20 +3,53 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/afex/hystrix-go/hystrix"
 	"github.com/go-kit/kit/log"
-	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"micro-go/common/discover"
+	"micro-go/common/loadbalance"
 	proxy2 "micro-go/gateway/proxy"
+	// 注册 pd.StringService 的消息类型, 供路由的 gRPC 转码使用
+	_ "micro-go/rpc_demo/pd"
+	"micro-go/security/service"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 func main() {
 	// 创建环境变量
 	var (
-		consulHost = flag.String("consul.host", "127.0.0.1", "consul server ip address")
-		consulPort = flag.String("consul.port", "8500", "consul server port")
+		consulHost       = flag.String("consul.host", "127.0.0.1", "consul server ip address")
+		consulPort       = flag.Int("consul.port", 8500, "consul server port")
+		discoveryBackend = flag.String("discovery.backend", "consul", "service discovery backend: consul, etcd, static")
+		etcdEndpoints    = flag.String("etcd.endpoints", "127.0.0.1:2379", "etcd endpoints, comma separated")
+		discoveryFile    = flag.String("discovery.file", "", "static services file (yaml or json), used by static backend")
+		balance          = flag.String("loadbalance", loadbalance.StrategyRandom, "load balance strategy: random, round-robin, weighted-round-robin, consistent-hash, least-connection, peak-ewma")
+		zone             = flag.String("locality.zone", "", "gateway zone, prefer service instances with the same zone meta")
+		upstreamTimeout  = flag.Duration("upstream.timeout", proxy2.DefaultUpstreamTimeout, "wait for upstream response headers, 504 on timeout")
+		minLocal         = flag.Int("locality.min-instances", loadbalance.DefaultMinLocalInstances, "spill over to other zones when local instances are fewer than this")
+		routeFile        = flag.String("route.file", "", "route table file (yaml or json), reloaded on change, /{service}/{path} is used when no route matches, see fallback in the route file")
+		authMode         = flag.String("auth.mode", "local", "validate bearer tokens locally with the jwt secret or remotely by /oauth/check_token: local, remote")
+		authSecret       = flag.String("auth.secret", "secret", "jwt secret shared with the security service, used by local mode")
+		authService      = flag.String("auth.service", proxy2.DefaultAuthService, "security service name, used by remote mode")
+		authClientId     = flag.String("auth.client-id", "clientId", "gateway client id registered in the security service")
+		authClientSecret = flag.String("auth.client-secret", "clientSecret", "gateway client secret registered in the security service")
+		rateLimitBackend = flag.String("ratelimit.backend", "memory", "rate limit counters backend: memory, redis")
+		redisAddress     = flag.String("redis.address", "127.0.0.1:6379", "redis address, used by redis rate limit backend")
+		redisPassword    = flag.String("redis.password", "", "redis password")
+		redisDB          = flag.Int("redis.db", 0, "redis database")
+		retryMax         = flag.Int("retry.max", proxy2.DefaultMaxRetries, "max retries of idempotent requests to other instances, negative to disable")
+		retryBudgetRatio = flag.Float64("retry.budget-ratio", proxy2.DefaultRetryBudgetRatio, "max ratio of retries to requests per service")
+		retryBudgetMin   = flag.Int("retry.budget-min", proxy2.DefaultRetryBudgetMinPerSecond, "retries per second always allowed per service")
+		breakerVolume    = flag.Int("breaker.volume", 20, "min requests in the rolling window before a circuit can open")
+		breakerErrors    = flag.Int("breaker.error-percent", 50, "error percent to open a circuit")
+		breakerSleep     = flag.Duration("breaker.sleep-window", 5*time.Second, "wait after a circuit opens before testing for recovery")
+		adminAddress     = flag.String("admin.address", ":9091", "address of /metrics and /hystrix/stream")
 	)
 	flag.Parse()
 
@@ -28,29 +61,109 @@ func main() {
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
 
-	// 创建consul api客户端
-	consulConfig := api.DefaultConfig()
-	consulConfig.Address = "http://" + *consulHost + ":" + *consulPort
-	consulClient, err := api.NewClient(consulConfig)
+	// 创建服务发现客户端, 只返回健康检查通过的实例
+	discoveryClient, err := discover.NewDiscoveryClient(&discover.BackendConfig{
+		Backend:       *discoveryBackend,
+		ConsulHost:    *consulHost,
+		ConsulPort:    *consulPort,
+		EtcdEndpoints: *etcdEndpoints,
+		StaticFile:    *discoveryFile,
+	})
 	if err != nil {
 		logger.Log("err", err)
 		os.Exit(1)
 	}
+	defer discoveryClient.Close()
+
+	// 缓存各服务的健康实例, 实例变化由服务发现客户端监控
+	cache := proxy2.NewServiceCache(discoveryClient, logger)
+	defer cache.Close()
+
+	// 选择服务实例的负载均衡器, 每个服务一个
+	newBalance, err := loadbalance.NewFactory(*balance)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	// 优先转发到同区域的服务实例
+	newLoadBalance := func() loadbalance.LoadBalance {
+		return loadbalance.NewZoneAwareLoadBalance(*zone, *minLocal, newBalance())
+	}
+
+	// 加载路由表, 文件修改后自动重新加载
+	routes, err := proxy2.NewRouteTable(*routeFile)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	defer routes.Close()
+
+	// 各服务的熔断和幂等请求的重试
+	resilience := proxy2.NewResilience(&proxy2.ResilienceConfig{
+		MaxRetries:              *retryMax,
+		RetryBudgetRatio:        *retryBudgetRatio,
+		RetryBudgetMinPerSecond: *retryBudgetMin,
+		Breaker: hystrix.CommandConfig{
+			RequestVolumeThreshold: *breakerVolume,
+			ErrorPercentThreshold:  *breakerErrors,
+			SleepWindow:            int(*breakerSleep / time.Millisecond),
+		},
+	}, proxy2.NewPrometheusResilienceMetrics("gateway", "upstream"))
 
 	// 创建反向代理
-	proxy := proxy2.NewReverseProxy(consulClient, logger)
+	proxy := proxy2.NewReverseProxy(cache, routes, newLoadBalance, resilience, *upstreamTimeout, logger)
+
+	// 按路由的认证策略校验令牌
+	var validator proxy2.TokenValidator
+	switch *authMode {
+	case "local":
+		validator = proxy2.NewLocalTokenValidator(service.NewJwtTokenEnhancer(*authSecret))
+	case "remote":
+		validator = proxy2.NewRemoteTokenValidator(cache, &loadbalance.RoundRobinLoadBalance{}, *authService, *authClientId, *authClientSecret, nil)
+	default:
+		logger.Log("err", "unknown auth mode "+*authMode)
+		os.Exit(1)
+	}
+
+	// 按路由的限流规则限制请求, 认证后可按客户端和用户限流
+	var limiter proxy2.RateLimiter
+	switch *rateLimitBackend {
+	case "memory":
+		limiter = proxy2.NewMemoryRateLimiter()
+	case "redis":
+		pool := proxy2.NewRedisPool(*redisAddress, *redisPassword, *redisDB)
+		defer pool.Close()
+		limiter = proxy2.NewRedisRateLimiter(pool, "")
+	default:
+		logger.Log("err", "unknown rate limit backend "+*rateLimitBackend)
+		os.Exit(1)
+	}
+	handler := proxy2.NewRateLimitHandler(routes, limiter, proxy, logger)
+	handler = proxy2.NewAuthHandler(routes, validator, handler, logger)
 
 	errc := make(chan error)
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errc <- fmt.Errorf("%s", <-c)
 	}()
 
-	// 开始监听
+	// 监控数据与熔断器状态, 使用单独的端口避免与服务路径冲突
+	go func() {
+		hystrixStreamHandler := hystrix.NewStreamHandler()
+		hystrixStreamHandler.Start()
+		defer hystrixStreamHandler.Stop()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/hystrix/stream", hystrixStreamHandler)
+		logger.Log("transport", "HTTP", "admin", *adminAddress)
+		errc <- http.ListenAndServe(*adminAddress, mux)
+	}()
+
+	// 开始监听, 同时接受明文 HTTP/2 以转发 gRPC 请求
 	go func() {
 		logger.Log("transport", "HTTP", "addr", "9090")
-		errc <- http.ListenAndServe(":9090", proxy)
+		errc <- http.ListenAndServe(":9090", h2c.NewHandler(handler, &http2.Server{}))
 	}()
 
 	// 运行，等待结束
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"micro-go/common/loadbalance"
+	"micro-go/security/endpoint"
+	"micro-go/security/model"
+	"micro-go/security/service"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissingToken    = errors.New("missing bearer token")
+	ErrInvalidToken    = errors.New("invalid or expired token")
+	ErrNotPermit       = errors.New("insufficient authorities")
+	ErrAuthUnavailable = errors.New("token check service unavailable")
+)
+
+// 转发给上游的可信身份头, 客户端传入的同名头会被删除
+const (
+	HeaderUserId          = "X-User-Id"
+	HeaderUsername        = "X-Username"
+	HeaderUserAuthorities = "X-User-Authorities"
+	HeaderClientId        = "X-Client-Id"
+)
+
+// 默认校验令牌的服务名
+const DefaultAuthService = "oauth"
+
+// 路由的认证策略
+type AuthPolicy struct {
+	Optional    bool     `json:"optional"`    // 没有令牌时仍然转发, 有令牌时校验并转发身份
+	Authorities []string `json:"authorities"` // 用户需具有其中一个权限, 为空时只校验令牌
+}
+
+// 校验访问令牌, 返回令牌对应的用户和客户端信息
+// 令牌无效时返回 ErrInvalidToken, 其他错误视为校验服务不可用
+type TokenValidator interface {
+	Validate(ctx context.Context, token string) (*model.OAuth2Details, error)
+}
+
+// 使用与 security 相同的密钥在网关本地校验 JWT 令牌
+type LocalTokenValidator struct {
+	enhancer service.TokenEnhancer
+}
+
+/*
+*
+创建本地令牌校验器
+@param enhancer 令牌增强工具, 如 service.NewJwtTokenEnhancer(secret)
+*/
+func NewLocalTokenValidator(enhancer service.TokenEnhancer) *LocalTokenValidator {
+	return &LocalTokenValidator{enhancer: enhancer}
+}
+
+func (validator *LocalTokenValidator) Validate(ctx context.Context, token string) (*model.OAuth2Details, error) {
+	accessToken, details, err := validator.enhancer.Extract(token)
+	if err != nil || accessToken.IsExpired() || details.User == nil {
+		return nil, ErrInvalidToken
+	}
+	return details, nil
+}
+
+// 通过 security 服务的 /oauth/check_token 校验令牌
+type RemoteTokenValidator struct {
+	cache        *ServiceCache
+	lb           loadbalance.LoadBalance
+	serviceName  string
+	clientId     string
+	clientSecret string
+	client       *http.Client
+}
+
+/*
+*
+创建远程令牌校验器
+@param cache 服务实例缓存, 用于查询 security 服务的实例
+@param lb 选择 security 服务实例的负载均衡器
+@param serviceName security 服务名, 为空时使用 DefaultAuthService
+@param clientId 网关在 security 注册的客户端ID
+@param clientSecret 网关的客户端密钥
+*/
+func NewRemoteTokenValidator(cache *ServiceCache, lb loadbalance.LoadBalance, serviceName, clientId, clientSecret string, client *http.Client) *RemoteTokenValidator {
+	if serviceName == "" {
+		serviceName = DefaultAuthService
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RemoteTokenValidator{
+		cache:        cache,
+		lb:           lb,
+		serviceName:  serviceName,
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		client:       client,
+	}
+}
+
+func (validator *RemoteTokenValidator) Validate(ctx context.Context, token string) (*model.OAuth2Details, error) {
+	services, err := validator.cache.Services(validator.serviceName)
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, ErrAuthUnavailable
+	}
+	instance, err := validator.lb.SelectService(services)
+	if err != nil {
+		return nil, err
+	}
+
+	checkUrl := fmt.Sprintf("http://%s:%d/oauth/check_token?token=%s", instance.Address, instance.Port, url.QueryEscape(token))
+	req, err := http.NewRequest(http.MethodPost, checkUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(validator.clientId, validator.clientSecret)
+	start := time.Now()
+	resp, err := validator.client.Do(req.WithContext(ctx))
+	if err != nil {
+		loadbalance.Done(validator.lb, instance, time.Since(start), err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("check token: %s", resp.Status)
+		loadbalance.Done(validator.lb, instance, time.Since(start), err)
+		return nil, err
+	}
+
+	response := endpoint.CheckTokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	loadbalance.Done(validator.lb, instance, time.Since(start), nil)
+	if response.Err != "" || response.OAuthDetails == nil || response.OAuthDetails.User == nil {
+		return nil, ErrInvalidToken
+	}
+	return response.OAuthDetails, nil
+}
+
+/*
+*
+创建网关认证处理方法, 按路由的认证策略校验 Authorization: Bearer 令牌
+校验通过后以 X-User-Id、X-Username、X-User-Authorities、X-Client-Id 头转发用户身份
+@param routes 路由表, 只校验设置了 auth 的路由和默认规则
+@param validator 令牌校验器
+@param next 校验通过后的处理方法, 如反向代理
+*/
+func NewAuthHandler(routes *RouteTable, validator TokenValidator, next http.Handler, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// 身份头只能由网关设置
+		for _, key := range []string{HeaderUserId, HeaderUsername, HeaderUserAuthorities, HeaderClientId} {
+			req.Header.Del(key)
+		}
+
+		match, req := matchRoute(routes, req)
+		policy, serviceName := match.auth(), match.service(req)
+		if policy == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		token := bearerToken(req)
+		if token == "" {
+			if policy.Optional {
+				next.ServeHTTP(w, req)
+				return
+			}
+			writeError(w, req, &gatewayError{status: http.StatusUnauthorized, code: ErrorCodeUnauthorized, service: serviceName, err: ErrMissingToken})
+			return
+		}
+
+		details, err := validator.Validate(req.Context(), token)
+		if err == ErrInvalidToken {
+			writeError(w, req, &gatewayError{status: http.StatusUnauthorized, code: ErrorCodeUnauthorized, service: serviceName, err: err})
+			return
+		}
+		if err != nil {
+			logger.Log("Auth failed", "validate token error", err.Error())
+			writeError(w, req, &gatewayError{status: http.StatusServiceUnavailable, code: ErrorCodeAuthUnavailable, service: serviceName, err: ErrAuthUnavailable})
+			return
+		}
+		if !policy.permit(details.User) {
+			writeError(w, req, &gatewayError{status: http.StatusForbidden, code: ErrorCodeForbidden, service: serviceName, err: ErrNotPermit})
+			return
+		}
+
+		req.Header.Set(HeaderUserId, strconv.Itoa(details.User.UserId))
+		req.Header.Set(HeaderUsername, details.User.Username)
+		req.Header.Set(HeaderUserAuthorities, strings.Join(details.User.Authorities, ","))
+		if details.Client != nil {
+			req.Header.Set(HeaderClientId, details.Client.ClientId)
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), authContextKey, details)))
+	})
+}
+
+// 请求的认证信息, 未认证时返回 nil
+func OAuth2Details(req *http.Request) *model.OAuth2Details {
+	details, _ := req.Context().Value(authContextKey).(*model.OAuth2Details)
+	return details
+}
+
+// 用户是否具有其中一个权限
+func (policy *AuthPolicy) permit(user *model.UserDetails) bool {
+	if len(policy.Authorities) == 0 {
+		return true
+	}
+	for _, required := range policy.Authorities {
+		for _, authority := range user.Authorities {
+			if authority == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 读取 Authorization: Bearer 令牌
+func bearerToken(req *http.Request) string {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(authorization[len("Bearer "):])
+	}
+	return ""
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"micro-go/common/discover"
+	"micro-go/common/loadbalance"
+	"micro-go/security/endpoint"
+	"micro-go/security/model"
+	"micro-go/security/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const authRoutesYaml = `
+routes:
+  - name: admin
+    match:
+      prefix: /admin
+    service: string
+    auth:
+      authorities: [Admin]
+  - name: simple
+    match:
+      prefix: /simple
+    service: string
+    auth:
+      optional: true
+  - name: public
+    match:
+      prefix: /public
+    service: string
+fallback:
+  auth:
+    authorities: [Admin]
+`
+
+func newAccessToken(t *testing.T, enhancer service.TokenEnhancer, expires time.Duration, user *model.UserDetails) string {
+	expiresTime := time.Now().Add(expires)
+	token, err := enhancer.Enhance(&model.OAuth2Token{ExpiresTime: &expiresTime}, &model.OAuth2Details{
+		Client: &model.ClientDetails{ClientId: "clientId"},
+		User:   user,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.TokenValue
+}
+
+func newAuthGateway(t *testing.T, validator func(cache *ServiceCache) TokenValidator, register func(client discover.DiscoveryClientV2)) (string, func()) {
+	routes, err := newRouteTableFromYaml(authRoutesYaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeUpstream := registerUpstream(t, client, "string", "string-1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderUserId, r.Header.Get(HeaderUserId))
+		w.Header().Set(HeaderUsername, r.Header.Get(HeaderUsername))
+		w.Header().Set(HeaderUserAuthorities, r.Header.Get(HeaderUserAuthorities))
+		w.Header().Set(HeaderClientId, r.Header.Get(HeaderClientId))
+	})
+	if register != nil {
+		register(client)
+	}
+	cache := NewServiceCache(client, log.NewNopLogger())
+	proxy := NewReverseProxy(cache, routes, newRandom, nil, 0, log.NewNopLogger())
+	gateway := httptest.NewServer(NewAuthHandler(routes, validator(cache), proxy, log.NewNopLogger()))
+	return gateway.URL, func() {
+		gateway.Close()
+		cache.Close()
+		closeUpstream()
+		client.Close()
+	}
+}
+
+// 从 YAML 创建不监控文件的路由表
+func newRouteTableFromYaml(data string) (*RouteTable, error) {
+	table := &RouteTable{}
+	if err := table.parse([]byte(data)); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+func doAuthRequest(t *testing.T, url, token string, header map[string]string) *http.Response {
+	req, _ := http.NewRequest("GET", url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func expectAuthStatus(t *testing.T, resp *http.Response, status int) {
+	if resp.StatusCode != status {
+		t.Fatalf("%s: expect status %d, got %d", resp.Request.URL, status, resp.StatusCode)
+	}
+	if status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("%s: expect WWW-Authenticate header", resp.Request.URL)
+	}
+}
+
+func testAuthHandler(t *testing.T, gateway string, admin, simple, expired string) {
+	spoofed := map[string]string{HeaderUserId: "99", HeaderUsername: "root"}
+
+	// 没有令牌、令牌无效或过期
+	expectAuthStatus(t, doAuthRequest(t, gateway+"/admin", "", nil), http.StatusUnauthorized)
+	expectAuthStatus(t, doAuthRequest(t, gateway+"/admin", "invalid", nil), http.StatusUnauthorized)
+	expectAuthStatus(t, doAuthRequest(t, gateway+"/admin", expired, nil), http.StatusUnauthorized)
+	// 缺少权限
+	expectAuthStatus(t, doAuthRequest(t, gateway+"/admin", simple, nil), http.StatusForbidden)
+
+	// 认证通过后转发身份, 忽略客户端传入的身份头
+	resp := doAuthRequest(t, gateway+"/admin", admin, spoofed)
+	expectAuthStatus(t, resp, http.StatusOK)
+	if resp.Header.Get(HeaderUserId) != "2" || resp.Header.Get(HeaderUsername) != "admin" ||
+		resp.Header.Get(HeaderUserAuthorities) != "Admin,Simple" || resp.Header.Get(HeaderClientId) != "clientId" {
+		t.Fatalf("unexpected identity headers %v", resp.Header)
+	}
+
+	// 可选认证的路由没有令牌时仍然转发
+	resp = doAuthRequest(t, gateway+"/simple", "", spoofed)
+	expectAuthStatus(t, resp, http.StatusOK)
+	if resp.Header.Get(HeaderUserId) != "" || resp.Header.Get(HeaderUsername) != "" {
+		t.Fatalf("expect spoofed identity removed, got %v", resp.Header)
+	}
+	resp = doAuthRequest(t, gateway+"/simple", simple, nil)
+	if resp.Header.Get(HeaderUsername) != "simple" {
+		t.Fatalf("expect simple identity, got %v", resp.Header)
+	}
+
+	// 没有认证策略的路由不校验令牌, 同样删除身份头
+	resp = doAuthRequest(t, gateway+"/public/health", "", spoofed)
+	expectAuthStatus(t, resp, http.StatusOK)
+	if resp.Header.Get(HeaderUserId) != "" {
+		t.Fatalf("expect spoofed identity removed, got %v", resp.Header)
+	}
+
+	// 默认规则使用单独的认证策略, 不能绕过路由的认证访问服务
+	expectAuthStatus(t, doAuthRequest(t, gateway+"/string/admin", "", nil), http.StatusUnauthorized)
+	expectAuthStatus(t, doAuthRequest(t, gateway+"/string/admin", simple, nil), http.StatusForbidden)
+	resp = doAuthRequest(t, gateway+"/string/admin", admin, spoofed)
+	expectAuthStatus(t, resp, http.StatusOK)
+	if resp.Header.Get(HeaderUsername) != "admin" {
+		t.Fatalf("expect admin identity, got %v", resp.Header)
+	}
+}
+
+func TestAuthHandlerLocal(t *testing.T) {
+	enhancer := service.NewJwtTokenEnhancer("secret")
+	admin := newAccessToken(t, enhancer, time.Hour, &model.UserDetails{UserId: 2, Username: "admin", Authorities: []string{"Admin", "Simple"}})
+	simple := newAccessToken(t, enhancer, time.Hour, &model.UserDetails{UserId: 1, Username: "simple", Authorities: []string{"Simple"}})
+	expired := newAccessToken(t, enhancer, -time.Hour, &model.UserDetails{UserId: 2, Username: "admin", Authorities: []string{"Admin"}})
+
+	gateway, stop := newAuthGateway(t, func(cache *ServiceCache) TokenValidator {
+		return NewLocalTokenValidator(enhancer)
+	}, nil)
+	defer stop()
+	testAuthHandler(t, gateway, admin, simple, expired)
+
+	// 其他密钥签发的令牌
+	other := newAccessToken(t, service.NewJwtTokenEnhancer("other"), time.Hour, &model.UserDetails{UserId: 2, Username: "admin", Authorities: []string{"Admin"}})
+	expectAuthStatus(t, doAuthRequest(t, gateway+"/admin", other, nil), http.StatusUnauthorized)
+}
+
+func TestAuthHandlerRemote(t *testing.T) {
+	enhancer := service.NewJwtTokenEnhancer("secret")
+	admin := newAccessToken(t, enhancer, time.Hour, &model.UserDetails{UserId: 2, Username: "admin", Authorities: []string{"Admin", "Simple"}})
+	simple := newAccessToken(t, enhancer, time.Hour, &model.UserDetails{UserId: 1, Username: "simple", Authorities: []string{"Simple"}})
+	expired := newAccessToken(t, enhancer, -time.Hour, &model.UserDetails{UserId: 2, Username: "admin", Authorities: []string{"Admin"}})
+
+	// 模拟 security 服务的 /oauth/check_token
+	checkToken := func(w http.ResponseWriter, r *http.Request) {
+		if clientId, clientSecret, ok := r.BasicAuth(); !ok || clientId != "clientId" || clientSecret != "clientSecret" || r.URL.Path != "/oauth/check_token" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response := endpoint.CheckTokenResponse{}
+		token, details, err := enhancer.Extract(r.URL.Query().Get("token"))
+		if err != nil || token.IsExpired() {
+			response.Err = "invalid token"
+		} else {
+			response.OAuthDetails = details
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+
+	var closeOAuth func()
+	gateway, stop := newAuthGateway(t, func(cache *ServiceCache) TokenValidator {
+		return NewRemoteTokenValidator(cache, &loadbalance.RandomLoadBalance{}, "", "clientId", "clientSecret", nil)
+	}, func(client discover.DiscoveryClientV2) {
+		closeOAuth = registerUpstream(t, client, DefaultAuthService, "oauth-1", checkToken)
+	})
+	defer stop()
+	testAuthHandler(t, gateway, admin, simple, expired)
+
+	// security 服务不可用
+	closeOAuth()
+	resp := doAuthRequest(t, gateway+"/admin", admin, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expect status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"github.com/hashicorp/consul/api"
+	"micro-go/common/loadbalance"
+	"sync"
+)
+
+// 各服务独立的负载均衡器
+// 权重、延迟和摘除等状态按服务隔离, 一个服务的实例变化不会清理其他服务的状态
+type serviceBalancers struct {
+	newLoadBalance loadbalance.Factory
+
+	mutex     sync.Mutex
+	balancers map[string]*serviceBalancer
+}
+
+type serviceBalancer struct {
+	lb loadbalance.LoadBalance
+
+	mutex    sync.Mutex
+	services []*api.AgentService // 最近一次更新到负载均衡器的实例
+}
+
+func newServiceBalancers(newLoadBalance loadbalance.Factory) *serviceBalancers {
+	return &serviceBalancers{
+		newLoadBalance: newLoadBalance,
+		balancers:      make(map[string]*serviceBalancer),
+	}
+}
+
+/*
+*
+服务的负载均衡器, 首次使用时创建, 实例变化时更新负载均衡器的状态
+@param serviceName 服务名
+@param services 服务的全部健康实例
+*/
+func (balancers *serviceBalancers) get(serviceName string, services []*api.AgentService) loadbalance.LoadBalance {
+	balancers.mutex.Lock()
+	balancer, ok := balancers.balancers[serviceName]
+	if !ok {
+		balancer = &serviceBalancer{lb: balancers.newLoadBalance()}
+		balancers.balancers[serviceName] = balancer
+	}
+	balancers.mutex.Unlock()
+
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	if !sameServices(balancer.services, services) {
+		loadbalance.Update(balancer.lb, services)
+		balancer.services = services
+	}
+	return balancer.lb
+}
+
+// 实例的 ID 和地址是否相同
+func sameServices(a, b []*api.AgentService) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].Address != b[i].Address || a[i].Port != b[i].Port {
+			return false
+		}
+	}
+	return true
+}
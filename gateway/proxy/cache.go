@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/consul/api"
+	"micro-go/common/discover"
+	"sync"
+)
+
+// 网关的服务实例缓存
+// 未缓存的服务每次请求一次性查询, 存在实例后才由服务发现客户端监控实例变化, 只保留健康的实例
+// 同一服务的并发查询只查询一次, 查询时不持有锁, 不影响其他服务的请求
+type ServiceCache struct {
+	client discover.DiscoveryClientV2
+	logger log.Logger
+
+	mutex      sync.RWMutex
+	instancers map[string]*discover.Instancer
+	loading    map[string]*serviceLoad
+	closed     bool
+}
+
+// 正在查询的服务, 等待查询的请求共享结果
+type serviceLoad struct {
+	done     chan struct{}
+	services []*api.AgentService
+	err      error
+}
+
+/*
+*
+创建服务实例缓存
+@param client 服务发现客户端, 返回健康检查通过的实例
+*/
+func NewServiceCache(client discover.DiscoveryClientV2, logger log.Logger) *ServiceCache {
+	return &ServiceCache{
+		client:     client,
+		logger:     logger,
+		instancers: make(map[string]*discover.Instancer),
+		loading:    make(map[string]*serviceLoad),
+	}
+}
+
+// 服务的健康实例, 服务不存在时返回空列表
+func (cache *ServiceCache) Services(serviceName string) ([]*api.AgentService, error) {
+	cache.mutex.RLock()
+	instancer, ok := cache.instancers[serviceName]
+	cache.mutex.RUnlock()
+	if ok {
+		return instancer.AgentServices(), nil
+	}
+
+	cache.mutex.Lock()
+	if instancer, ok = cache.instancers[serviceName]; ok {
+		cache.mutex.Unlock()
+		return instancer.AgentServices(), nil
+	}
+	if load, ok := cache.loading[serviceName]; ok {
+		cache.mutex.Unlock()
+		<-load.done
+		return load.services, load.err
+	}
+	load := &serviceLoad{done: make(chan struct{})}
+	cache.loading[serviceName] = load
+	cache.mutex.Unlock()
+
+	load.services, load.err = cache.load(serviceName)
+	cache.mutex.Lock()
+	delete(cache.loading, serviceName)
+	cache.mutex.Unlock()
+	close(load.done)
+	return load.services, load.err
+}
+
+// 查询服务的实例, 存在实例时使用查询结果创建监控并加入缓存
+func (cache *ServiceCache) load(serviceName string) ([]*api.AgentService, error) {
+	// 一次性查询不开启监控, 只为存在实例的服务创建监控, 避免任意路径为不存在的服务创建监控
+	instances, err := discover.LookupServices(cache.client, context.Background(), serviceName)
+	if err != nil || len(instances) == 0 {
+		return nil, err
+	}
+
+	instancer := discover.NewInstancerFrom(cache.client, serviceName, instances, cache.logger)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.closed {
+		instancer.Stop()
+	} else {
+		cache.instancers[serviceName] = instancer
+	}
+	return instancer.AgentServices(), nil
+}
+
+// 停止所有服务的监控
+func (cache *ServiceCache) Close() error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.closed = true
+	for serviceName, instancer := range cache.instancers {
+		instancer.Stop()
+		delete(cache.instancers, serviceName)
+	}
+	return nil
+}
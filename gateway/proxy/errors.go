@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrNoHealthyUpstream = errors.New("no healthy upstream")
+	ErrMissingService    = errors.New("service name is missing in request path")
+	ErrNoRouteMatched    = errors.New("no route matches the request")
+)
+
+// 网关错误码
+const (
+	ErrorCodeNoHealthyUpstream = "NO_HEALTHY_UPSTREAM"
+	ErrorCodeDiscovery         = "DISCOVERY_ERROR"
+	ErrorCodeUpstreamFailure   = "UPSTREAM_FAILURE"
+	ErrorCodeUpstreamTimeout   = "UPSTREAM_TIMEOUT"
+	ErrorCodeNotFound          = "NOT_FOUND"
+	ErrorCodeUnauthorized      = "UNAUTHORIZED"
+	ErrorCodeForbidden         = "FORBIDDEN"
+	ErrorCodeAuthUnavailable   = "AUTH_UNAVAILABLE"
+	ErrorCodeRateLimited       = "RATE_LIMITED"
+	ErrorCodeCircuitOpen       = "CIRCUIT_OPEN"
+	ErrorCodeBadRequest        = "BAD_REQUEST"
+	ErrorCodeServiceError      = "SERVICE_ERROR"
+)
+
+// 网关错误码返回给客户端的说明, 底层错误可能包含实例地址等内部信息, 只记录在网关日志中
+// 其他错误码为上游返回的业务错误或请求错误, 原样返回
+var errorMessages = map[string]string{
+	ErrorCodeNoHealthyUpstream: "no healthy upstream",
+	ErrorCodeDiscovery:         "service discovery unavailable",
+	ErrorCodeUpstreamFailure:   "upstream request failed",
+	ErrorCodeUpstreamTimeout:   "upstream request timed out",
+	ErrorCodeNotFound:          "no route or service matches the request path",
+	ErrorCodeUnauthorized:      "missing, invalid or expired bearer token",
+	ErrorCodeForbidden:         "insufficient authorities",
+	ErrorCodeAuthUnavailable:   "token check service unavailable",
+	ErrorCodeRateLimited:       "rate limit exceeded",
+	ErrorCodeCircuitOpen:       "circuit breaker is open",
+}
+
+// 返回给客户端的错误
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Service string `json:"service,omitempty"`
+	Error   string `json:"error"`
+}
+
+// 转发前发生的错误, 如没有健康实例或服务发现失败
+type gatewayError struct {
+	status  int
+	code    string
+	service string
+	err     error
+}
+
+func (err *gatewayError) Error() string {
+	return err.err.Error()
+}
+
+// 返回给客户端的错误说明
+func (err *gatewayError) message() string {
+	if message, ok := errorMessages[err.code]; ok {
+		return message
+	}
+	return err.Error()
+}
+
+// 转发前发生错误时不再请求上游, 直接交给 ErrorHandler
+type errorTransport struct {
+	http.RoundTripper
+}
+
+func (transport *errorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err, ok := req.Context().Value(errorContextKey).(*gatewayError); ok {
+		return nil, err
+	}
+	// 协议升级后的连接是长连接, 不受路由超时限制
+	route, ok := req.Context().Value(routeContextKey).(*Route)
+	if !ok || route.Timeout <= 0 || isUpgrade(req) {
+		return transport.RoundTripper.RoundTrip(req)
+	}
+
+	// 路由的超时包括读取响应体, 响应体关闭时释放
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(route.Timeout))
+	resp, err := transport.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// 记录转发前发生的错误
+func withError(req *http.Request, err *gatewayError) {
+	*req = *req.WithContext(context.WithValue(req.Context(), errorContextKey, err))
+}
+
+// 将转发错误转换为 503 没有健康实例、502 上游失败、504 上游超时
+func toGatewayError(req *http.Request, err error) *gatewayError {
+	if gatewayErr, ok := err.(*gatewayError); ok {
+		return gatewayErr
+	}
+	var service string
+	if upstream, ok := req.Context().Value(upstreamContextKey).(*upstream); ok {
+		service = upstream.service.Service
+	}
+	if isTimeout(err) {
+		return &gatewayError{status: http.StatusGatewayTimeout, code: ErrorCodeUpstreamTimeout, service: service, err: err}
+	}
+	return &gatewayError{status: http.StatusBadGateway, code: ErrorCodeUpstreamFailure, service: service, err: err}
+}
+
+// 是否为连接或等待响应超时
+func isTimeout(err error) bool {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// 以 JSON 返回错误, gRPC 请求返回 grpc-status
+func writeError(w http.ResponseWriter, req *http.Request, err *gatewayError) {
+	if isGrpc(req) {
+		writeGrpcError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gateway"`)
+	}
+	w.WriteHeader(err.status)
+	json.NewEncoder(w).Encode(ErrorResponse{Code: err.code, Service: err.service, Error: err.message()})
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"micro-go/common/discover"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func expectErrorResponse(t *testing.T, url string, status int, code, service string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("%s: expect status %d, got %d", url, status, resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/json; charset=utf-8" {
+		t.Fatalf("%s: expect json, got %s", url, contentType)
+	}
+	body := ErrorResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != code || body.Service != service || body.Error == "" {
+		t.Fatalf("%s: unexpected error response %+v", url, body)
+	}
+	// 网关错误只返回固定说明, 不暴露实例地址等底层错误
+	if message, ok := errorMessages[code]; ok && body.Error != message {
+		t.Fatalf("%s: expect message %q, got %q", url, message, body.Error)
+	}
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	client, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 已停止的实例
+	closeDown := registerUpstream(t, client, "down", "down-1", func(w http.ResponseWriter, r *http.Request) {})
+	closeDown()
+	// 响应超时的实例
+	block := make(chan struct{})
+	defer registerUpstream(t, client, "slow", "slow-1", func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	})()
+	defer close(block)
+
+	cache := NewServiceCache(client, log.NewNopLogger())
+	defer cache.Close()
+	gateway := httptest.NewServer(NewReverseProxy(cache, nil, newRandom, nil, 100*time.Millisecond, log.NewNopLogger()))
+	defer gateway.Close()
+
+	expectErrorResponse(t, gateway.URL+"/", http.StatusNotFound, ErrorCodeNotFound, "")
+	expectErrorResponse(t, gateway.URL+"/unknown/health", http.StatusServiceUnavailable, ErrorCodeNoHealthyUpstream, "unknown")
+	expectErrorResponse(t, gateway.URL+"/down/health", http.StatusBadGateway, ErrorCodeUpstreamFailure, "down")
+	expectErrorResponse(t, gateway.URL+"/slow/health", http.StatusGatewayTimeout, ErrorCodeUpstreamTimeout, "slow")
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/codes"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 上游协议
+const (
+	ProtocolHTTP = "http" // HTTP/1.1, 支持 WebSocket 等协议升级
+	ProtocolH2C  = "h2c"  // 明文 HTTP/2, 用于 gRPC 服务
+)
+
+// 实例元数据中的 gRPC 端口, 同时提供 HTTP 和 gRPC 的服务以注册的端口提供 HTTP
+const MetaGrpcPort = "grpc_port"
+
+// 是否为 gRPC 请求, 转码的请求来自 JSON 客户端
+func isGrpc(req *http.Request) bool {
+	if route, ok := req.Context().Value(routeContextKey).(*Route); ok && route.Grpc != nil {
+		return false
+	}
+	return req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// 是否为协议升级请求, 如 WebSocket
+func isUpgrade(req *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(req.Header["Connection"], "Upgrade")
+}
+
+// 转发使用的协议, 路由未指定时 gRPC 请求使用 h2c, 协议升级只能使用 HTTP/1.1
+func upstreamProtocol(req *http.Request, route *Route) string {
+	if route != nil && route.Grpc != nil {
+		return ProtocolH2C
+	}
+	if isUpgrade(req) {
+		return ProtocolHTTP
+	}
+	if route != nil && route.Protocol != "" {
+		return route.Protocol
+	}
+	if isGrpc(req) {
+		return ProtocolH2C
+	}
+	return ProtocolHTTP
+}
+
+// 实例地址, h2c 优先使用元数据中的 gRPC 端口
+func upstreamHost(service *api.AgentService, protocol string) string {
+	port := service.Port
+	if protocol == ProtocolH2C {
+		if grpcPort, err := strconv.Atoi(service.Meta[MetaGrpcPort]); err == nil {
+			port = grpcPort
+		}
+	}
+	return fmt.Sprintf("%s:%d", service.Address, port)
+}
+
+// 按上游协议选择 HTTP/1.1 或 h2c 的 Transport
+type protocolTransport struct {
+	http *http.Transport
+	h2c  *http2.Transport
+}
+
+// h2c 没有响应头超时, 由路由超时和 gRPC 客户端的 deadline 控制
+func newProtocolTransport(timeout time.Duration) *protocolTransport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &protocolTransport{
+		http: transport,
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+		},
+	}
+}
+
+func (transport *protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if upstream, ok := req.Context().Value(upstreamContextKey).(*upstream); ok && upstream.protocol == ProtocolH2C {
+		// gRPC 要求 TE: trailers, 转发时作为逐跳头被删除
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") && req.Header.Get("Te") == "" {
+			req = req.Clone(req.Context())
+			req.Header.Set("Te", "trailers")
+		}
+		return transport.h2c.RoundTrip(req)
+	}
+	return transport.http.RoundTrip(req)
+}
+
+// 网关错误对应的 gRPC 状态码
+func grpcCode(status int) codes.Code {
+	switch status {
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Unavailable
+}
+
+// gRPC 客户端只识别 grpc-status, 以只有头的响应返回错误
+func writeGrpcError(w http.ResponseWriter, err *gatewayError) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(grpcCode(err.status))))
+	w.Header().Set("Grpc-Message", err.code+": "+err.message())
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"micro-go/common/discover"
+	"micro-go/rpc_demo/pd"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const protocolRoutesYaml = `
+routes:
+  - name: string-grpc
+    match:
+      prefix: /pd.StringService
+      headers:
+        X-Route: string-service
+    service: string-service
+  - name: missing-grpc
+    match:
+      prefix: /pd.StringService
+      headers:
+        X-Route: missing
+    service: missing
+  - name: echo
+    match:
+      prefix: /echo
+    service: echo
+    rewrite: /
+    timeout: 50ms
+  - name: grpc
+    match:
+      prefix: /pd.StringService
+    service: pd.StringService
+`
+
+type testStringServer struct {
+	pd.UnimplementedStringServiceServer
+}
+
+func (server *testStringServer) Concat(ctx context.Context, req *pd.StringRequest) (*pd.StringResponse, error) {
+	return &pd.StringResponse{Ret: req.A + req.B}, nil
+}
+
+func startGrpcUpstream(t *testing.T, server pd.StringServiceServer) (string, int, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	pd.RegisterStringServiceServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	grpcPort, _ := strconv.Atoi(port)
+	return host, grpcPort, grpcServer.Stop
+}
+
+func TestReverseProxyProtocols(t *testing.T) {
+	defer hystrix.Flush()
+	routes, err := newRouteTableFromYaml(protocolRoutesYaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// gRPC 服务, 以服务全名注册, 或以 HTTP 端口注册并在元数据中声明 gRPC 端口
+	host, grpcPort, stopGrpc := startGrpcUpstream(t, &testStringServer{})
+	defer stopGrpc()
+	if err := client.Register(context.Background(), "pd.StringService", "grpc-1", "", host, grpcPort, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Register(context.Background(), "string-service", "string-service-1", "", host, 1,
+		&discover.RegisterOptions{Meta: map[string]string{MetaGrpcPort: strconv.Itoa(grpcPort)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// WebSocket 回显服务
+	upgrader := websocket.Upgrader{}
+	defer registerUpstream(t, client, "echo", "echo-1", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, message); err != nil {
+				return
+			}
+		}
+	})()
+
+	cache := NewServiceCache(client, log.NewNopLogger())
+	defer cache.Close()
+	resilience, _ := newTestResilience(nil)
+	proxy := NewReverseProxy(cache, routes, newRoundRobin, resilience, 0, log.NewNopLogger())
+	gateway := httptest.NewServer(h2c.NewHandler(proxy, &http2.Server{}))
+	defer gateway.Close()
+	gatewayAddress := strings.TrimPrefix(gateway.URL, "http://")
+
+	conn, err := grpc.Dial(gatewayAddress, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stringClient := pd.NewStringServiceClient(conn)
+	concat := func(route string) (*pd.StringResponse, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if route != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-route", route)
+		}
+		return stringClient.Concat(ctx, &pd.StringRequest{A: "a", B: "b"})
+	}
+
+	// 按 gRPC 服务全名注册的服务, 或使用元数据中的 gRPC 端口
+	for _, route := range []string{"", "string-service"} {
+		resp, err := concat(route)
+		if err != nil {
+			t.Fatalf("route %q: %v", route, err)
+		}
+		if resp.Ret != "ab" {
+			t.Fatalf("route %q: expect ab, got %s", route, resp.Ret)
+		}
+	}
+
+	// 没有配置路由时按 gRPC 服务全名转发
+	fallback := httptest.NewServer(h2c.NewHandler(NewReverseProxy(cache, nil, newRoundRobin, nil, 0, log.NewNopLogger()), &http2.Server{}))
+	defer fallback.Close()
+	fallbackConn, err := grpc.Dial(strings.TrimPrefix(fallback.URL, "http://"), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fallbackConn.Close()
+	if resp, err := pd.NewStringServiceClient(fallbackConn).Concat(context.Background(), &pd.StringRequest{A: "a", B: "b"}); err != nil || resp.Ret != "ab" {
+		t.Fatalf("expect ab by service full name, got %v %v", resp, err)
+	}
+
+	// 网关错误以 grpc-status 返回
+	if _, err := concat("missing"); status.Code(err) != codes.Unavailable || !strings.Contains(status.Convert(err).Message(), ErrorCodeNoHealthyUpstream) {
+		t.Fatalf("expect unavailable, got %v", err)
+	}
+	_, err = stringClient.Diff(context.Background(), &pd.StringRequest{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expect unimplemented from upstream, got %v", err)
+	}
+
+	// WebSocket 连接不受路由超时限制
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+gatewayAddress+"/echo/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for _, message := range []string{"hello", "world"} {
+		time.Sleep(100 * time.Millisecond)
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		_, reply, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply) != message {
+			t.Fatalf("expect echo %s, got %s", message, reply)
+		}
+	}
+}
@@ -1,53 +1,201 @@
 package proxy
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"github.com/go-kit/kit/log"
 	"github.com/hashicorp/consul/api"
-	"math/rand"
+	"micro-go/common/loadbalance"
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"time"
 )
 
-// 创建反向代理处理方法
-func NewReverseProxy(client *api.Client, logger log.Logger) *httputil.ReverseProxy {
+// 转发请求的上下文键
+type contextKey int
+
+const (
+	upstreamContextKey contextKey = iota
+	errorContextKey
+	routeContextKey
+	authContextKey
+	matchContextKey
+)
+
+// 默认的上游响应超时
+const DefaultUpstreamTimeout = 30 * time.Second
+
+// 本次转发选择的服务实例
+type upstream struct {
+	name     string
+	service  *api.AgentService
+	version  string                  // 按路由分流选择的版本
+	services []*api.AgentService     // 服务的全部健康实例, 重试时选择其他实例
+	protocol string                  // 上游协议, http 或 h2c
+	lb       loadbalance.LoadBalance // 服务的负载均衡器, 重试和转发结束时使用
+	start    time.Time
+}
+
+/*
+*
+创建反向代理处理方法
+@param cache 服务实例缓存
+@param routes 路由表, 没有配置路由时按 /{serviceName}/{path} 转发, gRPC 请求按 /{package.Service}/{Method} 转发, 为 nil 时只使用默认规则
+@param newLoadBalance 创建负载均衡器, 每个服务使用独立的负载均衡器选择实例, 转发结束后反馈耗时和错误
+@param resilience 各服务的熔断和重试, 为 nil 时不熔断也不重试
+@param timeout 等待上游响应头的超时, 超时返回 504, 小于等于 0 时使用 DefaultUpstreamTimeout
+*/
+func NewReverseProxy(cache *ServiceCache, routes *RouteTable, newLoadBalance loadbalance.Factory, resilience *Resilience, timeout time.Duration, logger log.Logger) *httputil.ReverseProxy {
+	balancers := newServiceBalancers(newLoadBalance)
+
 	// 创建Director
 	director := func(req *http.Request) {
-		// 查询原始请求路径
-		reqPath := req.URL.Path
-		if reqPath == "" {
+		var serviceName, destPath string
+		match, matched := matchRoute(routes, req)
+		*req = *matched
+		route := match.route
+		if route != nil {
+			// 按路由转发, 超时和响应头由 Transport 和 ModifyResponse 处理
+			serviceName = route.Service
+			destPath = route.rewritePath(req.URL.Path)
+			route.RequestHeaders.apply(req.Header)
+			*req = *req.WithContext(context.WithValue(req.Context(), routeContextKey, route))
+			// JSON 请求转为 gRPC 调用
+			if route.Grpc != nil {
+				destPath = route.Grpc.path()
+				if err := transcodeRequest(req, route.Grpc); err != nil {
+					withError(req, &gatewayError{status: http.StatusBadRequest, code: ErrorCodeBadRequest, service: serviceName, err: err})
+					return
+				}
+			}
+		} else if !match.fallback {
+			withError(req, &gatewayError{status: http.StatusNotFound, code: ErrorCodeNotFound, err: ErrNoRouteMatched})
 			return
+		} else {
+			// 按照分隔符'/' 对路径进行分解，获取服务名称serviceName
+			pathArray := strings.Split(req.URL.Path, "/")
+			if len(pathArray) < 2 || pathArray[1] == "" {
+				withError(req, &gatewayError{status: http.StatusNotFound, code: ErrorCodeNotFound, err: ErrMissingService})
+				return
+			}
+			serviceName = pathArray[1]
+			// 重新组织请求路径，去掉服务名称部分
+			destPath = "/" + strings.Join(pathArray[2:], "/")
+			// gRPC 以服务全名作为服务名, 保留完整的方法路径
+			if isGrpc(req) {
+				destPath = req.URL.Path
+			}
 		}
 
-		// 按照分隔符'/' 对路径进行分解，获取服务名称serviceName
-		pathArray := strings.Split(reqPath, "/")
-		serviceName := pathArray[1]
-
-		// 调用consul api 查询serviceName 的服务实例列表
-		result, _, err := client.Catalog().Service(serviceName, "", nil)
+		// 从缓存中查询serviceName 的健康服务实例列表
+		result, err := cache.Services(serviceName)
 		if err != nil {
 			logger.Log("ReverseProxy failed", "query service instance error", err.Error())
+			withError(req, &gatewayError{status: http.StatusServiceUnavailable, code: ErrorCodeDiscovery, service: serviceName, err: err})
 			return
 		}
 
+		// 负载均衡器按服务的全部实例更新状态
+		lb := balancers.get(serviceName, result)
+
+		// 按权重或请求指定的版本选择实例
+		var version string
+		if route != nil && route.Split != nil {
+			version, result = route.Split.selectServices(req, result)
+		}
+
 		if len(result) == 0 {
 			logger.Log("ReverseProxy failed", "no such service instance", serviceName)
+			withError(req, &gatewayError{status: http.StatusServiceUnavailable, code: ErrorCodeNoHealthyUpstream, service: serviceName, err: ErrNoHealthyUpstream})
 			return
 		}
 
-		// 重新组织请求路径，去掉服务名称部分
-		destPath := strings.Join(pathArray[2:], "/")
+		// 使用负载均衡器选择一个服务实例, 一致性哈希按用户或路由指定的请求头固定实例
+		tgt, err := loadbalance.SelectServiceFor(lb, req.Context(), hashKey(req, route), result)
+		if err != nil {
+			logger.Log("ReverseProxy failed", "select service instance error", err.Error())
+			withError(req, &gatewayError{status: http.StatusServiceUnavailable, code: ErrorCodeNoHealthyUpstream, service: serviceName, err: err})
+			return
+		}
+		logger.Log("service id", tgt.ID)
 
-		// 随机选择一个服务实例
-		tgt := result[rand.Int()%len(result)]
-		logger.Log("service id", tgt.ServiceID)
+		// 记录选择的实例, 转发结束后反馈给负载均衡器
+		protocol := upstreamProtocol(req, route)
+		*req = *req.WithContext(context.WithValue(req.Context(), upstreamContextKey, &upstream{name: serviceName, version: version, service: tgt, services: result, protocol: protocol, lb: lb, start: time.Now()}))
 
 		// 设置代理服务地址信息
 		req.URL.Scheme = "http"
-		req.URL.Host = fmt.Sprintf("%s:%d", tgt.ServiceAddress, tgt.ServicePort)
-		req.URL.Path = "/" + destPath
+		req.URL.Host = upstreamHost(tgt, protocol)
+		req.URL.Path = destPath
+		req.URL.RawPath = ""
 	}
 
-	return &httputil.ReverseProxy{Director: director}
+	// 5xx 视为实例故障, 转码的响应按 grpc-status 转换后判断
+	modifyResponse := func(resp *http.Response) error {
+		route, _ := resp.Request.Context().Value(routeContextKey).(*Route)
+		if route != nil && route.Grpc != nil {
+			var service string
+			if upstream, ok := resp.Request.Context().Value(upstreamContextKey).(*upstream); ok {
+				service = upstream.name
+			}
+			if err := transcodeResponse(resp, route.Grpc, service); err != nil {
+				return err
+			}
+		}
+		var err error
+		if resp.StatusCode >= http.StatusInternalServerError {
+			err = errors.New(resp.Status)
+		}
+		done(resp.Request, err)
+		if upstream, ok := resp.Request.Context().Value(upstreamContextKey).(*upstream); ok && upstream.version != "" {
+			resp.Header.Set(HeaderUpstreamVersion, upstream.version)
+		}
+		if route != nil {
+			route.ResponseHeaders.apply(resp.Header)
+		}
+		return nil
+	}
+
+	// 返回 JSON 错误: 503 没有健康实例, 502 上游失败, 504 上游超时
+	errorHandler := func(w http.ResponseWriter, req *http.Request, err error) {
+		gatewayErr := toGatewayError(req, err)
+		if _, ok := err.(*gatewayError); !ok {
+			logger.Log("ReverseProxy failed", "proxy error", err.Error())
+			done(req, err)
+		}
+		writeError(w, req, gatewayErr)
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultUpstreamTimeout
+	}
+	var roundTripper http.RoundTripper = newProtocolTransport(timeout)
+	if resilience != nil {
+		roundTripper = &resilienceTransport{next: roundTripper, resilience: resilience}
+	}
+
+	return &httputil.ReverseProxy{
+		Director:       director,
+		Transport:      &errorTransport{RoundTripper: roundTripper},
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+		// gRPC 流式调用需要立即发送每条消息
+		FlushInterval: -1,
+	}
+}
+
+// 一致性哈希的键, 路由未指定请求头时使用认证后的用户ID
+func hashKey(req *http.Request, route *Route) string {
+	if route != nil && route.HashHeader != "" {
+		return req.Header.Get(route.HashHeader)
+	}
+	return req.Header.Get(HeaderUserId)
+}
+
+// 反馈转发结果
+func done(req *http.Request, err error) {
+	if upstream, ok := req.Context().Value(upstreamContextKey).(*upstream); ok {
+		loadbalance.Done(upstream.lb, upstream.service, time.Since(upstream.start), err)
+	}
 }
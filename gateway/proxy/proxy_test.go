@@ -0,0 +1,336 @@
+package proxy
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"micro-go/common/discover"
+	"micro-go/common/loadbalance"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 记录查询次数的服务发现客户端
+type countingDiscoveryClient struct {
+	discover.DiscoveryClientV2
+	queries int32
+	lookups int32
+}
+
+func (client *countingDiscoveryClient) LookupServices(ctx context.Context, serviceName string) ([]*discover.ServiceInstance, error) {
+	atomic.AddInt32(&client.lookups, 1)
+	return client.DiscoveryClientV2.DiscoveryServices(ctx, serviceName)
+}
+
+func (client *countingDiscoveryClient) DiscoveryServices(ctx context.Context, serviceName string) ([]*discover.ServiceInstance, error) {
+	atomic.AddInt32(&client.queries, 1)
+	return client.DiscoveryClientV2.DiscoveryServices(ctx, serviceName)
+}
+
+// 记录反馈的负载均衡器
+type recordingLoadBalance struct {
+	loadbalance.RoundRobinLoadBalance
+	mutex  sync.Mutex
+	errors []error
+}
+
+func (lb *recordingLoadBalance) Done(service *api.AgentService, latency time.Duration, err error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.errors = append(lb.errors, err)
+}
+
+func newRoundRobin() loadbalance.LoadBalance {
+	return &loadbalance.RoundRobinLoadBalance{}
+}
+
+func newRandom() loadbalance.LoadBalance {
+	return &loadbalance.RandomLoadBalance{}
+}
+
+// 记录实例更新的负载均衡器
+type updatingLoadBalance struct {
+	loadbalance.RoundRobinLoadBalance
+	updates [][]*api.AgentService
+}
+
+func (lb *updatingLoadBalance) Update(services []*api.AgentService) {
+	lb.updates = append(lb.updates, services)
+}
+
+func registerUpstream(t *testing.T, client discover.DiscoveryClientV2, serviceName, id string, handler http.HandlerFunc) func() {
+	server := httptest.NewServer(handler)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	instancePort, _ := strconv.Atoi(port)
+	if err := client.Register(context.Background(), serviceName, id, "", host, instancePort, nil); err != nil {
+		t.Fatal(err)
+	}
+	return server.Close
+}
+
+func TestReverseProxy(t *testing.T) {
+	static, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer static.Close()
+	client := &countingDiscoveryClient{DiscoveryClientV2: static}
+
+	defer registerUpstream(t, static, "string", "string-1", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	})()
+
+	cache := NewServiceCache(client, log.NewNopLogger())
+	defer cache.Close()
+	lb := &recordingLoadBalance{}
+	gateway := httptest.NewServer(NewReverseProxy(cache, nil, func() loadbalance.LoadBalance { return lb }, nil, 0, log.NewNopLogger()))
+	defer gateway.Close()
+
+	// 去掉服务名后转发
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(gateway.URL + "/string/op/Concat/a/b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "/op/Concat/a/b" {
+			t.Fatalf("expect path without service name, got %s", body)
+		}
+	}
+
+	// 实例缓存后不再每次请求查询注册中心
+	if queries := atomic.LoadInt32(&client.queries); queries > 2 {
+		t.Fatalf("expect cached instances, got %d queries", queries)
+	}
+
+	// 5xx 反馈给负载均衡器
+	resp, err := http.Get(gateway.URL + "/string/fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	lb.mutex.Lock()
+	errs := lb.errors
+	lb.mutex.Unlock()
+	if len(errs) != 6 || errs[0] != nil || errs[5] == nil {
+		t.Fatalf("expect 5 successes and 1 failure, got %v", errs)
+	}
+}
+
+func TestServiceCache(t *testing.T) {
+	static, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer static.Close()
+	client := &countingDiscoveryClient{DiscoveryClientV2: static}
+	cache := NewServiceCache(client, log.NewNopLogger())
+	defer cache.Close()
+
+	// 不存在的服务只一次性查询, 不经过会开启监控的 DiscoveryServices
+	for i := 0; i < 3; i++ {
+		services, err := cache.Services("unknown")
+		if err != nil || len(services) != 0 || len(cache.instancers) != 0 {
+			t.Fatalf("expect no instancer for unknown service, got %v %v", services, err)
+		}
+	}
+	if client.lookups != 3 || client.queries != 0 {
+		t.Fatalf("expect 3 lookups without discovery, got %d lookups %d queries", client.lookups, client.queries)
+	}
+	var services []*api.AgentService
+
+	client.Register(context.Background(), "string", "string-1", "", "127.0.0.1", 10085, nil)
+	if services, _ = cache.Services("string"); len(services) != 1 {
+		t.Fatalf("expect 1 instance, got %d", len(services))
+	}
+	// 使用一次性查询的结果创建监控, 不再重复查询
+	if atomic.LoadInt32(&client.queries) != 0 {
+		t.Fatalf("expect no discovery after lookup, got %d queries", client.queries)
+	}
+
+	// 实例变化后更新缓存
+	client.Register(context.Background(), "string", "string-2", "", "127.0.0.1", 10086, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if services, _ = cache.Services("string"); len(services) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect 2 instances, got %d", len(services))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// 查询指定服务时阻塞的服务发现客户端
+type blockingDiscoveryClient struct {
+	discover.DiscoveryClientV2
+	service string
+	block   chan struct{}
+	lookups int32
+}
+
+func (client *blockingDiscoveryClient) LookupServices(ctx context.Context, serviceName string) ([]*discover.ServiceInstance, error) {
+	if serviceName == client.service {
+		atomic.AddInt32(&client.lookups, 1)
+		<-client.block
+	}
+	return client.DiscoveryServices(ctx, serviceName)
+}
+
+func TestServiceCacheSlowLookup(t *testing.T) {
+	static, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer static.Close()
+	static.Register(context.Background(), "string", "string-1", "", "127.0.0.1", 10085, nil)
+	static.Register(context.Background(), "slow", "slow-1", "", "127.0.0.1", 10086, nil)
+	client := &blockingDiscoveryClient{DiscoveryClientV2: static, service: "slow", block: make(chan struct{})}
+	cache := NewServiceCache(client, log.NewNopLogger())
+	defer cache.Close()
+	if services, _ := cache.Services("string"); len(services) != 1 {
+		t.Fatalf("expect 1 instance, got %d", len(services))
+	}
+
+	// 同一服务的并发请求只查询一次
+	results := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			services, _ := cache.Services("slow")
+			results <- len(services)
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&client.lookups) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expect slow lookup")
+		}
+	}
+
+	// 查询慢的服务不影响已缓存的服务
+	done := make(chan struct{})
+	go func() {
+		cache.Services("string")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cached service blocked by slow lookup")
+	}
+
+	close(client.block)
+	for i := 0; i < 3; i++ {
+		if n := <-results; n != 1 {
+			t.Fatalf("expect 1 slow instance, got %d", n)
+		}
+	}
+	if lookups := atomic.LoadInt32(&client.lookups); lookups != 1 {
+		t.Fatalf("expect 1 lookup, got %d", lookups)
+	}
+}
+
+func TestServiceBalancers(t *testing.T) {
+	balancers := newServiceBalancers(func() loadbalance.LoadBalance {
+		return &updatingLoadBalance{}
+	})
+	stringServices := []*api.AgentService{{ID: "string-1", Address: "127.0.0.1", Port: 10085}}
+	userServices := []*api.AgentService{{ID: "user-1", Address: "127.0.0.1", Port: 10086}}
+
+	// 每个服务使用独立的负载均衡器
+	stringLb := balancers.get("string", stringServices).(*updatingLoadBalance)
+	userLb := balancers.get("user", userServices).(*updatingLoadBalance)
+	if stringLb == userLb {
+		t.Fatal("expect a load balancer for each service")
+	}
+
+	// 实例不变时不更新, 地址变化时更新
+	balancers.get("string", []*api.AgentService{{ID: "string-1", Address: "127.0.0.1", Port: 10085}})
+	balancers.get("string", []*api.AgentService{{ID: "string-1", Address: "127.0.0.2", Port: 10085}})
+	if len(stringLb.updates) != 2 || stringLb.updates[1][0].Address != "127.0.0.2" {
+		t.Fatalf("expect 2 updates, got %v", stringLb.updates)
+	}
+	if len(userLb.updates) != 1 {
+		t.Fatalf("expect user balancer not updated by string instances, got %d updates", len(userLb.updates))
+	}
+}
+
+func TestReverseProxyHashKey(t *testing.T) {
+	routes, err := newRouteTableFromYaml(`
+routes:
+  - name: session
+    match:
+      prefix: /session
+    service: string
+    hashHeader: X-Session-Id
+  - name: string
+    match:
+      prefix: /string
+    service: string
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, id := range []string{"string-1", "string-2", "string-3"} {
+		id := id
+		defer registerUpstream(t, client, "string", id, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(id))
+		})()
+	}
+	cache := NewServiceCache(client, log.NewNopLogger())
+	defer cache.Close()
+	newConsistentHash := func() loadbalance.LoadBalance {
+		return &loadbalance.ConsistentHashLoadBalance{}
+	}
+	gateway := httptest.NewServer(NewReverseProxy(cache, routes, newConsistentHash, nil, 0, log.NewNopLogger()))
+	defer gateway.Close()
+
+	get := func(path, header, value string) string {
+		req, _ := http.NewRequest("GET", gateway.URL+path, nil)
+		req.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// 相同的键固定转发到同一实例
+	cases := []struct{ path, header string }{{"/session/op", "X-Session-Id"}, {"/string/op", HeaderUserId}}
+	for _, c := range cases {
+		selected := map[string]string{}
+		instances := map[string]bool{}
+		for i := 0; i < 30; i++ {
+			key := strconv.Itoa(i % 10)
+			instance := get(c.path, c.header, key)
+			if previous, ok := selected[key]; ok && previous != instance {
+				t.Fatalf("%s: expect key %s to stay on %s, got %s", c.path, key, previous, instance)
+			}
+			selected[key] = instance
+			instances[instance] = true
+		}
+		if len(instances) < 2 {
+			t.Fatalf("%s: expect keys spread over instances, got %v", c.path, instances)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimitBy        = errors.New("rate limit by must be ip, client or user")
+	ErrRateLimitAlgorithm = errors.New("rate limit algorithm must be token-bucket or sliding-window")
+	ErrRateLimitInvalid   = errors.New("rate limit and window must be positive")
+	ErrRateLimited        = errors.New("rate limit exceeded")
+)
+
+// 限流的维度
+const (
+	RateLimitByIP     = "ip"     // 客户端 IP
+	RateLimitByClient = "client" // OAuth 客户端ID, 未认证时使用 IP
+	RateLimitByUser   = "user"   // 用户ID, 未认证时使用 IP
+)
+
+// 限流算法
+const (
+	AlgorithmTokenBucket   = "token-bucket"
+	AlgorithmSlidingWindow = "sliding-window"
+)
+
+// 限流响应头
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderRateLimitReset     = "X-RateLimit-Reset"
+	HeaderRetryAfter         = "Retry-After"
+)
+
+// 限流规则, 每个窗口允许 Limit 个请求
+type RateLimitRule struct {
+	By        string   `json:"by"`        // 限流维度, 默认 ip
+	Algorithm string   `json:"algorithm"` // 限流算法, 默认 token-bucket
+	Limit     int      `json:"limit"`     // 窗口内允许的请求数
+	Window    Duration `json:"window"`    // 窗口时长
+	Burst     int      `json:"burst"`     // 令牌桶容量, 默认为 Limit
+}
+
+func (rule *RateLimitRule) validate() error {
+	if rule.By == "" {
+		rule.By = RateLimitByIP
+	}
+	if rule.Algorithm == "" {
+		rule.Algorithm = AlgorithmTokenBucket
+	}
+	if rule.By != RateLimitByIP && rule.By != RateLimitByClient && rule.By != RateLimitByUser {
+		return ErrRateLimitBy
+	}
+	if rule.Algorithm != AlgorithmTokenBucket && rule.Algorithm != AlgorithmSlidingWindow {
+		return ErrRateLimitAlgorithm
+	}
+	if rule.Limit <= 0 || rule.Window <= 0 || rule.Burst < 0 {
+		return ErrRateLimitInvalid
+	}
+	return nil
+}
+
+// 令牌桶容量
+func (rule *RateLimitRule) capacity() float64 {
+	if rule.Burst > 0 {
+		return float64(rule.Burst)
+	}
+	return float64(rule.Limit)
+}
+
+// 每纳秒生成的令牌数
+func (rule *RateLimitRule) rate() float64 {
+	return float64(rule.Limit) / float64(rule.Window)
+}
+
+// 限流状态的键, 规则变化后使用新的计数
+func (rule *RateLimitRule) key(scope, id string) string {
+	return fmt.Sprintf("%s:%s:%s:%d/%s/%d:%s", scope, rule.By, rule.Algorithm, rule.Limit, time.Duration(rule.Window), rule.Burst, id)
+}
+
+// 限流结果
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // 计数恢复的时间
+	RetryAfter time.Duration // 被拒绝时可以重试的时间
+}
+
+// 令牌桶的结果, tokens 为本次请求后剩余的令牌
+func tokenBucketResult(rule *RateLimitRule, allowed bool, tokens float64) *RateLimitResult {
+	result := &RateLimitResult{
+		Allowed:   allowed,
+		Limit:     rule.Limit,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration(math.Ceil((rule.capacity() - tokens) / rule.rate())),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration(math.Ceil((1 - tokens) / rule.rate()))
+	}
+	return result
+}
+
+// 滑动窗口计数的结果, previous 和 current 为上一个和当前窗口在本次请求前的计数, elapsed 为当前窗口已经过的时间
+func slidingWindowResult(rule *RateLimitRule, allowed bool, previous, current float64, elapsed time.Duration) *RateLimitResult {
+	window := time.Duration(rule.Window)
+	weight := 1 - float64(elapsed)/float64(window)
+	count := previous*weight + current
+	if allowed {
+		count++
+	}
+	limit := float64(rule.Limit)
+	result := &RateLimitResult{
+		Allowed:   allowed,
+		Limit:     rule.Limit,
+		Remaining: int(math.Max(0, math.Floor(limit-count))),
+		Reset:     window - elapsed,
+	}
+	if !allowed {
+		if current+1 > limit || previous == 0 {
+			// 当前窗口已满, 等待下一个窗口
+			result.RetryAfter = window - elapsed
+		} else {
+			// 等待上一个窗口的计数衰减
+			result.RetryAfter = time.Duration((1-(limit-current-1)/previous)*float64(window)) - elapsed
+		}
+	}
+	return result
+}
+
+// 限流器, 记录各个键的请求并判断是否允许本次请求
+type RateLimiter interface {
+	Allow(key string, rule *RateLimitRule) (*RateLimitResult, error)
+}
+
+// 清理过期状态的间隔
+const memoryRateLimitSweepInterval = time.Minute
+
+// 单机内存限流器
+type MemoryRateLimiter struct {
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	windows   map[string]*slidingWindow
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // 令牌桶装满的时间
+}
+
+type slidingWindow struct {
+	window   time.Duration
+	index    int64
+	previous float64
+	current  float64
+}
+
+// 创建内存限流器, 多个网关实例之间不共享计数
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		windows: make(map[string]*slidingWindow),
+		now:     time.Now,
+	}
+}
+
+func (limiter *MemoryRateLimiter) Allow(key string, rule *RateLimitRule) (*RateLimitResult, error) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	now := limiter.now()
+	limiter.sweep(now)
+
+	if rule.Algorithm == AlgorithmSlidingWindow {
+		window := time.Duration(rule.Window)
+		index := now.UnixNano() / int64(window)
+		elapsed := time.Duration(now.UnixNano() % int64(window))
+		state, ok := limiter.windows[key]
+		if !ok {
+			state = &slidingWindow{window: window, index: index}
+			limiter.windows[key] = state
+		}
+		if state.index != index {
+			if state.index == index-1 {
+				state.previous = state.current
+			} else {
+				state.previous = 0
+			}
+			state.current = 0
+			state.index = index
+		}
+		allowed := state.previous*(1-float64(elapsed)/float64(window))+state.current+1 <= float64(rule.Limit)
+		result := slidingWindowResult(rule, allowed, state.previous, state.current, elapsed)
+		if allowed {
+			state.current++
+		}
+		return result, nil
+	}
+
+	state, ok := limiter.buckets[key]
+	if !ok {
+		state = &tokenBucket{tokens: rule.capacity(), last: now}
+		limiter.buckets[key] = state
+	}
+	if elapsed := now.Sub(state.last); elapsed > 0 {
+		state.tokens = math.Min(rule.capacity(), state.tokens+float64(elapsed)*rule.rate())
+		state.last = now
+	}
+	allowed := state.tokens >= 1
+	if allowed {
+		state.tokens--
+	}
+	state.full = now.Add(time.Duration(math.Ceil((rule.capacity() - state.tokens) / rule.rate())))
+	return tokenBucketResult(rule, allowed, state.tokens), nil
+}
+
+// 定期删除已恢复的状态, 避免大量客户端占用内存
+func (limiter *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Before(limiter.nextSweep) {
+		return
+	}
+	limiter.nextSweep = now.Add(memoryRateLimitSweepInterval)
+	// 装满的令牌桶与新建的相同
+	for key, state := range limiter.buckets {
+		if now.After(state.full) {
+			delete(limiter.buckets, key)
+		}
+	}
+	// 上一个窗口之前的计数已不影响结果
+	for key, state := range limiter.windows {
+		if now.UnixNano()/int64(state.window) > state.index+1 {
+			delete(limiter.windows, key)
+		}
+	}
+}
+
+/*
+*
+创建网关限流处理方法, 按路由的限流规则限制请求, 没有匹配的路由时使用路由文件的默认规则
+被拒绝时返回 429 及 Retry-After, 所有响应带有 X-RateLimit-Limit、X-RateLimit-Remaining、X-RateLimit-Reset
+@param routes 路由表
+@param limiter 限流器, 限流器出错时放行请求
+@param next 限流通过后的处理方法, 如反向代理
+*/
+func NewRateLimitHandler(routes *RouteTable, limiter RateLimiter, next http.Handler, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		match, req := matchRoute(routes, req)
+		scope, service, rules := "default", "", match.rateLimits
+		if route := match.route; route != nil {
+			scope, service, rules = route.Service+"/"+route.Name, route.Service, route.RateLimits
+		}
+
+		// 使用剩余请求数最少的结果设置响应头
+		var limited *RateLimitResult
+		for _, rule := range rules {
+			result, err := limiter.Allow(rule.key(scope, rateLimitId(req, rule.By)), rule)
+			if err != nil {
+				logger.Log("RateLimit failed", "allow error", err.Error())
+				continue
+			}
+			if limited == nil || (limited.Allowed && !result.Allowed) ||
+				(limited.Allowed == result.Allowed && result.Remaining < limited.Remaining) {
+				limited = result
+			}
+		}
+		if limited == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		w.Header().Set(HeaderRateLimitLimit, strconv.Itoa(limited.Limit))
+		w.Header().Set(HeaderRateLimitRemaining, strconv.Itoa(limited.Remaining))
+		w.Header().Set(HeaderRateLimitReset, strconv.Itoa(ceilSeconds(limited.Reset)))
+		if !limited.Allowed {
+			// 至少等待 1 秒
+			retryAfter := ceilSeconds(limited.RetryAfter)
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set(HeaderRetryAfter, strconv.Itoa(retryAfter))
+			writeError(w, req, &gatewayError{status: http.StatusTooManyRequests, code: ErrorCodeRateLimited, service: service, err: ErrRateLimited})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// 请求在限流维度上的标识, 客户端和用户未认证时使用 IP
+func rateLimitId(req *http.Request, by string) string {
+	if details := OAuth2Details(req); details != nil {
+		switch {
+		case by == RateLimitByClient && details.Client != nil:
+			return "client:" + details.Client.ClientId
+		case by == RateLimitByUser && details.User != nil:
+			return "user:" + strconv.Itoa(details.User.UserId)
+		}
+	}
+	// 只使用连接地址, X-Forwarded-For 可以被客户端伪造
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// 向上取整的秒数
+func ceilSeconds(duration time.Duration) int {
+	if duration <= 0 {
+		return 0
+	}
+	return int(math.Ceil(duration.Seconds()))
+}
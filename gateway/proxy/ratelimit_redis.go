@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"time"
+)
+
+// 令牌桶脚本, 返回是否允许及剩余令牌
+const tokenBucketScript = `
+	local key = KEYS[1]
+	local rate = tonumber(ARGV[1])
+	local capacity = tonumber(ARGV[2])
+	local now = tonumber(ARGV[3])
+	local ttl = tonumber(ARGV[4])
+	local state = redis.call('HMGET', key, 'tokens', 'ts')
+	local tokens = tonumber(state[1])
+	local ts = tonumber(state[2])
+	if tokens == nil or ts == nil then
+		tokens = capacity
+		ts = now
+	end
+	-- 按经过的时间补充令牌
+	if now > ts then
+		tokens = math.min(capacity, tokens + (now - ts) * rate)
+		ts = now
+	end
+	local allowed = 0
+	if tokens >= 1 then
+		tokens = tokens - 1
+		allowed = 1
+	end
+	redis.call('HMSET', key, 'tokens', tostring(tokens), 'ts', ts)
+	redis.call('PEXPIRE', key, ttl)
+	return {allowed, tostring(tokens)}
+`
+
+// 滑动窗口计数脚本, 返回是否允许及上一个和当前窗口在本次请求前的计数
+const slidingWindowScript = `
+	local current_key = KEYS[1]
+	local previous_key = KEYS[2]
+	local limit = tonumber(ARGV[1])
+	local weight = tonumber(ARGV[2])
+	local ttl = tonumber(ARGV[3])
+	local previous = tonumber(redis.call('GET', previous_key) or '0')
+	local current = tonumber(redis.call('GET', current_key) or '0')
+	if previous * weight + current + 1 > limit then
+		return {0, previous, current}
+	end
+	redis.call('INCR', current_key)
+	redis.call('PEXPIRE', current_key, ttl)
+	return {1, previous, current}
+`
+
+// 默认的限流键前缀
+const DefaultRedisRateLimitPrefix = "gateway:ratelimit:"
+
+// 基于 Redis 的分布式限流器, 多个网关实例共享计数
+// 使用 Lua 脚本保证判断和计数的原子性, 时间以网关时钟为准
+type RedisRateLimiter struct {
+	pool          *redis.Pool
+	prefix        string
+	tokenBucket   *redis.Script
+	slidingWindow *redis.Script
+	now           func() time.Time
+}
+
+/*
+*
+创建 Redis 限流器
+@param pool redis 连接池
+@param prefix 键前缀, 为空时使用 DefaultRedisRateLimitPrefix
+*/
+func NewRedisRateLimiter(pool *redis.Pool, prefix string) *RedisRateLimiter {
+	if prefix == "" {
+		prefix = DefaultRedisRateLimitPrefix
+	}
+	return &RedisRateLimiter{
+		pool:          pool,
+		prefix:        prefix,
+		tokenBucket:   redis.NewScript(1, tokenBucketScript),
+		slidingWindow: redis.NewScript(2, slidingWindowScript),
+		now:           time.Now,
+	}
+}
+
+func (limiter *RedisRateLimiter) Allow(key string, rule *RateLimitRule) (*RateLimitResult, error) {
+	conn := limiter.pool.Get()
+	defer conn.Close()
+	now := limiter.now()
+	window := time.Duration(rule.Window)
+
+	if rule.Algorithm == AlgorithmSlidingWindow {
+		index := now.UnixNano() / int64(window)
+		elapsed := time.Duration(now.UnixNano() % int64(window))
+		weight := 1 - float64(elapsed)/float64(window)
+		values, err := redis.Values(limiter.slidingWindow.Do(conn,
+			limiter.prefix+key+":"+strconv.FormatInt(index, 10),
+			limiter.prefix+key+":"+strconv.FormatInt(index-1, 10),
+			rule.Limit, strconv.FormatFloat(weight, 'f', -1, 64), int64(2*window/time.Millisecond)))
+		if err != nil {
+			return nil, err
+		}
+		var allowed, previous, current int
+		if _, err = redis.Scan(values, &allowed, &previous, &current); err != nil {
+			return nil, err
+		}
+		return slidingWindowResult(rule, allowed == 1, float64(previous), float64(current), elapsed), nil
+	}
+
+	// 令牌桶在装满所需的时间后过期
+	ttl := time.Duration(rule.capacity()/rule.rate()) + time.Second
+	values, err := redis.Values(limiter.tokenBucket.Do(conn, limiter.prefix+key,
+		strconv.FormatFloat(rule.rate()*float64(time.Millisecond), 'f', -1, 64), rule.capacity(),
+		now.UnixNano()/int64(time.Millisecond), int64(ttl/time.Millisecond)))
+	if err != nil {
+		return nil, err
+	}
+	var allowed int
+	var tokens float64
+	if _, err = redis.Scan(values, &allowed, &tokens); err != nil {
+		return nil, err
+	}
+	return tokenBucketResult(rule, allowed == 1, tokens), nil
+}
+
+/*
+*
+创建 redis 连接池
+@param address redis 地址 host:port
+@param password 密码, 为空时不认证
+@param db 数据库编号
+*/
+func NewRedisPool(address, password string, db int) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     100,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			conn, err := redis.Dial("tcp", address, redis.DialPassword(password), redis.DialDatabase(db),
+				redis.DialConnectTimeout(time.Second), redis.DialReadTimeout(time.Second), redis.DialWriteTimeout(time.Second))
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		},
+	}
+}
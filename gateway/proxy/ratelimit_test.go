@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"micro-go/security/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func expectRateLimit(t *testing.T, limiter RateLimiter, key string, rule *RateLimitRule, allowed bool, remaining int) *RateLimitResult {
+	result, err := limiter.Allow(key, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed != allowed || result.Remaining != remaining || result.Limit != rule.Limit {
+		t.Fatalf("%s: expect allowed %v remaining %d, got %+v", rule.Algorithm, allowed, remaining, result)
+	}
+	return result
+}
+
+func newRateLimitRule(algorithm string, limit int, window time.Duration, burst int) *RateLimitRule {
+	rule := &RateLimitRule{Algorithm: algorithm, Limit: limit, Window: Duration(window), Burst: burst}
+	if err := rule.validate(); err != nil {
+		panic(err)
+	}
+	return rule
+}
+
+func TestMemoryRateLimiterTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewMemoryRateLimiter()
+	limiter.now = func() time.Time { return now }
+	testTokenBucket(t, limiter, func(d time.Duration) { now = now.Add(d) })
+
+	// 装满的令牌桶被清理
+	now = now.Add(2 * memoryRateLimitSweepInterval)
+	limiter.Allow("other", newRateLimitRule(AlgorithmTokenBucket, 1, time.Second, 0))
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("expect idle buckets removed, got %d", len(limiter.buckets))
+	}
+}
+
+func testTokenBucket(t *testing.T, limiter RateLimiter, sleep func(time.Duration)) {
+	// 每秒 2 个请求, 最多突发 4 个
+	rule := newRateLimitRule(AlgorithmTokenBucket, 2, time.Second, 4)
+	for i := 3; i >= 0; i-- {
+		expectRateLimit(t, limiter, "bucket", rule, true, i)
+	}
+	result := expectRateLimit(t, limiter, "bucket", rule, false, 0)
+	if result.RetryAfter <= 0 || result.RetryAfter > 500*time.Millisecond || result.Reset != 2*time.Second {
+		t.Fatalf("unexpected retry after %v reset %v", result.RetryAfter, result.Reset)
+	}
+	// 其他键不受影响
+	expectRateLimit(t, limiter, "other-bucket", rule, true, 3)
+
+	sleep(500 * time.Millisecond)
+	expectRateLimit(t, limiter, "bucket", rule, true, 0)
+	expectRateLimit(t, limiter, "bucket", rule, false, 0)
+	sleep(time.Second)
+	expectRateLimit(t, limiter, "bucket", rule, true, 1)
+}
+
+func TestMemoryRateLimiterSlidingWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewMemoryRateLimiter()
+	limiter.now = func() time.Time { return now }
+	testSlidingWindow(t, limiter, func(d time.Duration) { now = now.Add(d) })
+}
+
+func testSlidingWindow(t *testing.T, limiter RateLimiter, sleep func(time.Duration)) {
+	// 每秒 4 个请求
+	rule := newRateLimitRule(AlgorithmSlidingWindow, 4, time.Second, 0)
+	for i := 3; i >= 0; i-- {
+		expectRateLimit(t, limiter, "window", rule, true, i)
+	}
+	result := expectRateLimit(t, limiter, "window", rule, false, 0)
+	if result.RetryAfter != time.Second || result.Reset != time.Second {
+		t.Fatalf("unexpected retry after %v reset %v", result.RetryAfter, result.Reset)
+	}
+
+	// 下一个窗口的前半段, 上一个窗口按 50% 计入
+	sleep(1500 * time.Millisecond)
+	expectRateLimit(t, limiter, "window", rule, true, 1)
+	expectRateLimit(t, limiter, "window", rule, true, 0)
+	result = expectRateLimit(t, limiter, "window", rule, false, 0)
+	if result.RetryAfter != 250*time.Millisecond {
+		t.Fatalf("expect retry after 250ms, got %v", result.RetryAfter)
+	}
+	sleep(250 * time.Millisecond)
+	expectRateLimit(t, limiter, "window", rule, true, 0)
+
+	// 超过两个窗口后重新计数
+	sleep(2 * time.Second)
+	expectRateLimit(t, limiter, "window", rule, true, 3)
+}
+
+// 需要 Redis, 设置 REDIS_ADDRESS 后运行
+func TestRedisRateLimiter(t *testing.T) {
+	address := os.Getenv("REDIS_ADDRESS")
+	if address == "" {
+		t.Skip("REDIS_ADDRESS is not set")
+	}
+	pool := NewRedisPool(address, os.Getenv("REDIS_PASSWORD"), 0)
+	defer pool.Close()
+
+	now := time.Unix(1000, 0)
+	prefix := "gateway:ratelimit:test:" + strconv.FormatInt(time.Now().UnixNano(), 10) + ":"
+	limiter := NewRedisRateLimiter(pool, prefix)
+	limiter.now = func() time.Time { return now }
+	testTokenBucket(t, limiter, func(d time.Duration) { now = now.Add(d) })
+	testSlidingWindow(t, limiter, func(d time.Duration) { now = now.Add(d) })
+}
+
+const rateLimitRoutesYaml = `
+routes:
+  - name: string
+    match:
+      prefix: /string
+    service: string
+    rateLimits:
+      - {by: user, limit: 1, window: 1m}
+      - {by: ip, limit: 3, window: 1m}
+rateLimits:
+  - {by: ip, algorithm: sliding-window, limit: 1, window: 1m}
+`
+
+func TestRateLimitHandler(t *testing.T) {
+	routes, err := newRouteTableFromYaml(rateLimitRoutesYaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := NewRateLimitHandler(routes, NewMemoryRateLimiter(), next, log.NewNopLogger())
+
+	serve := func(path string, user int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if user > 0 {
+			details := &model.OAuth2Details{User: &model.UserDetails{UserId: user}}
+			req = req.WithContext(context.WithValue(req.Context(), authContextKey, details))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, remaining string) {
+		if w.Code != status || w.Header().Get(HeaderRateLimitRemaining) != remaining || w.Header().Get(HeaderRateLimitLimit) == "" {
+			t.Fatalf("expect status %d remaining %s, got %d %v", status, remaining, w.Code, w.Header())
+		}
+		if status == http.StatusTooManyRequests && w.Header().Get(HeaderRetryAfter) == "" {
+			t.Fatalf("expect Retry-After header, got %v", w.Header())
+		}
+	}
+
+	// 每个用户 1 个请求, 同一 IP 3 个请求
+	expect(serve("/string/a", 1), http.StatusOK, "0")
+	expect(serve("/string/a", 1), http.StatusTooManyRequests, "0")
+	expect(serve("/string/a", 2), http.StatusOK, "0")
+	expect(serve("/string/a", 3), http.StatusTooManyRequests, "0")
+
+	// 没有匹配的路由时使用默认规则
+	expect(serve("/other/a", 0), http.StatusOK, "0")
+	w := serve("/other/a", 0)
+	expect(w, http.StatusTooManyRequests, "0")
+	if retryAfter, _ := strconv.Atoi(w.Header().Get(HeaderRetryAfter)); retryAfter < 1 || retryAfter > 60 {
+		t.Fatalf("unexpected Retry-After %s", w.Header().Get(HeaderRetryAfter))
+	}
+}
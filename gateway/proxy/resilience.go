@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/hashicorp/consul/api"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"math"
+	"micro-go/common/loadbalance"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// 默认的重试配置
+const (
+	DefaultMaxRetries              = 2
+	DefaultRetryBudgetRatio        = 0.2
+	DefaultRetryBudgetMinPerSecond = 3
+)
+
+// 重试预算最多累积的秒数
+const retryBudgetSeconds = 10
+
+// 上游的熔断和重试配置
+type ResilienceConfig struct {
+	MaxRetries              int                   // 幂等请求失败后的最大重试次数, 默认 2, 小于 0 时不重试
+	RetryBudgetRatio        float64               // 重试数占请求数的比例上限, 默认 0.2
+	RetryBudgetMinPerSecond int                   // 请求较少时每秒至少允许的重试数, 默认 3
+	Breaker                 hystrix.CommandConfig // 各服务的熔断配置, 未设置的项使用 hystrix 默认值
+}
+
+func (config *ResilienceConfig) withDefaults() {
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultMaxRetries
+	}
+	if config.RetryBudgetRatio <= 0 {
+		config.RetryBudgetRatio = DefaultRetryBudgetRatio
+	}
+	if config.RetryBudgetMinPerSecond <= 0 {
+		config.RetryBudgetMinPerSecond = DefaultRetryBudgetMinPerSecond
+	}
+}
+
+// 熔断和重试的监控指标, 标签 service
+type ResilienceMetrics struct {
+	CircuitOpen          metrics.Gauge   // 熔断器是否打开
+	ShortCircuits        metrics.Counter // 熔断器打开时拒绝的请求数
+	Retries              metrics.Counter // 重试次数
+	RetryBudgetExhausted metrics.Counter // 超出重试预算放弃重试的次数
+}
+
+// 创建注册到 Prometheus 的监控指标
+func NewPrometheusResilienceMetrics(namespace, subsystem string) *ResilienceMetrics {
+	labels := []string{"service"}
+	return &ResilienceMetrics{
+		CircuitOpen: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "circuit_open",
+			Help:      "Whether the circuit breaker of the service is open.",
+		}, labels),
+		ShortCircuits: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "short_circuits_total",
+			Help:      "Total number of requests rejected by the open circuit breaker.",
+		}, labels),
+		Retries: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "retries_total",
+			Help:      "Total number of retries to another instance.",
+		}, labels),
+		RetryBudgetExhausted: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "retry_budget_exhausted_total",
+			Help:      "Total number of retries skipped because the retry budget is exhausted.",
+		}, labels),
+	}
+}
+
+// 各服务的熔断器和重试预算
+// 熔断器使用 hystrix, 状态可以通过 hystrix.NewStreamHandler 以 /hystrix/stream 查看
+type Resilience struct {
+	config  ResilienceConfig
+	metrics *ResilienceMetrics
+
+	mutex   sync.Mutex
+	budgets map[string]*retryBudget
+}
+
+/*
+*
+创建上游的熔断和重试
+@param config 熔断和重试配置, 为空时使用默认配置
+@param metrics 监控指标, 为空时不上报
+*/
+func NewResilience(config *ResilienceConfig, metrics *ResilienceMetrics) *Resilience {
+	resilience := &Resilience{
+		metrics: metrics,
+		budgets: make(map[string]*retryBudget),
+	}
+	if config != nil {
+		resilience.config = *config
+	}
+	resilience.config.withDefaults()
+	return resilience
+}
+
+// 服务的熔断器和重试预算, 首次使用时创建
+func (resilience *Resilience) service(serviceName string) (*hystrix.CircuitBreaker, *retryBudget, error) {
+	resilience.mutex.Lock()
+	budget, ok := resilience.budgets[serviceName]
+	if !ok {
+		hystrix.ConfigureCommand(serviceName, resilience.config.Breaker)
+		budget = newRetryBudget(resilience.config.RetryBudgetRatio, resilience.config.RetryBudgetMinPerSecond)
+		resilience.budgets[serviceName] = budget
+	}
+	resilience.mutex.Unlock()
+	circuit, _, err := hystrix.GetCircuit(serviceName)
+	return circuit, budget, err
+}
+
+// 路由可以覆盖最大重试次数
+func (resilience *Resilience) maxRetries(req *http.Request) int {
+	maxRetries := resilience.config.MaxRetries
+	if route, ok := req.Context().Value(routeContextKey).(*Route); ok && route.Retries != nil {
+		maxRetries = *route.Retries
+	}
+	if maxRetries < 0 || !retryable(req) {
+		return 0
+	}
+	return maxRetries
+}
+
+func (resilience *Resilience) setCircuitOpen(serviceName string, circuit *hystrix.CircuitBreaker) {
+	if resilience.metrics == nil {
+		return
+	}
+	var open float64
+	if circuit.IsOpen() {
+		open = 1
+	}
+	resilience.metrics.CircuitOpen.With("service", serviceName).Set(open)
+}
+
+// 只重试没有请求体的幂等请求, 请求体已被读取无法重发
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+// 连接失败、超时及 502、503、504 可以重试其他实例
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// 为服务加上熔断和重试的 Transport
+// 熔断器打开时直接返回 503, 失败的幂等请求在重试预算内转发到其他实例
+type resilienceTransport struct {
+	next       http.RoundTripper
+	resilience *Resilience
+}
+
+func (transport *resilienceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upstream, ok := req.Context().Value(upstreamContextKey).(*upstream)
+	if !ok {
+		return transport.next.RoundTrip(req)
+	}
+	resilience := transport.resilience
+	circuit, budget, err := resilience.service(upstream.name)
+	if err != nil {
+		return nil, err
+	}
+	budget.deposit()
+	maxRetries := resilience.maxRetries(req)
+	tried := []*api.AgentService{upstream.service}
+
+	if !circuit.AllowRequest() {
+		if resilience.metrics != nil {
+			resilience.metrics.ShortCircuits.With("service", upstream.name).Add(1)
+		}
+		resilience.setCircuitOpen(upstream.name, circuit)
+		return nil, &gatewayError{status: http.StatusServiceUnavailable, code: ErrorCodeCircuitOpen, service: upstream.name, err: ErrCircuitOpen}
+	}
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := transport.next.RoundTrip(req)
+		failure := err
+		if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+			failure = errors.New(resp.Status)
+		}
+		reportEvent(circuit, start, err, failure)
+		resilience.setCircuitOpen(upstream.name, circuit)
+
+		if failure == nil || attempt >= maxRetries || req.Context().Err() != nil || !shouldRetry(resp, err) {
+			return resp, err
+		}
+		// 熔断器已打开或没有其他实例时返回本次结果
+		next := selectAnother(upstream.lb, upstream.services, tried)
+		if next == nil || !circuit.AllowRequest() {
+			return resp, err
+		}
+		if !budget.withdraw() {
+			if resilience.metrics != nil {
+				resilience.metrics.RetryBudgetExhausted.With("service", upstream.name).Add(1)
+			}
+			return resp, err
+		}
+
+		// 放弃本次响应, 反馈失败后转发到其他实例
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		loadbalance.Done(upstream.lb, upstream.service, time.Since(upstream.start), failure)
+		if resilience.metrics != nil {
+			resilience.metrics.Retries.With("service", upstream.name).Add(1)
+		}
+
+		tried = append(tried, next)
+		upstream.service = next
+		upstream.start = time.Now()
+		retryURL := *req.URL
+		retryURL.Host = upstreamHost(next, upstream.protocol)
+		retryReq := *req
+		retryReq.URL = &retryURL
+		req = &retryReq
+	}
+}
+
+// 从未尝试过的实例中选择
+func selectAnother(lb loadbalance.LoadBalance, services, tried []*api.AgentService) *api.AgentService {
+	candidates := make([]*api.AgentService, 0, len(services))
+	for _, service := range services {
+		if !containsService(tried, service) {
+			candidates = append(candidates, service)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	next, err := lb.SelectService(candidates)
+	if err != nil {
+		return nil
+	}
+	return next
+}
+
+func containsService(services []*api.AgentService, service *api.AgentService) bool {
+	for _, s := range services {
+		if s.ID == service.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// 上报调用结果, 超时与其他失败分开统计
+func reportEvent(circuit *hystrix.CircuitBreaker, start time.Time, err, failure error) {
+	event := "success"
+	if failure != nil {
+		event = "failure"
+		if isTimeout(err) {
+			event = "timeout"
+		}
+	}
+	circuit.ReportEvent([]string{event}, start, time.Since(start))
+}
+
+// 重试预算, 每个请求增加 ratio 次重试, 每秒另外增加 minPerSecond 次
+// 避免上游整体故障时重试放大流量
+type retryBudget struct {
+	ratio        float64
+	minPerSecond float64
+	max          float64
+
+	mutex   sync.Mutex
+	balance float64
+	last    time.Time
+	now     func() time.Time
+}
+
+func newRetryBudget(ratio float64, minPerSecond int) *retryBudget {
+	max := float64(minPerSecond * retryBudgetSeconds)
+	return &retryBudget{
+		ratio:        ratio,
+		minPerSecond: float64(minPerSecond),
+		max:          max,
+		balance:      max,
+		last:         time.Now(),
+		now:          time.Now,
+	}
+}
+
+func (budget *retryBudget) refill() {
+	now := budget.now()
+	if elapsed := now.Sub(budget.last); elapsed > 0 {
+		budget.balance = math.Min(budget.max, budget.balance+elapsed.Seconds()*budget.minPerSecond)
+		budget.last = now
+	}
+}
+
+// 每个请求增加重试额度
+func (budget *retryBudget) deposit() {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	budget.refill()
+	budget.balance = math.Min(budget.max, budget.balance+budget.ratio)
+}
+
+// 使用一次重试额度, 额度不足时返回 false
+func (budget *retryBudget) withdraw() bool {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	budget.refill()
+	if budget.balance < 1 {
+		return false
+	}
+	budget.balance--
+	return true
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/go-kit/kit/log"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"micro-go/common/discover"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testResilienceMetrics struct {
+	circuitOpen *stdprometheus.GaugeVec
+	retries     *stdprometheus.CounterVec
+}
+
+func newTestResilience(config *ResilienceConfig) (*Resilience, *testResilienceMetrics) {
+	vecs := &testResilienceMetrics{
+		circuitOpen: stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{Name: "circuit_open"}, []string{"service"}),
+		retries:     stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "retries"}, []string{"service"}),
+	}
+	resilience := NewResilience(config, &ResilienceMetrics{
+		CircuitOpen:          kitprometheus.NewGauge(vecs.circuitOpen),
+		ShortCircuits:        kitprometheus.NewCounter(stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "short_circuits"}, []string{"service"})),
+		Retries:              kitprometheus.NewCounter(vecs.retries),
+		RetryBudgetExhausted: kitprometheus.NewCounter(stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "exhausted"}, []string{"service"})),
+	})
+	return resilience, vecs
+}
+
+func newResilienceGateway(t *testing.T, resilience *Resilience, register func(client discover.DiscoveryClientV2) func()) (string, func()) {
+	client, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeUpstreams := register(client)
+	cache := NewServiceCache(client, log.NewNopLogger())
+	gateway := httptest.NewServer(NewReverseProxy(cache, nil, newRoundRobin, resilience, 0, log.NewNopLogger()))
+	return gateway.URL, func() {
+		gateway.Close()
+		cache.Close()
+		closeUpstreams()
+		client.Close()
+	}
+}
+
+func TestResilienceRetry(t *testing.T) {
+	defer hystrix.Flush()
+	resilience, vecs := newTestResilience(&ResilienceConfig{Breaker: hystrix.CommandConfig{RequestVolumeThreshold: 1000}})
+	gateway, stop := newResilienceGateway(t, resilience, func(client discover.DiscoveryClientV2) func() {
+		closeFailing := registerUpstream(t, client, "retry", "retry-1", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+		closeHealthy := registerUpstream(t, client, "retry", "retry-2", func(w http.ResponseWriter, r *http.Request) {})
+		return func() {
+			closeFailing()
+			closeHealthy()
+		}
+	})
+	defer stop()
+
+	// 幂等请求重试到其他实例
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(gateway + "/retry/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expect retried GET to succeed, got %d", resp.StatusCode)
+		}
+	}
+	if retries := testutil.ToFloat64(vecs.retries.WithLabelValues("retry")); retries == 0 || retries > 4 {
+		t.Fatalf("expect one retry per failed request, got %v", retries)
+	}
+
+	// 非幂等请求不重试
+	failures := 0
+	for i := 0; i < 4; i++ {
+		resp, err := http.Post(gateway+"/retry/health", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			failures++
+		}
+	}
+	if failures == 0 {
+		t.Fatal("expect POST failures without retry")
+	}
+}
+
+func TestResilienceCircuitBreaker(t *testing.T) {
+	defer hystrix.Flush()
+	resilience, vecs := newTestResilience(&ResilienceConfig{
+		MaxRetries: -1,
+		Breaker:    hystrix.CommandConfig{RequestVolumeThreshold: 3, ErrorPercentThreshold: 50, SleepWindow: 60000},
+	})
+	gateway, stop := newResilienceGateway(t, resilience, func(client discover.DiscoveryClientV2) func() {
+		return registerUpstream(t, client, "breaker", "breaker-1", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+	})
+	defer stop()
+
+	// 熔断器的统计是异步的, 连续失败后熔断器打开
+	for i := 0; ; i++ {
+		resp, err := http.Get(gateway + "/breaker/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := ErrorResponse{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			if body.Code != ErrorCodeCircuitOpen || body.Service != "breaker" {
+				t.Fatalf("unexpected circuit open response %+v", body)
+			}
+			break
+		}
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("expect upstream failure, got %d", resp.StatusCode)
+		}
+		if i == 100 {
+			t.Fatal("circuit not opened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if open := testutil.ToFloat64(vecs.circuitOpen.WithLabelValues("breaker")); open != 1 {
+		t.Fatalf("expect circuit open gauge 1, got %v", open)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(1000, 0)
+	budget := newRetryBudget(0.5, 1)
+	budget.now = func() time.Time { return now }
+	budget.last = now
+
+	// 最多累积 10 秒的保底重试
+	for i := 0; i < retryBudgetSeconds; i++ {
+		if !budget.withdraw() {
+			t.Fatalf("expect retry %d allowed", i)
+		}
+	}
+	if budget.withdraw() {
+		t.Fatal("expect budget exhausted")
+	}
+
+	// 每个请求增加 0.5 次重试
+	budget.deposit()
+	if budget.withdraw() {
+		t.Fatal("expect budget exhausted after one request")
+	}
+	budget.deposit()
+	if !budget.withdraw() {
+		t.Fatal("expect retry allowed after two requests")
+	}
+
+	// 每秒增加保底重试
+	now = now.Add(time.Second)
+	if !budget.withdraw() || budget.withdraw() {
+		t.Fatal("expect one retry per second")
+	}
+}
@@ -0,0 +1,383 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"micro-go/common/filewatch"
+	"net"
+	"net/http"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRouteServiceMissing = errors.New("route service is missing")
+	ErrRoutePrefixInvalid  = errors.New("route prefix must start with /")
+	ErrRouteProtocol       = errors.New("route protocol must be http or h2c")
+)
+
+// 路由文件结构, 支持 YAML 与 JSON, 按顺序匹配第一条路由
+//
+//	routes:
+//	  - name: string-v2
+//	    match:
+//	      prefix: /api/string
+//	      host: api.example.com
+//	      methods: [POST]
+//	      headers:
+//	        X-Version: v2
+//	    service: string
+//	    rewrite: /op
+//	    timeout: 3s
+//	    hashHeader: X-Session-Id
+//	    split:
+//	      header: X-Version
+//	      versions:
+//	        - {name: v1, weight: 95, tags: [v1]}
+//	        - {name: v2, weight: 5, tags: [v2]}
+//	    requestHeaders:
+//	      add:
+//	        X-Gateway: micro-go
+//	      remove: [Cookie]
+//	    auth:
+//	      authorities: [Admin]
+//	    rateLimits:
+//	      - {by: user, algorithm: sliding-window, limit: 100, window: 1m}
+//	  - name: string-grpc
+//	    match:
+//	      prefix: /pd.StringService
+//	    service: string-grpc
+//	    protocol: h2c
+//	  - name: string-concat
+//	    match:
+//	      prefix: /string/concat
+//	      methods: [POST]
+//	    service: string-grpc
+//	    grpc:
+//	      method: pd.StringService/Concat
+//	      errorField: err
+//	rateLimits:
+//	  - {by: ip, limit: 20, window: 1s, burst: 40}
+//	fallback:
+//	  auth:
+//	    authorities: [Admin]
+type routeFile struct {
+	Routes     []*Route         `json:"routes"`
+	RateLimits []*RateLimitRule `json:"rateLimits"` // 没有匹配的路由时使用的限流规则
+	Fallback   *FallbackPolicy  `json:"fallback"`   // 没有匹配的路由时的默认规则, 为空时按服务名转发且不校验令牌
+}
+
+// 没有匹配的路由时按 /{serviceName}/{path} 转发的默认规则
+type FallbackPolicy struct {
+	Disabled bool        `json:"disabled"` // 禁用默认规则, 没有匹配的路由时返回 404
+	Auth     *AuthPolicy `json:"auth"`     // 默认规则的认证策略, 为空时不校验令牌
+}
+
+// 路由规则
+type Route struct {
+	Name            string           `json:"name"`
+	Match           RouteMatch       `json:"match"`
+	Service         string           `json:"service"`         // 转发的服务名
+	Rewrite         *string          `json:"rewrite"`         // 替换匹配的路径前缀, 为空时保留原路径
+	Timeout         Duration         `json:"timeout"`         // 转发超时, 为 0 时使用网关的上游超时
+	RequestHeaders  HeaderRewrite    `json:"requestHeaders"`  // 转发前修改请求头
+	ResponseHeaders HeaderRewrite    `json:"responseHeaders"` // 返回前修改响应头
+	Auth            *AuthPolicy      `json:"auth"`            // 认证策略, 为空时不校验令牌
+	RateLimits      []*RateLimitRule `json:"rateLimits"`      // 限流规则, 需全部通过
+	Retries         *int             `json:"retries"`         // 幂等请求的最大重试次数, 为空时使用网关的配置
+	Protocol        string           `json:"protocol"`        // 上游协议 http 或 h2c, 为空时 gRPC 请求使用 h2c
+	Grpc            *GrpcTranscode   `json:"grpc"`            // 将 JSON 请求转为 gRPC 调用, 为空时不转码
+	Split           *TrafficSplit    `json:"split"`           // 按权重分配到不同版本的实例, 为空时不区分版本
+	HashHeader      string           `json:"hashHeader"`      // 一致性哈希使用的请求头, 为空时使用认证后的 X-User-Id
+}
+
+// 路由匹配条件, 未设置的条件不参与匹配
+type RouteMatch struct {
+	Prefix  string            `json:"prefix"`  // 路径前缀, 按路径段匹配, 默认 /
+	Host    string            `json:"host"`    // 域名, 支持 *.example.com
+	Methods []string          `json:"methods"` // 请求方法, 满足其一即可
+	Headers map[string]string `json:"headers"` // 需全部匹配的请求头
+}
+
+// 添加或删除的头
+type HeaderRewrite struct {
+	Add    map[string]string `json:"add"`
+	Remove []string          `json:"remove"`
+}
+
+// 配置文件中的时长, 如 3s、500ms
+type Duration time.Duration
+
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*duration = Duration(parsed)
+	return nil
+}
+
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+// 判断请求是否满足路由的匹配条件
+func (route *Route) Matches(req *http.Request) bool {
+	if !matchPrefix(req.URL.Path, route.Match.Prefix) {
+		return false
+	}
+	if route.Match.Host != "" && !matchHost(req.Host, route.Match.Host) {
+		return false
+	}
+	if len(route.Match.Methods) > 0 {
+		matched := false
+		for _, method := range route.Match.Methods {
+			if strings.EqualFold(method, req.Method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for key, value := range route.Match.Headers {
+		if req.Header.Get(key) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// 转发的路径, 将匹配的前缀替换为 rewrite
+func (route *Route) rewritePath(path string) string {
+	if route.Rewrite == nil {
+		return path
+	}
+	rest := strings.TrimPrefix(path, strings.TrimSuffix(route.Match.Prefix, "/"))
+	rewritten := strings.TrimSuffix(*route.Rewrite, "/") + rest
+	if !strings.HasPrefix(rewritten, "/") {
+		rewritten = "/" + rewritten
+	}
+	return rewritten
+}
+
+func (rewrite *HeaderRewrite) apply(header http.Header) {
+	for _, key := range rewrite.Remove {
+		header.Del(key)
+	}
+	for key, value := range rewrite.Add {
+		header.Set(key, value)
+	}
+}
+
+func (route *Route) validate() error {
+	if route.Service == "" {
+		return ErrRouteServiceMissing
+	}
+	if route.Match.Prefix == "" {
+		route.Match.Prefix = "/"
+	}
+	if !strings.HasPrefix(route.Match.Prefix, "/") {
+		return ErrRoutePrefixInvalid
+	}
+	if route.Protocol != "" && route.Protocol != ProtocolHTTP && route.Protocol != ProtocolH2C {
+		return ErrRouteProtocol
+	}
+	if route.Grpc != nil {
+		if err := route.Grpc.validate(); err != nil {
+			return err
+		}
+	}
+	if route.Split != nil {
+		if err := route.Split.validate(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range route.RateLimits {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按路径段匹配前缀, /api/string 匹配 /api/string/op 但不匹配 /api/stringx
+func matchPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// 匹配域名, 忽略端口
+func matchHost(host, pattern string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return strings.EqualFold(host, pattern)
+}
+
+// 网关的路由表, 修改路由文件后自动重新加载
+// 没有匹配的路由时使用 /{serviceName}/{path} 的默认规则, 默认规则可以单独设置认证策略或禁用,
+// 避免绕过路由的认证直接访问服务
+type RouteTable struct {
+	File string
+
+	mutex      sync.RWMutex
+	routes     []*Route
+	rateLimits []*RateLimitRule
+	fallback   *FallbackPolicy
+
+	watcher *filewatch.FileWatcher
+}
+
+// 请求的匹配结果, 取自同一版本的路由表
+type routeMatch struct {
+	route        *Route           // 匹配的路由, 没有匹配时为 nil
+	rateLimits   []*RateLimitRule // 没有匹配的路由时使用的限流规则
+	fallback     bool             // 没有匹配的路由时是否使用默认规则
+	fallbackAuth *AuthPolicy      // 默认规则的认证策略, 禁用默认规则时为 nil
+}
+
+// 请求的认证策略, 没有匹配的路由时使用默认规则的策略
+func (match *routeMatch) auth() *AuthPolicy {
+	if match.route != nil {
+		return match.route.Auth
+	}
+	return match.fallbackAuth
+}
+
+// 请求转发的服务名, 没有匹配的路由时取路径的第一段
+func (match *routeMatch) service(req *http.Request) string {
+	if match.route != nil {
+		return match.route.Service
+	}
+	if pathArray := strings.Split(req.URL.Path, "/"); len(pathArray) > 1 {
+		return pathArray[1]
+	}
+	return ""
+}
+
+// 请求匹配的第一条路由, 没有匹配时返回 nil
+func (table *RouteTable) Match(req *http.Request) *Route {
+	return table.match(req).route
+}
+
+func (table *RouteTable) match(req *http.Request) *routeMatch {
+	if table == nil {
+		return &routeMatch{fallback: true}
+	}
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	match := &routeMatch{rateLimits: table.rateLimits}
+	for _, route := range table.routes {
+		if route.Matches(req) {
+			match.route = route
+			return match
+		}
+	}
+	match.fallback = table.fallback == nil || !table.fallback.Disabled
+	if match.fallback && table.fallback != nil {
+		match.fallbackAuth = table.fallback.Auth
+	}
+	return match
+}
+
+/*
+*
+匹配请求的路由并保存在请求的上下文中, 已匹配过的请求直接返回之前的结果
+最外层的处理方法匹配一次, 认证、限流和转发使用同一结果, 路由表重新加载时不会前后不一致
+@param table 路由表
+@param req 请求
+*/
+func matchRoute(table *RouteTable, req *http.Request) (*routeMatch, *http.Request) {
+	if match, ok := req.Context().Value(matchContextKey).(*routeMatch); ok {
+		return match, req
+	}
+	match := table.match(req)
+	return match, req.WithContext(context.WithValue(req.Context(), matchContextKey, match))
+}
+
+// 没有匹配的路由时使用的限流规则
+func (table *RouteTable) RateLimits() []*RateLimitRule {
+	if table == nil {
+		return nil
+	}
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.rateLimits
+}
+
+// 当前的路由
+func (table *RouteTable) Routes() []*Route {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.routes
+}
+
+// 停止监控路由文件
+func (table *RouteTable) Close() error {
+	if table.watcher == nil {
+		return nil
+	}
+	return table.watcher.Close()
+}
+
+// 解析路由文件并替换当前的路由
+func (table *RouteTable) parse(data []byte) error {
+	file, err := parseRoutes(data)
+	if err != nil {
+		return err
+	}
+
+	table.mutex.Lock()
+	table.routes = file.Routes
+	table.rateLimits = file.RateLimits
+	table.fallback = file.Fallback
+	table.mutex.Unlock()
+	return nil
+}
+
+// 解析并校验路由
+func parseRoutes(data []byte) (*routeFile, error) {
+	file := &routeFile{}
+	if err := yaml.Unmarshal(data, file); err != nil {
+		return nil, err
+	}
+	for _, route := range file.Routes {
+		if err := route.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range file.RateLimits {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// 创建路由表, file 为空时只使用默认规则
+func NewRouteTable(file string) (*RouteTable, error) {
+	table := &RouteTable{File: file}
+	if file == "" {
+		return table, nil
+	}
+
+	// 修改文件后重新加载, 读取失败时保留之前的路由
+	watcher, err := filewatch.NewFileWatcher(file, "gateway routes", table.parse)
+	if err != nil {
+		return nil, err
+	}
+	table.watcher = watcher
+	return table, nil
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"github.com/go-kit/kit/log"
+	"io/ioutil"
+	"micro-go/common/discover"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const routesYaml = `
+routes:
+  - name: string-v2
+    match:
+      prefix: /api/string
+      methods: [GET]
+      headers:
+        X-Version: v2
+    service: string
+    rewrite: /v2
+    requestHeaders:
+      add:
+        X-Gateway: micro-go
+      remove: [X-Internal]
+    responseHeaders:
+      add:
+        X-Route: string-v2
+  - name: string
+    match:
+      prefix: /api/string/
+      host: "*.example.com"
+    service: string
+    rewrite: /
+  - name: slow
+    match:
+      prefix: /api/slow
+    service: slow
+    timeout: 100ms
+`
+
+func newRouteRequest(method, host, path string, header map[string]string) *http.Request {
+	req := httptest.NewRequest(method, "http://"+host+path, nil)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	return req
+}
+
+func TestRouteMatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gateway-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "routes.yaml")
+	if err := ioutil.WriteFile(file, []byte(routesYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := NewRouteTable(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	cases := []struct {
+		req   *http.Request
+		route string
+		path  string
+	}{
+		{newRouteRequest("GET", "api.example.com", "/api/string/op", map[string]string{"X-Version": "v2"}), "string-v2", "/v2/op"},
+		{newRouteRequest("POST", "api.example.com:9090", "/api/string/op", map[string]string{"X-Version": "v2"}), "string", "/op"},
+		{newRouteRequest("GET", "api.example.com", "/api/string", nil), "string", "/"},
+		{newRouteRequest("GET", "localhost", "/api/string/op", nil), "", ""},
+		{newRouteRequest("GET", "api.example.com", "/api/stringx", nil), "", ""},
+		{newRouteRequest("GET", "localhost", "/api/slow/op", nil), "slow", "/api/slow/op"},
+	}
+	for _, c := range cases {
+		route := table.Match(c.req)
+		if route == nil {
+			if c.route != "" {
+				t.Fatalf("%s %s%s: expect route %s, got none", c.req.Method, c.req.Host, c.req.URL.Path, c.route)
+			}
+			continue
+		}
+		if route.Name != c.route {
+			t.Fatalf("%s %s%s: expect route %s, got %s", c.req.Method, c.req.Host, c.req.URL.Path, c.route, route.Name)
+		}
+		if path := route.rewritePath(c.req.URL.Path); path != c.path {
+			t.Fatalf("%s: expect path %s, got %s", route.Name, c.path, path)
+		}
+	}
+
+	// 修改文件后自动重新加载, 格式错误时保留之前的路由
+	if err := ioutil.WriteFile(file, []byte("routes: ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(`{"routes": [{"name": "all", "service": "string"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if routes := table.Routes(); len(routes) == 1 && routes[0].Match.Prefix == "/" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("routes not reloaded, got %d routes", len(table.Routes()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 缺少服务名的路由无法加载
+	if err := ioutil.WriteFile(file, []byte(`routes: [{name: none}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRouteTable(file); err != ErrRouteServiceMissing {
+		t.Fatalf("expect %v, got %v", ErrRouteServiceMissing, err)
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	table, err := newRouteTableFromYaml(routesYaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一请求只匹配一次, 路由表重新加载后仍使用之前的结果
+	match, req := matchRoute(table, newRouteRequest("GET", "api.example.com", "/api/slow/op", nil))
+	if match.route == nil || match.route.Name != "slow" || match.fallback {
+		t.Fatalf("unexpected match %+v", match)
+	}
+	table.mutex.Lock()
+	table.routes = nil
+	table.mutex.Unlock()
+	if again, _ := matchRoute(table, req); again != match {
+		t.Fatalf("expect the first match, got %+v", again)
+	}
+
+	// 没有匹配的路由时使用默认规则
+	if match, _ := matchRoute(table, newRouteRequest("GET", "api.example.com", "/api/slow/op", nil)); match.route != nil || !match.fallback {
+		t.Fatalf("expect fallback without routes, got %+v", match)
+	}
+	if match, _ := matchRoute(nil, newRouteRequest("GET", "api.example.com", "/string/op", nil)); !match.fallback {
+		t.Fatal("expect fallback without route table")
+	}
+
+	// 默认规则的认证策略, 以及禁用默认规则
+	table, err = newRouteTableFromYaml(routesYaml + "fallback: {auth: {authorities: [Admin]}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = newRouteRequest("GET", "api.example.com", "/string/op", nil)
+	if match, _ := matchRoute(table, req); !match.fallback || match.auth() == nil || match.service(req) != "string" {
+		t.Fatalf("expect fallback auth, got %+v", match)
+	}
+	table, err = newRouteTableFromYaml(routesYaml + "fallback: {disabled: true}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match, _ := matchRoute(table, newRouteRequest("GET", "api.example.com", "/string/op", nil)); match.fallback || match.auth() != nil {
+		t.Fatalf("expect fallback disabled, got %+v", match)
+	}
+}
+
+func TestReverseProxyRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gateway-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "routes.yaml")
+	if err := ioutil.WriteFile(file, []byte(routesYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	table, err := NewRouteTable(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+
+	client, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer registerUpstream(t, client, "string", "string-1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Internal") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Header().Set("X-Gateway", r.Header.Get("X-Gateway"))
+	})()
+	block := make(chan struct{})
+	defer registerUpstream(t, client, "slow", "slow-1", func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	})()
+	defer close(block)
+
+	cache := NewServiceCache(client, log.NewNopLogger())
+	defer cache.Close()
+	gateway := httptest.NewServer(NewReverseProxy(cache, table, newRandom, nil, 0, log.NewNopLogger()))
+	defer gateway.Close()
+
+	req, _ := http.NewRequest("GET", gateway.URL+"/api/string/op/Concat/a/b", nil)
+	req.Header.Set("X-Version", "v2")
+	req.Header.Set("X-Internal", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Path") != "/v2/op/Concat/a/b" ||
+		resp.Header.Get("X-Gateway") != "micro-go" || resp.Header.Get("X-Route") != "string-v2" {
+		t.Fatalf("unexpected routed response %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// 没有匹配的路由时按服务名转发
+	resp, err = http.Get(gateway.URL + "/string/op/Concat/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Path") != "/op/Concat/a/b" || resp.Header.Get("X-Route") != "" {
+		t.Fatalf("unexpected fallback response %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// 禁用默认规则后没有匹配的请求返回 404
+	if err := ioutil.WriteFile(file, []byte(routesYaml+"fallback: {disabled: true}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		table.mutex.RLock()
+		disabled := table.fallback != nil && table.fallback.Disabled
+		table.mutex.RUnlock()
+		if disabled {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("routes not reloaded")
+		}
+	}
+	expectErrorResponse(t, gateway.URL+"/string/op/Concat/a/b", http.StatusNotFound, ErrorCodeNotFound, "")
+
+	// 路由的超时
+	expectErrorResponse(t, gateway.URL+"/api/slow/op", http.StatusGatewayTimeout, ErrorCodeUpstreamTimeout, "slow")
+}
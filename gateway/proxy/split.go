@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/hashicorp/consul/api"
+	"math/rand"
+	"micro-go/common/discover"
+	"net/http"
+)
+
+var (
+	ErrSplitVersionMissing = errors.New("split versions are missing")
+	ErrSplitVersionName    = errors.New("split version name is missing or duplicated")
+	ErrSplitWeight         = errors.New("split weights must not be negative and must not be all zero")
+)
+
+// 返回本次转发的版本
+const HeaderUpstreamVersion = "X-Upstream-Version"
+
+// 按实例的标签或元数据将流量按权重分到不同版本, 如 95% v1、5% v2
+// 请求头或 cookie 的值为版本名时固定转发到该版本
+//
+//	split:
+//	  header: X-Version
+//	  cookie: version
+//	  versions:
+//	    - {name: v1, weight: 95, tags: [v1]}
+//	    - {name: v2, weight: 5, meta: {version: v2}}
+type TrafficSplit struct {
+	Header   string          `json:"header"` // 指定版本的请求头
+	Cookie   string          `json:"cookie"` // 指定版本的 cookie
+	Versions []*SplitVersion `json:"versions"`
+
+	total int
+}
+
+// 版本及其实例的过滤条件
+type SplitVersion struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"` // 权重, 为 0 时只接收指定版本的请求
+	discover.InstanceFilter
+}
+
+func (split *TrafficSplit) validate() error {
+	if len(split.Versions) == 0 {
+		return ErrSplitVersionMissing
+	}
+	names := make(map[string]bool, len(split.Versions))
+	split.total = 0
+	for _, version := range split.Versions {
+		if version.Name == "" || names[version.Name] {
+			return ErrSplitVersionName
+		}
+		names[version.Name] = true
+		if version.Weight < 0 {
+			return ErrSplitWeight
+		}
+		split.total += version.Weight
+	}
+	if split.total == 0 {
+		return ErrSplitWeight
+	}
+	return nil
+}
+
+// 请求指定的版本, 没有指定或版本不存在时返回 nil
+func (split *TrafficSplit) override(req *http.Request) *SplitVersion {
+	var name string
+	if split.Header != "" {
+		name = req.Header.Get(split.Header)
+	}
+	if name == "" && split.Cookie != "" {
+		if cookie, err := req.Cookie(split.Cookie); err == nil {
+			name = cookie.Value
+		}
+	}
+	for _, version := range split.Versions {
+		if name != "" && version.Name == name {
+			return version
+		}
+	}
+	return nil
+}
+
+// 按权重随机选择版本
+func (split *TrafficSplit) choose() *SplitVersion {
+	n := rand.Intn(split.total)
+	for _, version := range split.Versions {
+		if n < version.Weight {
+			return version
+		}
+		n -= version.Weight
+	}
+	return split.Versions[len(split.Versions)-1]
+}
+
+/*
+*
+选择本次请求的版本及其实例
+指定的版本没有实例时返回空列表, 按权重选择的版本没有实例时不区分版本, 使用全部实例
+@param req 转发的请求
+@param services 服务的全部健康实例
+*/
+func (split *TrafficSplit) selectServices(req *http.Request, services []*api.AgentService) (string, []*api.AgentService) {
+	version := split.override(req)
+	forced := version != nil
+	if !forced {
+		version = split.choose()
+	}
+	result := make([]*api.AgentService, 0, len(services))
+	for _, service := range services {
+		if version.Match(&discover.ServiceInstance{Tags: service.Tags, Meta: service.Meta}) {
+			result = append(result, service)
+		}
+	}
+	if len(result) == 0 && !forced {
+		return "", services
+	}
+	return version.Name, result
+}
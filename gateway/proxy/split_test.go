@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"io/ioutil"
+	"micro-go/common/discover"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const splitRoutesYaml = `
+routes:
+  - name: string
+    match:
+      prefix: /string
+    service: string
+    split:
+      header: X-Version
+      cookie: version
+      versions:
+        - {name: v1, weight: 80, tags: [v1]}
+        - {name: v2, weight: 20, meta: {version: v2}}
+        - {name: v3, weight: 0, tags: [v3]}
+`
+
+func registerVersion(t *testing.T, client discover.DiscoveryClientV2, id, version string, options *discover.RegisterOptions) func() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(version))
+	}))
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	instancePort, _ := strconv.Atoi(port)
+	if err := client.Register(context.Background(), "string", id, "", host, instancePort, options); err != nil {
+		t.Fatal(err)
+	}
+	return server.Close
+}
+
+func TestTrafficSplit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gateway-split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "routes.yaml")
+	if err := ioutil.WriteFile(file, []byte(splitRoutesYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := NewRouteTable(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer routes.Close()
+
+	client, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	defer registerVersion(t, client, "string-1", "v1", &discover.RegisterOptions{Tags: []string{"v1"}})()
+	defer registerVersion(t, client, "string-2", "v1", &discover.RegisterOptions{Tags: []string{"v1"}})()
+	defer registerVersion(t, client, "string-3", "v2", &discover.RegisterOptions{Meta: map[string]string{"version": "v2"}})()
+
+	cache := NewServiceCache(client, log.NewNopLogger())
+	defer cache.Close()
+	gateway := httptest.NewServer(NewReverseProxy(cache, routes, newRoundRobin, nil, 0, log.NewNopLogger()))
+	defer gateway.Close()
+
+	get := func(header map[string]string, cookie *http.Cookie) (int, string) {
+		req, _ := http.NewRequest("GET", gateway.URL+"/string/op", nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusOK && resp.Header.Get(HeaderUpstreamVersion) != string(body) {
+			t.Fatalf("expect version header %s, got %s", body, resp.Header.Get(HeaderUpstreamVersion))
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	// 按 80/20 的权重分配
+	counts := map[string]int{}
+	for i := 0; i < 500; i++ {
+		_, version := get(nil, nil)
+		counts[version]++
+	}
+	if counts["v2"] < 50 || counts["v2"] > 150 || counts["v1"]+counts["v2"] != 500 {
+		t.Fatalf("unexpected split %v", counts)
+	}
+
+	// 请求头和 cookie 指定版本, 指定的版本没有实例时返回 503
+	for i := 0; i < 10; i++ {
+		if _, version := get(map[string]string{"X-Version": "v2"}, nil); version != "v2" {
+			t.Fatalf("expect header to force v2, got %s", version)
+		}
+		if _, version := get(nil, &http.Cookie{Name: "version", Value: "v1"}); version != "v1" {
+			t.Fatalf("expect cookie to force v1, got %s", version)
+		}
+	}
+	if status, _ := get(map[string]string{"X-Version": "v3"}, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("expect 503 for version without instances, got %d", status)
+	}
+
+	// 修改权重后无需重启
+	updated := strings.Replace(strings.Replace(splitRoutesYaml, "weight: 80", "weight: 0", 1), "weight: 20", "weight: 100", 1)
+	if err := ioutil.WriteFile(file, []byte(updated), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if routes.Routes()[0].Split.Versions[0].Weight == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("split weights not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 20; i++ {
+		if _, version := get(nil, nil); version != "v2" {
+			t.Fatalf("expect all traffic to v2 after reload, got %s", version)
+		}
+	}
+}
+
+func TestTrafficSplitValidate(t *testing.T) {
+	cases := []struct {
+		split TrafficSplit
+		err   error
+	}{
+		{TrafficSplit{}, ErrSplitVersionMissing},
+		{TrafficSplit{Versions: []*SplitVersion{{Name: "v1", Weight: 1}, {Name: "v1", Weight: 1}}}, ErrSplitVersionName},
+		{TrafficSplit{Versions: []*SplitVersion{{Weight: 1}}}, ErrSplitVersionName},
+		{TrafficSplit{Versions: []*SplitVersion{{Name: "v1"}, {Name: "v2"}}}, ErrSplitWeight},
+		{TrafficSplit{Versions: []*SplitVersion{{Name: "v1", Weight: -1}, {Name: "v2", Weight: 2}}}, ErrSplitWeight},
+		{TrafficSplit{Versions: []*SplitVersion{{Name: "v1", Weight: 0}, {Name: "v2", Weight: 2}}}, nil},
+	}
+	for i, c := range cases {
+		if err := c.split.validate(); err != c.err {
+			t.Fatalf("case %d: expect %v, got %v", i, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrRouteGrpcMethod     = errors.New("route grpc method is not registered")
+	ErrRouteGrpcErrorField = errors.New("route grpc error field must be a string field of the response")
+	ErrMessageTooLarge     = errors.New("message exceeds 4 MB")
+	ErrInvalidGrpcFrame    = errors.New("invalid grpc message frame")
+)
+
+// 转码消息的最大长度, 与 gRPC 默认的最大消息一致
+const maxTranscodeMessageSize = 4 << 20
+
+// 业务错误默认的状态码
+const DefaultGrpcErrorStatus = http.StatusBadRequest
+
+// JSON 请求转为 gRPC 调用的配置
+// 请求和响应的消息类型从 gRPC 服务的描述中获取, 网关需要导入生成的 pb 包
+//
+//	grpc:
+//	  method: pd.StringService/Concat
+//	  errorField: err
+//	  errors:
+//	    maximum size of 1024 bytes exceeded: 413
+type GrpcTranscode struct {
+	Method      string         `json:"method"`      // gRPC 方法, 如 pd.StringService/Concat
+	ErrorField  string         `json:"errorField"`  // 响应中表示业务错误的字符串字段, 不为空时返回错误
+	ErrorStatus int            `json:"errorStatus"` // 业务错误的状态码, 默认 400
+	Errors      map[string]int `json:"errors"`      // 按错误信息指定状态码
+
+	method protoreflect.MethodDescriptor
+	input  protoreflect.MessageType
+	output protoreflect.MessageType
+}
+
+func (transcode *GrpcTranscode) validate() error {
+	name := strings.Replace(strings.TrimPrefix(transcode.Method, "/"), "/", ".", 1)
+	descriptor, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return ErrRouteGrpcMethod
+	}
+	method, ok := descriptor.(protoreflect.MethodDescriptor)
+	if !ok || method.IsStreamingClient() || method.IsStreamingServer() {
+		return ErrRouteGrpcMethod
+	}
+	if transcode.input, err = protoregistry.GlobalTypes.FindMessageByName(method.Input().FullName()); err != nil {
+		return ErrRouteGrpcMethod
+	}
+	if transcode.output, err = protoregistry.GlobalTypes.FindMessageByName(method.Output().FullName()); err != nil {
+		return ErrRouteGrpcMethod
+	}
+	if transcode.ErrorField != "" {
+		field := method.Output().Fields().ByName(protoreflect.Name(transcode.ErrorField))
+		if field == nil || field.Kind() != protoreflect.StringKind || field.IsList() {
+			return ErrRouteGrpcErrorField
+		}
+	}
+	if transcode.ErrorStatus == 0 {
+		transcode.ErrorStatus = DefaultGrpcErrorStatus
+	}
+	transcode.method = method
+	return nil
+}
+
+// gRPC 请求路径 /{package.Service}/{Method}
+func (transcode *GrpcTranscode) path() string {
+	return "/" + string(transcode.method.Parent().FullName()) + "/" + string(transcode.method.Name())
+}
+
+// 将 JSON 请求体转为 gRPC 请求, 请求体为空时使用空消息
+func transcodeRequest(req *http.Request, transcode *GrpcTranscode) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxTranscodeMessageSize+1))
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(body) > maxTranscodeMessageSize {
+			return ErrMessageTooLarge
+		}
+	}
+	message := transcode.input.New().Interface()
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := protojson.Unmarshal(body, message); err != nil {
+			return err
+		}
+	}
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	// 5 字节的消息头: 是否压缩及消息长度
+	frame := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	copy(frame[5:], data)
+	req.Method = http.MethodPost
+	req.URL.RawQuery = ""
+	req.Body = ioutil.NopCloser(bytes.NewReader(frame))
+	req.ContentLength = int64(len(frame))
+	req.Header.Del("Content-Length")
+	req.Header.Del("Accept-Encoding")
+	req.Header.Set("Content-Type", "application/grpc")
+	return nil
+}
+
+// 将 gRPC 响应转为 JSON, grpc-status 与业务错误转为 HTTP 状态码
+func transcodeResponse(resp *http.Response, transcode *GrpcTranscode, service string) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 5+maxTranscodeMessageSize+1))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	// 只有头的响应在响应头中返回 grpc-status, 否则在读取响应体后的 trailer 中
+	grpcStatus := resp.Header.Get("Grpc-Status")
+	grpcMessage := resp.Header.Get("Grpc-Message")
+	if grpcStatus == "" {
+		grpcStatus = resp.Trailer.Get("Grpc-Status")
+		grpcMessage = resp.Trailer.Get("Grpc-Message")
+	}
+	for key := range resp.Header {
+		if strings.HasPrefix(key, "Grpc-") {
+			resp.Header.Del(key)
+		}
+	}
+	resp.Header.Del("Trailer")
+	resp.Trailer = nil
+
+	code, err := strconv.Atoi(grpcStatus)
+	if err != nil {
+		return ErrInvalidGrpcFrame
+	}
+	if codes.Code(code) != codes.OK {
+		if message, err := url.PathUnescape(grpcMessage); err == nil {
+			grpcMessage = message
+		}
+		return writeResponse(resp, httpStatus(codes.Code(code)), ErrorResponse{Code: grpcCodeName(codes.Code(code)), Service: service, Error: grpcMessage})
+	}
+
+	if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return ErrInvalidGrpcFrame
+	}
+	message := transcode.output.New()
+	if err := proto.Unmarshal(body[5:], message.Interface()); err != nil {
+		return err
+	}
+	if transcode.ErrorField != "" {
+		field := message.Descriptor().Fields().ByName(protoreflect.Name(transcode.ErrorField))
+		if errText := message.Get(field).String(); errText != "" {
+			status, ok := transcode.Errors[errText]
+			if !ok {
+				status = transcode.ErrorStatus
+			}
+			return writeResponse(resp, status, ErrorResponse{Code: ErrorCodeServiceError, Service: service, Error: errText})
+		}
+	}
+	data, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(message.Interface())
+	if err != nil {
+		return err
+	}
+	return writeResponse(resp, http.StatusOK, json.RawMessage(data))
+}
+
+// 以 JSON 替换响应
+func writeResponse(resp *http.Response, status int, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp.StatusCode = status
+	resp.Status = strconv.Itoa(status) + " " + http.StatusText(status)
+	resp.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	resp.ContentLength = int64(len(data))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return nil
+}
+
+// gRPC 状态码对应的 HTTP 状态码
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// gRPC 状态码的规范名称, 如 INVALID_ARGUMENT
+func grpcCodeName(code codes.Code) string {
+	var name []rune
+	for i, r := range code.String() {
+		if unicode.IsUpper(r) && i > 0 {
+			name = append(name, '_')
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return string(name)
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"micro-go/common/discover"
+	"micro-go/rpc_demo/pd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const transcodeRoutesYaml = `
+routes:
+  - name: string-concat
+    match:
+      prefix: /string/concat
+      methods: [POST]
+    service: string-grpc
+    grpc:
+      method: pd.StringService/Concat
+      errorField: err
+      errors:
+        maximum size exceeded: 413
+  - name: string-diff
+    match:
+      prefix: /string/diff
+    service: string-grpc
+    grpc:
+      method: /pd.StringService/Diff
+`
+
+// 长度超过 10 时返回业务错误, Diff 返回 gRPC 错误
+type transcodeStringServer struct {
+	pd.UnimplementedStringServiceServer
+}
+
+func (server *transcodeStringServer) Concat(ctx context.Context, req *pd.StringRequest) (*pd.StringResponse, error) {
+	if len(req.A)+len(req.B) > 10 {
+		return &pd.StringResponse{Err: "maximum size exceeded"}, nil
+	}
+	if req.A == "" {
+		return &pd.StringResponse{Err: "empty"}, nil
+	}
+	return &pd.StringResponse{Ret: req.A + req.B}, nil
+}
+
+func (server *transcodeStringServer) Diff(ctx context.Context, req *pd.StringRequest) (*pd.StringResponse, error) {
+	return nil, status.Error(codes.InvalidArgument, "diff is not supported")
+}
+
+func TestGrpcTranscode(t *testing.T) {
+	routes, err := newRouteTableFromYaml(transcodeRoutesYaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	host, port, stop := startGrpcUpstream(t, &transcodeStringServer{})
+	defer stop()
+	if err := client.Register(context.Background(), "string-grpc", "string-grpc-1", "", host, port, nil); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewServiceCache(client, log.NewNopLogger())
+	defer cache.Close()
+	gateway := httptest.NewServer(NewReverseProxy(cache, routes, newRoundRobin, nil, 0, log.NewNopLogger()))
+	defer gateway.Close()
+
+	post := func(path, body string, status int) map[string]interface{} {
+		resp, err := http.Post(gateway.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		result := map[string]interface{}{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != status || resp.Header.Get("Content-Type") != "application/json; charset=utf-8" {
+			t.Fatalf("%s %s: expect status %d, got %d %v", path, body, status, resp.StatusCode, result)
+		}
+		return result
+	}
+
+	if result := post("/string/concat", `{"A": "a", "B": "b"}`, http.StatusOK); result["Ret"] != "ab" || result["err"] != "" {
+		t.Fatalf("unexpected concat result %v", result)
+	}
+
+	// 业务错误按配置转换状态码, 未配置的使用默认状态码
+	result := post("/string/concat", `{"A": "0123456789", "B": "a"}`, http.StatusRequestEntityTooLarge)
+	if result["code"] != ErrorCodeServiceError || result["service"] != "string-grpc" || result["error"] != "maximum size exceeded" {
+		t.Fatalf("unexpected service error %v", result)
+	}
+	post("/string/concat", ``, DefaultGrpcErrorStatus)
+
+	// gRPC 状态码转换为 HTTP 状态码
+	if result := post("/string/diff", `{}`, http.StatusBadRequest); result["code"] != "INVALID_ARGUMENT" || result["error"] != "diff is not supported" {
+		t.Fatalf("unexpected grpc error %v", result)
+	}
+
+	// 无法解析的请求体
+	if result := post("/string/concat", `{"C": 1}`, http.StatusBadRequest); result["code"] != ErrorCodeBadRequest {
+		t.Fatalf("unexpected bad request %v", result)
+	}
+}
+
+func TestGrpcTranscodeValidate(t *testing.T) {
+	cases := []struct {
+		transcode GrpcTranscode
+		err       error
+	}{
+		{GrpcTranscode{Method: "pd.StringService/Concat", ErrorField: "err"}, nil},
+		{GrpcTranscode{Method: "pd.StringService/Missing"}, ErrRouteGrpcMethod},
+		{GrpcTranscode{Method: "pd.Missing/Concat"}, ErrRouteGrpcMethod},
+		{GrpcTranscode{Method: "pd.StringService/Concat", ErrorField: "Missing"}, ErrRouteGrpcErrorField},
+	}
+	for _, c := range cases {
+		if err := c.transcode.validate(); err != c.err {
+			t.Fatalf("%s: expect %v, got %v", c.transcode.Method, c.err, err)
+		}
+	}
+}
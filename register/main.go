@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	discover2 "micro-go/common/discover"
+	"micro-go/common/lifecycle"
 	config2 "micro-go/register/config"
 	endpoint2 "micro-go/register/endpoint"
 	service2 "micro-go/register/service"
@@ -30,6 +31,23 @@ func main() {
 		// consul 地址
 		consulPort = flag.Int("consul.port", 8500, "consul port")
 		consulHost = flag.String("consul.host", "127.0.0.1", "consul host")
+
+		// 注册中心类型, 非 consul 时使用对应的服务发现客户端
+		discoveryBackend = flag.String("discovery.backend", "consul", "service discovery backend: consul, etcd, static")
+		etcdEndpoints    = flag.String("etcd.endpoints", "127.0.0.1:2379", "etcd endpoints, comma separated")
+		discoveryFile    = flag.String("discovery.file", "", "static services file (yaml or json), used by static backend")
+		checkTTL         = flag.Duration("check.ttl", 0, "report health by ttl heartbeat instead of consul http check, 0 to disable")
+		checkHTTP        = flag.String("check.http", "", "extra http check urls, comma separated")
+		checkTCP         = flag.String("check.tcp", "", "extra tcp check addresses, comma separated")
+		checkGRPC        = flag.String("check.grpc", "", "extra grpc health check addresses, comma separated")
+		checkInterval    = flag.Duration("check.interval", discover2.DefaultCheckInterval, "health check interval")
+		checkTimeout     = flag.Duration("check.timeout", 0, "health check timeout, 0 for consul default")
+		deregisterAfter  = flag.Duration("check.deregister-after", discover2.DefaultDeregisterCriticalServiceAfter, "deregister instance after its checks stay critical for this long")
+		serviceTags      = flag.String("service.tags", "", "instance tags, comma separated, e.g. v2,canary")
+		serviceMeta      = flag.String("service.meta", "", "instance metadata, comma separated, e.g. version=v2,zone=cn-east")
+		serviceWeight    = flag.Int("service.weight", 0, "instance weight when passing, 0 for default")
+		drainTimeout     = flag.Duration("shutdown.drain", lifecycle.DefaultDrainTimeout, "wait after deregister before shutting down servers")
+		shutdownTimeout  = flag.Duration("shutdown.timeout", lifecycle.DefaultShutdownTimeout, "max time to wait for in-flight requests on shutdown")
 	)
 
 	flag.Parse()
@@ -38,16 +56,32 @@ func main() {
 	errChan := make(chan error)
 
 	// 声明服务发现客户端
-	var discoveryClient discover2.DiscoveryClient
-	discoveryClient = discover2.NewMyDiscoverClient(*consulHost, *consulPort)
-
-	//if err != nil {
-	//	config.Logger.Println("Get Consul Client failed")
-	//	os.Exit(-1)
-	//}
+	var discoveryClientV2 discover2.DiscoveryClientV2
+	if *discoveryBackend == discover2.BackendConsul {
+		discoveryClientV2 = discover2.NewMyDiscoverClient(*consulHost, *consulPort)
+	} else {
+		var err error
+		discoveryClientV2, err = discover2.NewDiscoveryClient(&discover2.BackendConfig{
+			Backend:       *discoveryBackend,
+			EtcdEndpoints: *etcdEndpoints,
+			StaticFile:    *discoveryFile,
+		})
+		if err != nil {
+			config2.Logger.Println("Get discovery client failed", err)
+			os.Exit(-1)
+		}
+	}
 
 	// 声明并初始化 Service
-	var svc = service2.NewDiscoveryServiceImpl(discoveryClient)
+	var svc = service2.NewDiscoveryServiceImpl(discoveryClientV2)
+	// 开启 TTL 模式, 由服务自身上报健康状态
+	if *checkTTL > 0 {
+		err := discover2.UseTTLCheck(discoveryClientV2, &discover2.TTLCheck{TTL: *checkTTL, HealthCheck: discover2.BoolHealthChecker(svc.HealthCheck)})
+		if err != nil {
+			config2.Logger.Println("Use ttl check failed", err)
+			os.Exit(-1)
+		}
+	}
 	// 创建打招呼的Endpoint
 	sayHelloEndpoint := endpoint2.MakeSayHelloEndpoint(svc)
 	// 创建服务发现的Endpoint
@@ -64,19 +98,49 @@ func main() {
 	// 创建http.Handler
 	r := transport.MakeHttpHandler(ctx, endpts, config2.KitLogger)
 
+	// 注册选项, 实例可以声明版本、区域和权重
+	registerOptions, err := discover2.NewRegisterOptions(&discover2.RegisterConfig{
+		Tags:                           *serviceTags,
+		Meta:                           *serviceMeta,
+		Weight:                         *serviceWeight,
+		HTTPChecks:                     *checkHTTP,
+		TCPChecks:                      *checkTCP,
+		GRPCChecks:                     *checkGRPC,
+		CheckInterval:                  *checkInterval,
+		CheckTimeout:                   *checkTimeout,
+		DeregisterCriticalServiceAfter: *deregisterAfter,
+	})
+	if err != nil {
+		config2.Logger.Println("Parse register options failed", err)
+		os.Exit(-1)
+	}
+
 	// 定义服务实例ID
 	instanceId := *serviceName + "-" + uuid.NewV4().String()
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(*servicePort),
+		Handler: r,
+	}
+
+	// 服务退出时先取消注册, 等待流量排空后再关闭服务器
+	shutdown := lifecycle.NewLifecycle(*drainTimeout, *shutdownTimeout)
+	shutdown.OnDeregister(func(ctx context.Context) error {
+		return discoveryClientV2.DeRegister(ctx, instanceId)
+	})
+	shutdown.AddHTTPServer(server)
+	shutdown.OnFlush(discoveryClientV2.Close)
 	// 启动 http server
 	go func() {
 		config2.Logger.Println("Http Server start at port:" + strconv.Itoa(*servicePort))
 		// 启动前执行注册
-		if !discoveryClient.Register(*serviceName, instanceId, "/health", *serviceHost, *servicePort, nil, config2.Logger) {
+		if err := discoveryClientV2.Register(ctx, *serviceName, instanceId, "/health", *serviceHost, *servicePort, registerOptions); err != nil {
+			config2.Logger.Println("Register service error!", err)
 			config2.Logger.Printf("string-service for service %s failed.", *serviceName)
 			// 注册失败, 服务启动失败
 			os.Exit(-1)
 		}
-		handler := r
-		errChan <- http.ListenAndServe(":"+strconv.Itoa(*servicePort), handler)
+		config2.Logger.Println("Register service success!")
+		errChan <- server.ListenAndServe()
 	}()
 
 	go func() {
@@ -87,7 +151,8 @@ func main() {
 	}()
 
 	error := <-errChan
-	// 服务退出取消注册
-	discoveryClient.DeRegister(instanceId, config2.Logger)
 	config2.Logger.Println(error)
+	if err := shutdown.Shutdown(); err != nil {
+		config2.Logger.Println("Shutdown service error!", err)
+	}
 }
@@ -22,10 +22,10 @@ type Service interface {
 var ErrNotServiceInstances = errors.New("instances are not existed")
 
 type DiscoveryServiceImpl struct {
-	discoveryClient discover2.DiscoveryClient
+	discoveryClient discover2.DiscoveryClientV2
 }
 
-func NewDiscoveryServiceImpl(discoveryClient discover2.DiscoveryClient) Service {
+func NewDiscoveryServiceImpl(discoveryClient discover2.DiscoveryClientV2) Service {
 	return &DiscoveryServiceImpl{discoveryClient: discoveryClient}
 }
 
@@ -42,8 +42,17 @@ func (service *DiscoveryServiceImpl) SaveHello() string {
 // 服务发现
 func (service *DiscoveryServiceImpl) DiscoveryService(ctx context.Context, serviceName string) ([]interface{}, error) {
 	// 从consul中根据服务名获取服务实例列表
-
-	//instances := service.discoveryClient.DiscoveryServices(serviceName, config.logg)
-
-	return nil, nil
+	instances, err := service.discoveryClient.DiscoveryServices(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, ErrNotServiceInstances
+	}
+
+	result := make([]interface{}, len(instances))
+	for i := 0; i < len(instances); i++ {
+		result[i] = instances[i]
+	}
+	return result, nil
 }
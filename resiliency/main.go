@@ -7,6 +7,7 @@ import (
 	"github.com/go-kit/kit/circuitbreaker"
 	uuid "github.com/satori/go.uuid"
 	"micro-go/common/discover"
+	"micro-go/common/lifecycle"
 	"micro-go/common/loadbalance"
 	"micro-go/resiliency/config"
 	"micro-go/resiliency/endpoint"
@@ -21,24 +22,95 @@ import (
 
 func main() {
 	var (
-		servicePort = flag.Int("service.port", 10086, "service port")
-		serviceHost = flag.String("service.host", "127.0.0.1", "service host")
-		consulPort  = flag.Int("consul.port", 8500, "consul port")
-		consulHost  = flag.String("consul.host", "127.0.0.1", "consul host")
-		serviceName = flag.String("service.name", "use-string", "service name")
+		servicePort      = flag.Int("service.port", 10086, "service port")
+		serviceHost      = flag.String("service.host", "127.0.0.1", "service host")
+		consulPort       = flag.Int("consul.port", 8500, "consul port")
+		consulHost       = flag.String("consul.host", "127.0.0.1", "consul host")
+		discoveryBackend = flag.String("discovery.backend", "consul", "service discovery backend: consul, etcd, static")
+		etcdEndpoints    = flag.String("etcd.endpoints", "127.0.0.1:2379", "etcd endpoints, comma separated")
+		discoveryFile    = flag.String("discovery.file", "", "static services file (yaml or json), used by static backend")
+		checkTTL         = flag.Duration("check.ttl", 0, "report health by ttl heartbeat instead of consul http check, 0 to disable")
+		checkHTTP        = flag.String("check.http", "", "extra http check urls, comma separated")
+		checkTCP         = flag.String("check.tcp", "", "extra tcp check addresses, comma separated")
+		checkGRPC        = flag.String("check.grpc", "", "extra grpc health check addresses, comma separated")
+		checkInterval    = flag.Duration("check.interval", discover.DefaultCheckInterval, "health check interval")
+		checkTimeout     = flag.Duration("check.timeout", 0, "health check timeout, 0 for consul default")
+		deregisterAfter  = flag.Duration("check.deregister-after", discover.DefaultDeregisterCriticalServiceAfter, "deregister instance after its checks stay critical for this long")
+		serviceTags      = flag.String("service.tags", "", "instance tags, comma separated, e.g. v2,canary")
+		serviceMeta      = flag.String("service.meta", "", "instance metadata, comma separated, e.g. version=v2,zone=cn-east")
+		serviceWeight    = flag.Int("service.weight", 0, "instance weight when passing, 0 for default")
+		drainTimeout     = flag.Duration("shutdown.drain", lifecycle.DefaultDrainTimeout, "wait after deregister before shutting down servers")
+		shutdownTimeout  = flag.Duration("shutdown.timeout", lifecycle.DefaultShutdownTimeout, "max time to wait for in-flight requests on shutdown")
+		serviceName      = flag.String("service.name", "use-string", "service name")
+		stringTags       = flag.String("string.tags", "", "only call string-service instances with these tags, comma separated")
+		stringMeta       = flag.String("string.meta", "", "only call string-service instances with this metadata, e.g. zone=cn-east")
+		localityZone     = flag.String("locality.zone", "", "caller zone, defaults to zone in -service.meta; prefer string-service instances in the same zone")
+		minLocal         = flag.Int("locality.min-instances", loadbalance.DefaultMinLocalInstances, "spill over to other zones when local string-service instances are fewer than this")
+		stringOutlier    = flag.Bool("string.outlier", true, "eject string-service instances that keep failing between consul health checks")
+		stringBalance    = flag.String("string.loadbalance", loadbalance.StrategyPeakEwma, "load balance strategy for string-service: random, round-robin, weighted-round-robin, consistent-hash, least-connection, peak-ewma")
 	)
 	flag.Parse()
 
 	ctx := context.Background()
 	errChan := make(chan error)
-	var discoveryClient discover.DiscoveryClient
-	discoveryClient, err := discover.NewKitDiscoverClient(*consulHost, *consulPort)
+	discoveryClientV2, err := discover.NewDiscoveryClient(&discover.BackendConfig{
+		Backend:       *discoveryBackend,
+		ConsulHost:    *consulHost,
+		ConsulPort:    *consulPort,
+		EtcdEndpoints: *etcdEndpoints,
+		StaticFile:    *discoveryFile,
+	})
 	if err != nil {
-		config.Logger.Println("Get Consul client failed")
+		config.Logger.Println("Get discovery client failed", err)
 		os.Exit(-1)
 	}
+
+	// 注册选项, 实例可以声明版本、区域和权重
+	registerOptions, err := discover.NewRegisterOptions(&discover.RegisterConfig{
+		Tags:                           *serviceTags,
+		Meta:                           *serviceMeta,
+		Weight:                         *serviceWeight,
+		HTTPChecks:                     *checkHTTP,
+		TCPChecks:                      *checkTCP,
+		GRPCChecks:                     *checkGRPC,
+		CheckInterval:                  *checkInterval,
+		CheckTimeout:                   *checkTimeout,
+		DeregisterCriticalServiceAfter: *deregisterAfter,
+	})
+	if err != nil {
+		config.Logger.Println("Parse register options failed", err)
+		os.Exit(-1)
+	}
+
 	var svc service.Service
-	svc = service.NewUseStringService(discoveryClient, &loadbalance.RandomLoadBalance{})
+	// 按标签和元数据选择 string-service 的版本或区域
+	stringFilter, err := discover.ParseInstanceFilter(*stringTags, *stringMeta)
+	if err != nil {
+		config.Logger.Println("Parse string-service filter failed", err)
+		os.Exit(-1)
+	}
+	// 默认按延迟选择实例, 较慢或失败的实例分到更少的请求
+	stringLoadBalance, err := loadbalance.NewLoadBalance(*stringBalance)
+	if err != nil {
+		config.Logger.Println("Create load balance failed", err)
+		os.Exit(-1)
+	}
+	// 优先调用同区域的实例, 本区域实例不足时溢出到其他区域
+	zone := loadbalance.LocalZone(*localityZone, registerOptions.Meta)
+	stringLoadBalance = loadbalance.NewZoneAwareLoadBalance(zone, *minLocal, stringLoadBalance)
+	// 被动摘除连续失败或失败率过高的实例, 摘除状态上报到 /metrics
+	if *stringOutlier {
+		stringLoadBalance = loadbalance.NewOutlierDetector(stringLoadBalance, nil, loadbalance.NewPrometheusOutlierMetrics("resiliency", "string_service"))
+	}
+	svc = service.NewUseStringService(discover.NewFilteredDiscoveryClient(discoveryClientV2, stringFilter), stringLoadBalance)
+	// 开启 TTL 模式, 由服务自身上报健康状态
+	if *checkTTL > 0 {
+		err := discover.UseTTLCheck(discoveryClientV2, &discover.TTLCheck{TTL: *checkTTL, HealthCheck: discover.BoolHealthChecker(svc.HealthCheck)})
+		if err != nil {
+			config.Logger.Println("Use ttl check failed", err)
+			os.Exit(-1)
+		}
+	}
 	useStringEndpoint := endpoint.MakeUseStringEndpoint(svc)
 	useStringEndpoint = circuitbreaker.Hystrix(service.StringServiceCommandName)(useStringEndpoint)
 
@@ -55,19 +127,32 @@ func main() {
 	r := transport.MakeHttpHandler(ctx, endpts, config.KitLogger)
 
 	instanceId := *serviceName + "-" + uuid.NewV4().String()
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(*servicePort),
+		Handler: r,
+	}
+
+	// 服务退出时先取消注册, 等待流量排空后再关闭服务器
+	shutdown := lifecycle.NewLifecycle(*drainTimeout, *shutdownTimeout)
+	shutdown.OnDeregister(func(ctx context.Context) error {
+		return discoveryClientV2.DeRegister(ctx, instanceId)
+	})
+	shutdown.AddHTTPServer(server)
+	shutdown.OnFlush(discoveryClientV2.Close)
 
 	// http server
 	go func() {
 		config.Logger.Println("http server start at port:" + strconv.Itoa(*servicePort))
 
 		// 启动前执行注册
-		if !discoveryClient.Register(*serviceName, instanceId, "/health", *serviceHost, *servicePort, nil, config.Logger) {
-			config.Logger.Printf("use-string-service for service %s failed.", serviceName)
+		if err := discoveryClientV2.Register(ctx, *serviceName, instanceId, "/health", *serviceHost, *servicePort, registerOptions); err != nil {
+			config.Logger.Println("Register service error!", err)
+			config.Logger.Printf("use-string-service for service %s failed.", *serviceName)
 			// 注册失败，服务启动失败
 			os.Exit(-1)
 		}
-		handler := r
-		errChan <- http.ListenAndServe(":"+strconv.Itoa(*servicePort), handler)
+		config.Logger.Println("Register service success!")
+		errChan <- server.ListenAndServe()
 	}()
 
 	go func() {
@@ -77,7 +162,8 @@ func main() {
 	}()
 
 	error := <-errChan
-	// 服务退出取消注册
-	discoveryClient.DeRegister(instanceId, config.Logger)
 	config.Logger.Println(error)
+	if err := shutdown.Shutdown(); err != nil {
+		config.Logger.Println("Shutdown service error!", err)
+	}
 }
@@ -1,22 +1,29 @@
 package service
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"github.com/afex/hystrix-go/hystrix"
-	"github.com/hashicorp/consul/api"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd/lb"
 	"micro-go/common/discover"
 	"micro-go/common/loadbalance"
 	"micro-go/resiliency/config"
 	"net/http"
-	"net/url"
-	"strconv"
+	"time"
 )
 
 // Service constants
 const (
 	StringServiceCommandName = "String.string"
 	StringService            = "string"
+
+	// 最多尝试的实例次数
+	StringServiceRetryMax = 3
+	// 包括重试在内的总超时
+	StringServiceRetryTimeout = 3 * time.Second
+	// 每个实例保持的空闲连接数
+	StringServiceMaxIdleConns = 32
 )
 
 var (
@@ -31,67 +38,47 @@ type Service interface {
 }
 
 type UseStringService struct {
-	// 服务发现客户端
-	discoveryClient discover.DiscoveryClient
-	// 负载均衡器
-	loadbalance loadbalance.LoadBalance
-}
-
-type StringResponse struct {
-	Result string `json:"result"`
-	Error  error  `json:"error"`
+	// 负载均衡并带重试的 string-service Endpoint
+	stringEndpoint endpoint.Endpoint
 }
 
 func (u UseStringService) UseStringService(operationType, a, b string) (string, error) {
-	var (
-		operationResult string
-		err             error
-	)
-
-	instances := u.discoveryClient.DiscoveryServices(StringService, config.Logger)
-	instanceList := make([]*api.AgentService, len(instances))
-	for i := 0; i < len(instances); i++ {
-		instanceList[i] = instances[i].(*api.AgentService)
-	}
-
-	// 使用负载均衡算法选取实例
-	selectInstance, err := u.loadbalance.SelectService(instanceList)
+	response, err := u.stringEndpoint(context.Background(), StringRequest{RequestType: operationType, A: a, B: b})
 	if err != nil {
-		return operationResult, err
+		return "", err
 	}
-
-	config.Logger.Printf("current string-service ID is %s and address:port is %s:%d\n", selectInstance.ID, selectInstance.Address, selectInstance.Port)
-
-	requestUrl := url.URL{
-		Scheme: "http",
-		Host:   selectInstance.Address + ":" + strconv.Itoa(selectInstance.Port),
-		Path:   "/op/" + operationType + "/" + a + "/" + b,
-	}
-
-	resp, err := http.Post(requestUrl.String(), "", nil)
-	if err == nil {
-		// 解析结果
-		result := &StringResponse{}
-		err = json.NewDecoder(resp.Body).Decode(result)
-		if err == nil && result.Error == nil {
-			operationResult = result.Result
-		}
+	result := response.(StringResponse)
+	if result.Error != "" {
+		return "", errors.New(result.Error)
 	}
-
-	return operationResult, err
+	return result.Result, nil
 }
 
 func (u UseStringService) HealthCheck() bool {
 	return true
 }
 
-func NewUseStringService(client discover.DiscoveryClient, lb loadbalance.LoadBalance) Service {
+/*
+*
+创建调用 string-service 的服务
+服务实例(sd.Instancer) -> 每个实例的 kithttp.Client(sd.Endpointer) -> 负载均衡(lb.Balancer) -> 重试(lb.Retry)
+@param client 服务发现客户端
+@param loadBalance 选择 string-service 实例的负载均衡器
+*/
+func NewUseStringService(client discover.DiscoveryClientV2, loadBalance loadbalance.LoadBalance) Service {
 	hystrix.ConfigureCommand(StringServiceCommandName, hystrix.CommandConfig{
 		RequestVolumeThreshold: 5,
 	})
+
+	// 所有实例共用连接池
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = StringServiceMaxIdleConns
+	httpClient := &http.Client{Transport: transport}
+
+	instancer := discover.NewInstancer(client, StringService, config.KitLogger)
+	balancer := loadbalance.NewBalancer(instancer, MakeStringServiceFactory(httpClient), loadBalance, config.KitLogger)
 	return &UseStringService{
-		discoveryClient: client,
-		loadbalance:     lb,
+		stringEndpoint: lb.Retry(StringServiceRetryMax, StringServiceRetryTimeout, balancer),
 	}
 }
 
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/hashicorp/consul/api"
+	"micro-go/common/discover"
+	"micro-go/common/loadbalance"
+	"micro-go/string-service/endpoint"
+	stringservice "micro-go/string-service/service"
+	"micro-go/string-service/transport"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 注册模拟的 string-service 实例
+func registerStringService(t *testing.T, client discover.DiscoveryClientV2, id string, handler http.HandlerFunc) func() {
+	server := httptest.NewServer(handler)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	instancePort, _ := strconv.Atoi(port)
+	if err := client.Register(context.Background(), StringService, id, "", host, instancePort, nil); err != nil {
+		t.Fatal(err)
+	}
+	return server.Close
+}
+
+func TestUseStringService(t *testing.T) {
+	client, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 故障实例返回 500, 请求重试到正常实例
+	defer registerStringService(t, client, "string-1", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"string service unavailable"}`))
+	})()
+	defer registerStringService(t, client, "string-2", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/op/Concat/ab/cd" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`{"result":"abcd","error":null}`))
+	})()
+
+	svc := NewUseStringService(client, &loadbalance.RoundRobinLoadBalance{})
+	for i := 0; i < 4; i++ {
+		result, err := svc.UseStringService("Concat", "ab", "cd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "abcd" {
+			t.Fatalf("expect abcd, got %s", result)
+		}
+	}
+}
+
+// 记录调用结果反馈的负载均衡器
+type recordingLoadBalance struct {
+	loadbalance.RoundRobinLoadBalance
+	mutex  sync.Mutex
+	errors []error
+}
+
+func (lb *recordingLoadBalance) Done(service *api.AgentService, latency time.Duration, err error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	lb.errors = append(lb.errors, err)
+}
+
+func TestUseStringServiceInvalidRequest(t *testing.T) {
+	client, err := discover.NewStaticDiscoveryClient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 使用 string-service 的 HTTP 处理方法, 非法的操作类型返回 400
+	var requests int32
+	stringService := stringservice.StringService{}
+	handler := transport.MakeHttpHandler(context.Background(), endpoint.StringEndpoints{
+		StringEndpoints:      endpoint.MakeStringEndpoint(stringService),
+		HealthCheckEndpoints: endpoint.MakeHealthCheckEndpoint(stringService),
+	}, log.NewNopLogger())
+	defer registerStringService(t, client, "string-1", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		handler.ServeHTTP(w, r)
+	})()
+	defer registerStringService(t, client, "string-2", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		handler.ServeHTTP(w, r)
+	})()
+
+	lb := &recordingLoadBalance{}
+	svc := NewUseStringService(client, lb)
+	if _, err := svc.UseStringService("Upper", "ab", "cd"); err == nil || err.Error() != endpoint.ErrInvalidRequestType.Error() {
+		t.Fatalf("expect %v, got %v", endpoint.ErrInvalidRequestType, err)
+	}
+
+	// 请求错误不重试, 也不作为实例故障反馈给负载均衡器
+	if requests := atomic.LoadInt32(&requests); requests != 1 {
+		t.Fatalf("expect 1 request without retries, got %d", requests)
+	}
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	if len(lb.errors) != 1 || lb.errors[0] != nil {
+		t.Fatalf("expect 1 successful feedback, got %v", lb.errors)
+	}
+}
+
+func TestDecodeStringResponseError(t *testing.T) {
+	// 4xx 没有 JSON 错误时以状态作为错误
+	recorder := httptest.NewRecorder()
+	recorder.WriteHeader(http.StatusNotFound)
+	recorder.Write([]byte("404 page not found"))
+	response, err := decodeStringResponse(context.Background(), recorder.Result())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.(StringResponse).Error != "404 Not Found" {
+		t.Fatalf("expect status as error, got %+v", response)
+	}
+
+	recorder = httptest.NewRecorder()
+	recorder.WriteHeader(http.StatusBadGateway)
+	if _, err := decodeStringResponse(context.Background(), recorder.Result()); err == nil || err.Error() != "502 Bad Gateway" {
+		t.Fatalf("expect 502 error, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	kithttp "github.com/go-kit/kit/transport/http"
+	"io"
+	"micro-go/resiliency/config"
+	"net/http"
+	"net/url"
+)
+
+// 调用 string-service 的请求
+type StringRequest struct {
+	RequestType string
+	A           string
+	B           string
+}
+
+// string-service 的响应, 错误为字符串, 正常时为 null
+type StringResponse struct {
+	Result string `json:"result"`
+	Error  string `json:"error"`
+}
+
+/*
+*
+为每个 string-service 实例创建 kithttp.Client
+@param client 所有实例共用的 http 客户端, 复用连接
+*/
+func MakeStringServiceFactory(client *http.Client) sd.Factory {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		tgt, err := url.Parse("http://" + instance)
+		if err != nil {
+			return nil, nil, err
+		}
+		e := kithttp.NewClient("POST", tgt, encodeStringRequest, decodeStringResponse, kithttp.SetClient(client)).Endpoint()
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			config.Logger.Printf("current string-service address:port is %s\n", instance)
+			return e(ctx, request)
+		}, nil, nil
+	}
+}
+
+// 请求参数放在路径中: /op/{type}/{a}/{b}
+func encodeStringRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	stringRequest := request.(StringRequest)
+	req.URL.Path = "/op/" + stringRequest.RequestType + "/" + stringRequest.A + "/" + stringRequest.B
+	return nil
+}
+
+func decodeStringResponse(ctx context.Context, resp *http.Response) (interface{}, error) {
+	response := StringResponse{}
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	// 5xx 视为实例故障, 由负载均衡器重试其他实例
+	if resp.StatusCode >= http.StatusInternalServerError {
+		if err == nil && response.Error != "" {
+			return nil, errors.New(response.Error)
+		}
+		return nil, errors.New(resp.Status)
+	}
+	// 4xx 为请求错误, 作为响应返回, 不重试也不计入实例故障
+	if resp.StatusCode >= http.StatusBadRequest && (err != nil || response.Error == "") {
+		return StringResponse{Error: resp.Status}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -96,7 +96,7 @@ type HealthResponse struct {
 
 func MakeHealthCheckEndpoint(svc service.Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		status := true
+		status := svc.HealthCheck()
 		return HealthResponse{Status: status}, nil
 	}
 }
@@ -3,20 +3,42 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"github.com/go-kit/kit/log"
+	uuid "github.com/satori/go.uuid"
 	"google.golang.org/grpc"
+	"micro-go/common/discover"
+	"micro-go/common/health"
+	"micro-go/common/lifecycle"
 	endpoint2 "micro-go/rpc_demo/kit/endpoint"
 	"micro-go/rpc_demo/kit/service"
 	"micro-go/rpc_demo/kit/transport"
 	"micro-go/rpc_demo/pd"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 )
 
+// gRPC 服务全名, 用于健康检查
+const grpcServiceName = "pd.StringService"
+
 func main() {
+	var (
+		serviceHost = flag.String("service.host", "127.0.0.1", "service host")
+		servicePort = flag.Int("service.port", 8080, "grpc service port")
+		serviceName = flag.String("service.name", "string-grpc", "service name")
+		consulHost  = flag.String("consul.host", "127.0.0.1", "consul host")
+		consulPort  = flag.Int("consul.port", 8500, "consul port")
+
+		drainTimeout    = flag.Duration("shutdown.drain", lifecycle.DefaultDrainTimeout, "wait after deregister before shutting down servers")
+		shutdownTimeout = flag.Duration("shutdown.timeout", lifecycle.DefaultShutdownTimeout, "max time to wait for in-flight requests on shutdown")
+	)
 	flag.Parse()
 
 	ctx := context.Background()
+	errChan := make(chan error)
 
 	// 日志
 	var logger log.Logger
@@ -45,8 +67,55 @@ func main() {
 
 	handler := transport.NewStringServer(ctx, endpts)
 
-	ls, _ := net.Listen("tcp", "127.0.0.1:8080")
+	ls, err := net.Listen("tcp", *serviceHost+":"+strconv.Itoa(*servicePort))
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
 	gRPCServer := grpc.NewServer()
 	pd.RegisterStringServiceServer(gRPCServer, handler)
-	gRPCServer.Serve(ls)
+	// grpc.health.v1 健康检查, 供 Consul 的 gRPC 检查使用
+	health.RegisterGrpcHealthServer(gRPCServer, svc.HealthCheck, grpcServiceName)
+
+	// 只提供 gRPC 服务, 不注册 HTTP 检查, 由 Consul 通过 gRPC 检查服务健康状态
+	discoveryClient, err := discover.NewKitDiscoverClient(*consulHost, *consulPort)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	instanceId := *serviceName + "-" + uuid.NewV4().String()
+	registerOptions := &discover.RegisterOptions{
+		Checks: []*discover.CheckOptions{{
+			Name: "grpc health",
+			GRPC: *serviceHost + ":" + strconv.Itoa(*servicePort) + "/" + grpcServiceName,
+		}},
+	}
+	// 服务退出时先取消注册, 等待流量排空后再关闭服务器
+	shutdown := lifecycle.NewLifecycle(*drainTimeout, *shutdownTimeout)
+	// 注册中心不可用时仍然提供服务
+	if err := discoveryClient.Register(ctx, *serviceName, instanceId, "", *serviceHost, *servicePort, registerOptions); err != nil {
+		logger.Log("register", "failed", "err", err)
+	} else {
+		shutdown.OnDeregister(func(ctx context.Context) error {
+			return discoveryClient.DeRegister(ctx, instanceId)
+		})
+	}
+	shutdown.AddGRPCServer(gRPCServer)
+	shutdown.OnFlush(discoveryClient.Close)
+
+	go func() {
+		errChan <- gRPCServer.Serve(ls)
+	}()
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		errChan <- fmt.Errorf("%s", <-c)
+	}()
+
+	error := <-errChan
+	logger.Log("exit", error)
+	if err := shutdown.Shutdown(); err != nil {
+		logger.Log("shutdown", "failed", "err", err)
+	}
 }
@@ -58,6 +58,6 @@ func (mw loggingMiddleware) HealthCheck() (result bool) {
 			"took", time.Since(begin),
 		)
 	}(time.Now())
-	result = true
+	result = mw.Service.HealthCheck()
 	return result
 }
@@ -24,6 +24,9 @@ type Service interface {
 
 	// a,b pkg string value
 	Diff(ctx context.Context, a, b string) (string, error)
+
+	// 健康检查
+	HealthCheck() bool
 }
 
 // service
@@ -60,5 +63,10 @@ func (s StringService) Diff(ctx context.Context, a, b string) (string, error) {
 	return res, nil
 }
 
+// 健康检查
+func (s StringService) HealthCheck() bool {
+	return true
+}
+
 // ServiceMiddleware define service middleware
 type ServiceMiddleware func(Service) Service
@@ -378,6 +378,10 @@ func (enhancer *JwtTokenEnhancer) Enhance(token *model.OAuth2Token, oauth2Detail
 
 func (enhancer *JwtTokenEnhancer) Extract(tokenValue string) (*model.OAuth2Token, *model.OAuth2Details, error) {
 	token, err := jwt.ParseWithClaims(tokenValue, &OAuth2TokenCustomClaims{}, func(token *jwt.Token) (i interface{}, e error) {
+		// 只接受密钥签名的令牌
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, ErrInvalidTokenRequest
+		}
 		return enhancer.secretKey, nil
 	})
 	if err != nil {
@@ -417,7 +421,8 @@ func (enhancer *JwtTokenEnhancer) sign(oauth2Token *model.OAuth2Token, oauth2Det
 		claims.RefreshToken = *oauth2Token.RefreshToken
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	// 使用密钥签名, 网关等持有密钥的服务可以直接校验令牌
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	tokenValue, err := token.SignedString(enhancer.secretKey)
 	if err == nil {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	uuid "github.com/satori/go.uuid"
 	"micro-go/common/discover"
+	"micro-go/common/lifecycle"
 	"micro-go/string-service/config"
 	"micro-go/string-service/endpoint"
 	"micro-go/string-service/plugins"
@@ -21,27 +22,55 @@ import (
 func main() {
 	// 获取命令行参数
 	var (
-		servicePort = flag.Int("service.port", 10085, "service port")
-		serviceHost = flag.String("service.host", "127.0.0.1", "service host")
-		consulPort  = flag.Int("consul.port", 8500, "consul port")
-		consulHost  = flag.String("consul.host", "127.0.0.1", "consul host")
-		serviceName = flag.String("service.name", "string", "service name")
+		servicePort      = flag.Int("service.port", 10085, "service port")
+		serviceHost      = flag.String("service.host", "127.0.0.1", "service host")
+		consulPort       = flag.Int("consul.port", 8500, "consul port")
+		consulHost       = flag.String("consul.host", "127.0.0.1", "consul host")
+		discoveryBackend = flag.String("discovery.backend", "consul", "service discovery backend: consul, etcd, static")
+		etcdEndpoints    = flag.String("etcd.endpoints", "127.0.0.1:2379", "etcd endpoints, comma separated")
+		discoveryFile    = flag.String("discovery.file", "", "static services file (yaml or json), used by static backend")
+		checkTTL         = flag.Duration("check.ttl", 0, "report health by ttl heartbeat instead of consul http check, 0 to disable")
+		checkHTTP        = flag.String("check.http", "", "extra http check urls, comma separated")
+		checkTCP         = flag.String("check.tcp", "", "extra tcp check addresses, comma separated")
+		checkGRPC        = flag.String("check.grpc", "", "extra grpc health check addresses, comma separated")
+		checkInterval    = flag.Duration("check.interval", discover.DefaultCheckInterval, "health check interval")
+		checkTimeout     = flag.Duration("check.timeout", 0, "health check timeout, 0 for consul default")
+		deregisterAfter  = flag.Duration("check.deregister-after", discover.DefaultDeregisterCriticalServiceAfter, "deregister instance after its checks stay critical for this long")
+		serviceTags      = flag.String("service.tags", "", "instance tags, comma separated, e.g. v2,canary")
+		serviceMeta      = flag.String("service.meta", "", "instance metadata, comma separated, e.g. version=v2,zone=cn-east")
+		serviceWeight    = flag.Int("service.weight", 0, "instance weight when passing, 0 for default")
+		drainTimeout     = flag.Duration("shutdown.drain", lifecycle.DefaultDrainTimeout, "wait after deregister before shutting down servers")
+		shutdownTimeout  = flag.Duration("shutdown.timeout", lifecycle.DefaultShutdownTimeout, "max time to wait for in-flight requests on shutdown")
+		serviceName      = flag.String("service.name", "string", "service name")
 	)
 	flag.Parse()
 
 	ctx := context.Background()
 	errChan := make(chan error)
 
-	var discoveryClient discover.DiscoveryClient
-	discoveryClient, err := discover.NewKitDiscoverClient(*consulHost, *consulPort)
+	discoveryClientV2, err := discover.NewDiscoveryClient(&discover.BackendConfig{
+		Backend:       *discoveryBackend,
+		ConsulHost:    *consulHost,
+		ConsulPort:    *consulPort,
+		EtcdEndpoints: *etcdEndpoints,
+		StaticFile:    *discoveryFile,
+	})
 	if err != nil {
-		config.Logger.Println("Get Consul Client Failed")
+		config.Logger.Println("Get discovery client failed", err)
 		os.Exit(-1)
 	}
 
 	var svc service.Service
 	svc = service.StringService{}
 	svc = plugins.LoggingMiddleware(config.KitLogger)(svc)
+	// 开启 TTL 模式, 由服务自身上报健康状态
+	if *checkTTL > 0 {
+		err := discover.UseTTLCheck(discoveryClientV2, &discover.TTLCheck{TTL: *checkTTL, HealthCheck: discover.BoolHealthChecker(svc.HealthCheck)})
+		if err != nil {
+			config.Logger.Println("Use ttl check failed", err)
+			os.Exit(-1)
+		}
+	}
 
 	// 创建 endpoint
 	stringEndpoint := endpoint.MakeStringEndpoint(svc)
@@ -56,18 +85,48 @@ func main() {
 	// 创建http.Handler
 	r := transport.MakeHttpHandler(ctx, endpts, config.KitLogger)
 
+	// 注册选项, 实例可以声明版本、区域和权重
+	registerOptions, err := discover.NewRegisterOptions(&discover.RegisterConfig{
+		Tags:                           *serviceTags,
+		Meta:                           *serviceMeta,
+		Weight:                         *serviceWeight,
+		HTTPChecks:                     *checkHTTP,
+		TCPChecks:                      *checkTCP,
+		GRPCChecks:                     *checkGRPC,
+		CheckInterval:                  *checkInterval,
+		CheckTimeout:                   *checkTimeout,
+		DeregisterCriticalServiceAfter: *deregisterAfter,
+	})
+	if err != nil {
+		config.Logger.Println("Parse register options failed", err)
+		os.Exit(-1)
+	}
+
 	instanceId := *serviceName + "-" + uuid.NewV4().String()
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(*servicePort),
+		Handler: r,
+	}
+
+	// 服务退出时先取消注册, 等待流量排空后再关闭服务器
+	shutdown := lifecycle.NewLifecycle(*drainTimeout, *shutdownTimeout)
+	shutdown.OnDeregister(func(ctx context.Context) error {
+		return discoveryClientV2.DeRegister(ctx, instanceId)
+	})
+	shutdown.AddHTTPServer(server)
+	shutdown.OnFlush(discoveryClientV2.Close)
 
 	// http server
 	go func() {
 		config.Logger.Println("HTTP server start at port:" + strconv.Itoa(*servicePort))
 		// 启动前 执行注册服务发现
-		if !discoveryClient.Register(*serviceName, instanceId, "/health", *serviceHost, *servicePort, nil, config.Logger) {
-			config.Logger.Printf("string-service for service %s failed.", serviceName)
+		if err := discoveryClientV2.Register(ctx, *serviceName, instanceId, "/health", *serviceHost, *servicePort, registerOptions); err != nil {
+			config.Logger.Println("Register service error!", err)
+			config.Logger.Printf("string-service for service %s failed.", *serviceName)
 			os.Exit(-1)
 		}
-		handler := r
-		errChan <- http.ListenAndServe(":"+strconv.Itoa(*servicePort), handler)
+		config.Logger.Println("Register service success!")
+		errChan <- server.ListenAndServe()
 	}()
 
 	// 监控系统关闭信号 ctr+c
@@ -77,8 +136,8 @@ func main() {
 		errChan <- fmt.Errorf("%s", <-c)
 	}()
 	error := <-errChan
-
-	// 服务退出 取消注册服务发现
-	discoveryClient.DeRegister(instanceId, config.Logger)
 	config.Logger.Println(error)
+	if err := shutdown.Shutdown(); err != nil {
+		config.Logger.Println("Shutdown service error!", err)
+	}
 }
@@ -68,10 +68,12 @@ func decodeStringRequest(i context.Context, request2 *http.Request) (request int
 	}, nil
 }
 
-// 自定义错误响应
+// 自定义错误响应, 请求参数错误返回 400, 调用方不会当作实例故障重试
 func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	switch err {
+	case ErrorBadRequest, endpoint.ErrInvalidRequestType:
+		w.WriteHeader(http.StatusBadRequest)
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -9,6 +9,7 @@ import (
 	zipkinhttpsvr "github.com/openzipkin/zipkin-go/middleware/http"
 	zipkinhttp "github.com/openzipkin/zipkin-go/reporter/http"
 	"math/rand"
+	"micro-go/common/lifecycle"
 	"net/http"
 	"net/http/httputil"
 	"os"
@@ -28,9 +29,14 @@ func main() {
 		consulPort = flag.String("consul.port", "8500", "consul server port")
 
 		zipkinURL = flag.String("zipkin.url", "http://127.0.0.1:9411/api/v2/spans", "Zipkin server url")
+
+		shutdownTimeout = flag.Duration("shutdown.timeout", lifecycle.DefaultShutdownTimeout, "max time to wait for in-flight requests on shutdown")
 	)
 	flag.Parse()
 
+	// 网关不注册到注册中心, 关闭时等待处理中的请求完成后上报链路追踪数据
+	shutdown := lifecycle.NewLifecycle(0, *shutdownTimeout)
+
 	// 创建日志组件
 	var logger log.Logger
 	{
@@ -49,7 +55,7 @@ func main() {
 			useNoopTracer = (*zipkinURL == "")
 			reporter      = zipkinhttp.NewReporter(*zipkinURL)
 		)
-		defer reporter.Close()
+		shutdown.OnFlush(reporter.Close)
 		zEP, _ := zipkin.NewEndpoint(serviceName, hostPort)
 		zipkinTracer, err = zipkin.NewTracer(reporter, zipkin.WithLocalEndpoint(zEP), zipkin.WithNoopTracer(useNoopTracer))
 
@@ -88,19 +94,28 @@ func main() {
 
 	errChan := make(chan error)
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errChan <- fmt.Errorf("%s", <-c)
 	}()
 
+	server := &http.Server{
+		Addr:    ":9090",
+		Handler: handler,
+	}
+	shutdown.AddHTTPServer(server)
+
 	// 开始监听
 	go func() {
 		logger.Log("transport", "HTTP", "addr", "9090")
-		errChan <- http.ListenAndServe(":9090", handler)
+		errChan <- server.ListenAndServe()
 	}()
 
 	// 等待结束
 	logger.Log("exit", <-errChan)
+	if err := shutdown.Shutdown(); err != nil {
+		logger.Log("shutdown", "failed", "err", err)
+	}
 }
 
 // NewReverseProxy 创建反向代理处理方法
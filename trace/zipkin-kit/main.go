@@ -13,6 +13,8 @@ import (
 	"github.com/openzipkin/zipkin-go"
 	zipkinhttp "github.com/openzipkin/zipkin-go/reporter/http"
 	"google.golang.org/grpc"
+	"micro-go/common/health"
+	"micro-go/common/lifecycle"
 	pd "micro-go/trace/zipkin-kit/pb"
 	endpoints "micro-go/trace/zipkin-kit/string-service/endpoint"
 	"micro-go/trace/zipkin-kit/string-service/service"
@@ -34,11 +36,16 @@ func main() {
 
 		zipkinURL = flag.String("zipkin.url", "http://127.0.0.1:9411/api/v2/spans", "zipkinURL")
 		grpcAddr  = flag.String("grpc", ":9008", "gRPC listen address")
+
+		drainTimeout    = flag.Duration("shutdown.drain", lifecycle.DefaultDrainTimeout, "wait after deregister before shutting down servers")
+		shutdownTimeout = flag.Duration("shutdown.timeout", lifecycle.DefaultShutdownTimeout, "max time to wait for in-flight requests on shutdown")
 	)
 	flag.Parse()
 
 	ctx := context.Background()
 	errChan := make(chan error)
+	// 服务退出时先取消注册, 等待流量排空后再关闭服务器, 最后上报链路追踪数据
+	shutdown := lifecycle.NewLifecycle(*drainTimeout, *shutdownTimeout)
 
 	var logger log.Logger
 	{
@@ -56,7 +63,7 @@ func main() {
 			useNoopTracer = (*zipkinURL == "")
 			reporter      = zipkinhttp.NewReporter(*zipkinURL)
 		)
-		defer reporter.Close()
+		shutdown.OnFlush(reporter.Close)
 
 		zEP, _ := zipkin.NewEndpoint(serviceName, hostPort)
 		zipkinTracer, err = zipkin.NewTracer(reporter, zipkin.WithLocalEndpoint(zEP), zipkin.WithNoopTracer(useNoopTracer))
@@ -93,14 +100,31 @@ func main() {
 	r := MakeHttpHandler(ctx, endpts, zipkinTracer, logger)
 
 	// 创建注册对象
-	register := Register(*consulHost, *consulPost, *serviceHost, *servicePort, logger)
+	_, grpcPort, err := net.SplitHostPort(*grpcAddr)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	register := Register(*consulHost, *consulPost, *serviceHost, *servicePort, grpcPort, logger)
+	shutdown.OnDeregister(func(ctx context.Context) error {
+		register.Deregister()
+		return nil
+	})
+
+	server := &http.Server{
+		Addr:    ":" + *servicePort,
+		Handler: r,
+	}
+	shutdown.AddHTTPServer(server)
+
+	gRPCServer := grpc.NewServer()
+	shutdown.AddGRPCServer(gRPCServer)
 
 	go func() {
 		fmt.Println("Http Server start at port:" + *servicePort)
 		// 启动注册
 		register.Register()
-		handler := r
-		errChan <- http.ListenAndServe(":"+*servicePort, handler)
+		errChan <- server.ListenAndServe()
 	}()
 
 	// grpc server
@@ -115,8 +139,9 @@ func main() {
 		serverTracer := kitzipkin.GRPCServerTrace(zipkinTracer, kitzipkin.Name("string-grpc-transport"))
 
 		handler := NewGrpcServer(ctx, endpts, serverTracer)
-		gRPCServer := grpc.NewServer()
 		pd.RegisterStringServiceServer(gRPCServer, handler)
+		// grpc.health.v1 健康检查, 供 Consul 的 gRPC 检查使用
+		health.RegisterGrpcHealthServer(gRPCServer, svc.HealthCheck, GrpcServiceName)
 		errChan <- gRPCServer.Serve(listener)
 	}()
 
@@ -127,12 +152,16 @@ func main() {
 	}()
 
 	error := <-errChan
-	// 服务退出取消注册
-	register.Deregister()
 	fmt.Println(error)
+	if err := shutdown.Shutdown(); err != nil {
+		logger.Log("shutdown", "failed", "err", err)
+	}
 }
 
-func Register(consulHost, consulPort, svcHost, svcPort string, logger log.Logger) (register sd.Registrar) {
+// gRPC 服务全名, 用于健康检查
+const GrpcServiceName = "pd.StringService"
+
+func Register(consulHost, consulPort, svcHost, svcPort, grpcPort string, logger log.Logger) (register sd.Registrar) {
 
 	// 创建Consul 客户端连接
 	var client consul.Client
@@ -155,6 +184,13 @@ func Register(consulHost, consulPort, svcHost, svcPort string, logger log.Logger
 		Timeout:  "1s",
 		Notes:    "Consul check service health status.",
 	}
+	// 通过 grpc.health.v1 检查 gRPC 服务
+	grpcCheck := api.AgentServiceCheck{
+		GRPC:     svcHost + ":" + grpcPort + "/" + GrpcServiceName,
+		Interval: "10s",
+		Timeout:  "1s",
+		Notes:    "Consul check grpc service health status.",
+	}
 
 	port, _ := strconv.Atoi(svcPort)
 
@@ -166,6 +202,9 @@ func Register(consulHost, consulPort, svcHost, svcPort string, logger log.Logger
 		Port:    port,
 		Address: svcHost,
 		Check:   &check,
+		Checks:  api.AgentServiceChecks{&grpcCheck},
+		// 网关转发 gRPC 请求时使用的端口
+		Meta: map[string]string{"grpc_port": grpcPort},
 	}
 
 	// 创建注册对象